@@ -1,16 +1,22 @@
 package broker
 
 import (
+	"context"
 	"errors"
 	"io"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/garyburd/redigo/redis"
+	"github.com/heroku/busl/trace"
 	"github.com/heroku/busl/util"
 )
 
 type writer struct {
 	channel channel
+	ctx     context.Context // parent of the write spans
 }
 
 // known errors
@@ -21,6 +27,12 @@ var (
 
 // NewWriter creates a new redis channel writer
 func NewWriter(key string) (io.WriteCloser, error) {
+	return NewWriterContext(context.Background(), key)
+}
+
+// NewWriterContext creates a new redis channel writer, tracing its
+// writes as children of the span in ctx.
+func NewWriterContext(ctx context.Context, key string) (io.WriteCloser, error) {
 	r, err := NewRedisRegistrar().IsRegistered(key)
 	if err != nil {
 		return nil, err
@@ -30,37 +42,65 @@ func NewWriter(key string) (io.WriteCloser, error) {
 		return nil, ErrNotRegistered
 	}
 
-	return &writer{channel(key)}, nil
+	return &writer{channel: channel(key), ctx: ctx}, nil
 }
 
 func (w *writer) Close() error {
+	_, span := trace.Start(w.ctx, "broker.close", trace.KindClient)
+	defer span.End()
+
 	conn := redisPool.Get()
 	defer conn.Close()
 
 	conn.Send("MULTI")
 	conn.Send("EXPIRE", w.channel.id(), redisKeyExpire)
+	conn.Send("EXPIRE", w.channel.timingID(), redisKeyExpire)
+	conn.Send("EXPIRE", w.channel.contentTypeID(), redisKeyExpire)
 	conn.Send("SETEX", w.channel.doneID(), redisChannelExpire, []byte{1})
+	conn.Send("SETEX", w.channel.modifiedID(), redisKeyExpire, time.Now().Unix())
 	conn.Send("PUBLISH", w.channel.killID(), 1)
 	_, err := conn.Do("EXEC")
+	span.SetError(err)
 	return err
 }
 
 func (w *writer) Write(p []byte) (int, error) {
+	_, span := trace.Start(w.ctx, "broker.write", trace.KindClient)
+	defer span.End()
+	span.SetAttribute("busl.bytes", strconv.Itoa(len(p)))
+
 	conn := redisPool.Get()
 	defer conn.Close()
 
 	conn.Send("MULTI")
 	conn.Send("APPEND", w.channel.id(), p)
-	conn.Send("EXPIRE", w.channel.id(), redisChannelExpire)
+	if len(p) > 0 {
+		conn.Send("APPEND", w.channel.timingID(), timingRecord(len(p), time.Now()))
+	}
+	renew(conn, w.channel)
 	conn.Send("DEL", w.channel.doneID())
+	conn.Send("SETEX", w.channel.modifiedID(), redisChannelExpire, time.Now().Unix())
 	conn.Send("PUBLISH", w.channel.id(), 1)
 
 	_, err := conn.Do("EXEC")
+	span.SetError(err)
 	return len(p), err
 }
 
+// renew extends the expiry of the data of a channel along with its
+// timing index and metadata, which would get out of step with it otherwise.
+func renew(conn redis.Conn, channel channel) error {
+	for _, id := range []string{channel.id(), channel.timingID(), channel.contentTypeID(), channel.modifiedID()} {
+		if err := conn.Send("EXPIRE", id, redisChannelExpire); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 type reader struct {
 	channel  channel
+	ctx      context.Context // parent of the fetch spans
 	psc      redis.PubSubConn
 	offset   int64
 	replayed bool
@@ -71,6 +111,12 @@ type reader struct {
 
 // NewReader creates a new redis channel reader
 func NewReader(key string) (io.ReadCloser, error) {
+	return NewReaderContext(context.Background(), key)
+}
+
+// NewReaderContext creates a new redis channel reader, tracing its
+// fetches as children of the span in ctx.
+func NewReaderContext(ctx context.Context, key string) (io.ReadCloser, error) {
 	r, err := NewRedisRegistrar().IsRegistered(key)
 	if err != nil {
 		return nil, err
@@ -80,12 +126,19 @@ func NewReader(key string) (io.ReadCloser, error) {
 		return nil, ErrNotRegistered
 	}
 
-	psc := redis.PubSubConn{Conn: redisPool.Get()}
+	// Subscriptions get their own connection: readers are closed while
+	// another goroutine may still be blocked receiving from it.
+	conn, err := redisPool.Dial()
+	if err != nil {
+		return nil, err
+	}
+	psc := redis.PubSubConn{Conn: conn}
 	channel := channel(key)
 	psc.PSubscribe(channel.wildcardID())
 
 	rd := &reader{
 		channel: channel,
+		ctx:     ctx,
 		psc:     psc,
 		mutex:   &sync.Mutex{}}
 
@@ -178,13 +231,23 @@ func (r *reader) read(msg redis.PMessage, p []byte) (n int, err error) {
 	return n, err
 }
 
-func (r *reader) fetch(length int) ([]byte, error) {
+func (r *reader) fetch(length int) (data []byte, err error) {
+	_, span := trace.Start(r.ctx, "broker.fetch", trace.KindClient)
+	defer func() {
+		span.SetAttribute("busl.offset", strconv.FormatInt(r.offset, 10))
+		span.SetAttribute("busl.bytes", strconv.Itoa(len(data)))
+		if err != io.EOF {
+			span.SetError(err)
+		}
+		span.End()
+	}()
+
 	conn := redisPool.Get()
 	defer conn.Close()
 
 	start, end := r.offset, r.offset+int64(length)
 
-	err := conn.Send("MULTI")
+	err = conn.Send("MULTI")
 	if err != nil {
 		return nil, err
 	}
@@ -200,8 +263,7 @@ func (r *reader) fetch(length int) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	err = conn.Send("EXPIRE", r.channel.id(), redisChannelExpire)
-	if err != nil {
+	if err = renew(conn, r.channel); err != nil {
 		return nil, err
 	}
 
@@ -209,7 +271,7 @@ func (r *reader) fetch(length int) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	data, err := redis.Bytes(list[0], err)
+	data, err = redis.Bytes(list[0], err)
 	if err != nil {
 		return nil, err
 	}
@@ -276,21 +338,6 @@ func NoContent(rd io.Reader, offset int64) bool {
 	return offset > (strlen - 1)
 }
 
-// RenewExpiry renews the channel expiration
-func RenewExpiry(rd io.Reader) {
-	r, ok := rd.(*reader)
-	if !ok {
-		return
-	}
-
-	conn := redisPool.Get()
-	defer conn.Close()
-
-	conn.Send("MULTI")
-	conn.Send("EXPIRE", r.channel.id(), redisChannelExpire)
-	conn.Do("EXEC")
-}
-
 // Len returns the length of data already send to the reader
 func Len(wd io.WriteCloser) (int64, error) {
 	w, ok := wd.(*writer)
@@ -307,3 +354,89 @@ func Len(wd io.WriteCloser) (int64, error) {
 
 	return strlen, nil
 }
+
+// Info describes a stream held by the broker
+type Info struct {
+	Length      int64     // number of bytes published so far
+	Done        bool      // whether the publisher closed the stream
+	ModTime     time.Time // last write or close, zero if unknown
+	ContentType string    // as given by the publisher, if at all
+}
+
+// Stat returns the length, state, modification time and content type of
+// a stream without subscribing to it.
+func Stat(key string) (*Info, error) {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	channel := channel(key)
+	conn.Send("MULTI")
+	conn.Send("EXISTS", channel.id())
+	conn.Send("STRLEN", channel.id())
+	conn.Send("EXISTS", channel.doneID())
+	conn.Send("GET", channel.modifiedID())
+	conn.Send("GET", channel.contentTypeID())
+
+	list, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return nil, err
+	}
+
+	exists, err := redis.Bool(list[0], nil)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, ErrNotRegistered
+	}
+
+	info := &Info{}
+	if info.Length, err = redis.Int64(list[1], nil); err != nil {
+		return nil, err
+	}
+	if info.Done, err = redis.Bool(list[2], nil); err != nil {
+		return nil, err
+	}
+	if modified, err := redis.Int64(list[3], nil); err == nil {
+		info.ModTime = time.Unix(modified, 0).UTC()
+	}
+	if contentType, err := redis.String(list[4], nil); err == nil {
+		info.ContentType = contentType
+	}
+
+	return info, nil
+}
+
+// Streams returns the keys of the streams held by the broker starting
+// with prefix, at most limit of them.
+func Streams(prefix string, limit int) ([]string, error) {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	pattern := globEscaper.Replace(prefix) + "*:id"
+	keys := []string{}
+	cursor := "0"
+	for {
+		reply, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", pattern, "COUNT", 1000))
+		if err != nil {
+			return nil, err
+		}
+		ids, err := redis.Strings(reply[1], nil)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range ids {
+			keys = append(keys, strings.TrimSuffix(id, ":id"))
+			if len(keys) == limit {
+				return keys, nil
+			}
+		}
+
+		if cursor, err = redis.String(reply[0], nil); err != nil || cursor == "0" {
+			return keys, err
+		}
+	}
+}
+
+// Escapes the characters redis patterns give a meaning to
+var globEscaper = strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`, `]`, `\]`)
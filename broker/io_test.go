@@ -237,3 +237,24 @@ func TestLen(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, int64(5), l)
 }
+
+func TestStreams(t *testing.T) {
+	prefix, _ := util.NewUUID()
+	registrar := NewRedisRegistrar()
+	registrar.Register(prefix + "/1")
+	registrar.Register(prefix + "/2")
+	registrar.Register(prefix + "/3")
+
+	keys, err := Streams(prefix+"/", 10)
+	assert.Nil(t, err)
+	assert.Len(t, keys, 3)
+	assert.Contains(t, keys, prefix+"/2")
+
+	keys, err = Streams(prefix+"/", 2)
+	assert.Nil(t, err)
+	assert.Len(t, keys, 2)
+
+	keys, err = Streams(prefix+"-", 10)
+	assert.Nil(t, err)
+	assert.Empty(t, keys)
+}
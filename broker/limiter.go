@@ -0,0 +1,87 @@
+package broker
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// RedisLimiter keeps rate limiting counters in redis, so limits apply
+// across every busl instance sharing it.
+type RedisLimiter struct{}
+
+// NewRedisLimiter creates a new limiter instance
+func NewRedisLimiter() *RedisLimiter {
+	return &RedisLimiter{}
+}
+
+// Allow counts an event for key in the current fixed window and
+// reports whether limit is still respected, along with the time left
+// until the window resets.
+func (l *RedisLimiter) Allow(key string, limit int64, window time.Duration) (bool, time.Duration, error) {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	now := time.Now().UnixNano()
+	slot := now / int64(window)
+	id := fmt.Sprintf("ratelimit:%s:%d", key, slot)
+
+	conn.Send("MULTI")
+	conn.Send("INCR", id)
+	conn.Send("PEXPIRE", id, int64(window/time.Millisecond))
+	list, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return true, 0, err
+	}
+
+	count, err := redis.Int64(list[0], nil)
+	if err != nil {
+		return true, 0, err
+	}
+
+	retry := time.Duration((slot+1)*int64(window) - now)
+	return count <= limit, retry, nil
+}
+
+// Acquire takes one of the limit concurrency slots for key. Slots
+// expire along with channels in case an instance dies without
+// releasing them.
+func (l *RedisLimiter) Acquire(key string, limit int64) (bool, error) {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	id := "concurrency:" + key
+	conn.Send("MULTI")
+	conn.Send("INCR", id)
+	conn.Send("EXPIRE", id, redisChannelExpire)
+	list, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return false, err
+	}
+
+	count, err := redis.Int64(list[0], nil)
+	if err != nil {
+		return false, err
+	}
+	if count > limit {
+		_, err = conn.Do("DECR", id)
+		return false, err
+	}
+	return true, nil
+}
+
+// Release gives back a slot taken with Acquire
+func (l *RedisLimiter) Release(key string) error {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	id := "concurrency:" + key
+	count, err := redis.Int64(conn.Do("DECR", id))
+	if err == nil && count < 0 {
+		// The counter expired while the slot was held, and would
+		// otherwise grant more slots than the limit from now on.
+		_, err = conn.Do("DEL", id)
+	}
+	return err
+}
@@ -0,0 +1,57 @@
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/heroku/busl/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedisLimiterAllow(t *testing.T) {
+	l := NewRedisLimiter()
+	key, _ := util.NewUUID()
+
+	for i := 0; i < 3; i++ {
+		ok, _, err := l.Allow(key, 3, time.Minute)
+		assert.Nil(t, err)
+		assert.True(t, ok)
+	}
+
+	ok, retry, err := l.Allow(key, 3, time.Minute)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	assert.True(t, retry > 0 && retry <= time.Minute)
+}
+
+func TestRedisLimiterAcquire(t *testing.T) {
+	l := NewRedisLimiter()
+	key, _ := util.NewUUID()
+
+	ok, err := l.Acquire(key, 1)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	ok, err = l.Acquire(key, 1)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	assert.Nil(t, l.Release(key))
+
+	ok, err = l.Acquire(key, 1)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	// Slots held past the expiry of the counter don't take it below zero
+	conn := redisPool.Get()
+	defer conn.Close()
+	conn.Do("DEL", "concurrency:"+key)
+	assert.Nil(t, l.Release(key))
+
+	ok, err = l.Acquire(key, 1)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	ok, err = l.Acquire(key, 1)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+}
@@ -0,0 +1,262 @@
+package broker
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/heroku/busl/util"
+)
+
+// QueueLease is how long the items an instance is processing stay
+// aside after it was last seen, before other instances put them back.
+const QueueLease = time.Minute
+
+// RedisQueue is a durable queue kept in redis. Items being processed
+// stay in a list of the instance processing them until acknowledged,
+// and items scheduled for later wait in a sorted set.
+type RedisQueue struct {
+	name     string
+	instance string
+}
+
+// NewRedisQueue creates a queue stored under name
+func NewRedisQueue(name string) *RedisQueue {
+	instance, _ := util.NewUUID()
+	return &RedisQueue{name: name, instance: instance}
+}
+
+func (q *RedisQueue) pendingID() string   { return q.name + ":pending" }
+func (q *RedisQueue) scheduledID() string { return q.name + ":scheduled" }
+
+func (q *RedisQueue) processingID(instance string) string {
+	return q.name + ":processing:" + instance
+}
+
+func (q *RedisQueue) aliveID(instance string) string {
+	return q.name + ":alive:" + instance
+}
+
+// Push adds an item, to be processed at or after at
+func (q *RedisQueue) Push(item []byte, at time.Time) error {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	var err error
+	if at.After(time.Now()) {
+		_, err = conn.Do("ZADD", q.scheduledID(), at.UnixNano()/int64(time.Millisecond), item)
+	} else {
+		_, err = conn.Do("LPUSH", q.pendingID(), item)
+	}
+	return err
+}
+
+// Pop returns the next item due, or nil when there is none. The item
+// is kept aside until acknowledged.
+func (q *RedisQueue) Pop() ([]byte, error) {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	if err := q.promote(conn); err != nil {
+		return nil, err
+	}
+	if _, err := conn.Do("SET", q.aliveID(q.instance), 1, "EX", int(QueueLease/time.Second)); err != nil {
+		return nil, err
+	}
+
+	item, err := redis.Bytes(conn.Do("RPOPLPUSH", q.pendingID(), q.processingID(q.instance)))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	return item, err
+}
+
+// promote moves scheduled items which are due to the pending list
+func (q *RedisQueue) promote(conn redis.Conn) error {
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	due, err := redis.Strings(conn.Do("ZRANGEBYSCORE", q.scheduledID(), "-inf", now))
+	if err != nil {
+		return err
+	}
+
+	for _, item := range due {
+		// Only one instance gets to remove, and push, each item
+		removed, err := redis.Int(conn.Do("ZREM", q.scheduledID(), item))
+		if err != nil {
+			return err
+		}
+		if removed == 1 {
+			if _, err := conn.Do("LPUSH", q.pendingID(), item); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Ack removes an item returned by Pop for good
+func (q *RedisQueue) Ack(item []byte) error {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("LREM", q.processingID(q.instance), 1, item)
+	return err
+}
+
+// Recover puts back the items which were being processed by instances
+// not seen for QueueLease, such as busl before it last restarted.
+// Items are thus processed at least once.
+func (q *RedisQueue) Recover() error {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	prefix := q.processingID("")
+	cursor := "0"
+	for {
+		reply, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", globEscaper.Replace(prefix)+"*", "COUNT", 1000))
+		if err != nil {
+			return err
+		}
+		lists, err := redis.Strings(reply[1], nil)
+		if err != nil {
+			return err
+		}
+		for _, list := range lists {
+			if err := q.recover(conn, strings.TrimPrefix(list, prefix)); err != nil {
+				return err
+			}
+		}
+
+		if cursor, err = redis.String(reply[0], nil); err != nil || cursor == "0" {
+			return err
+		}
+	}
+}
+
+// recover moves the items of an instance gone to the pending list. As
+// each item is moved atomically, instances recovering together never
+// put back the same item twice.
+func (q *RedisQueue) recover(conn redis.Conn, instance string) error {
+	if instance == q.instance {
+		return nil
+	}
+	if alive, err := redis.Bool(conn.Do("EXISTS", q.aliveID(instance))); alive || err != nil {
+		return err
+	}
+
+	for {
+		_, err := redis.Bytes(conn.Do("RPOPLPUSH", q.processingID(instance), q.pendingID()))
+		if err == redis.ErrNil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		util.Count("queue.recover")
+	}
+}
+
+// WatchExpired calls fn with the key of each stream expiring before
+// being closed, until done is closed. It relies on redis keyspace
+// notifications, which it tries to enable. When several instances
+// watch, only one of them gets each key.
+func WatchExpired(fn func(key string), done <-chan struct{}) error {
+	conn, err := redisPool.Dial()
+	if err != nil {
+		return err
+	}
+
+	// Managed redis providers may forbid CONFIG, expecting the
+	// setting to be made through their own tools instead.
+	if err := enableExpiredEvents(conn); err != nil {
+		util.CountWithData("broker.expired.config.error", 1, "error=%q", err)
+	}
+
+	psc := redis.PubSubConn{Conn: conn}
+	if err := psc.PSubscribe("__keyevent@*__:expired"); err != nil {
+		conn.Close()
+		return err
+	}
+
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
+		select {
+		case <-done:
+		case <-stopped:
+		}
+		psc.Close()
+	}()
+
+	for {
+		switch msg := psc.Receive().(type) {
+		case redis.PMessage:
+			if key, ok := expiredStream(string(msg.Data)); ok {
+				fn(key)
+			}
+		case error:
+			select {
+			case <-done:
+				return nil
+			default:
+				return msg
+			}
+		}
+	}
+}
+
+// enableExpiredEvents adds expired key events to the notifications
+// redis sends, keeping the ones other clients rely on.
+func enableExpiredEvents(conn redis.Conn) error {
+	config, err := redis.Strings(conn.Do("CONFIG", "GET", "notify-keyspace-events"))
+	if err != nil {
+		return err
+	}
+	if len(config) != 2 {
+		return fmt.Errorf("unexpected CONFIG GET reply: %q", config)
+	}
+
+	flags := expiredEventFlags(config[1])
+	if flags == config[1] {
+		return nil
+	}
+	_, err = conn.Do("CONFIG", "SET", "notify-keyspace-events", flags)
+	return err
+}
+
+// expiredEventFlags returns the notify-keyspace-events flags enabling
+// key event notifications of expired keys on top of flags.
+func expiredEventFlags(flags string) string {
+	if !strings.Contains(flags, "E") {
+		flags += "E"
+	}
+	// A is an alias for every class of events, expired ones included
+	if !strings.ContainsAny(flags, "xA") {
+		flags += "x"
+	}
+	return flags
+}
+
+// expiredStream tells whether an expired redis key was a stream which
+// wasn't closed, and claims it for this instance.
+func expiredStream(id string) (string, bool) {
+	if !strings.HasSuffix(id, ":id") {
+		return "", false
+	}
+	channel := channel(strings.TrimSuffix(id, ":id"))
+
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	// Closed streams expire shortly after being done
+	if done, _ := redis.Bool(conn.Do("EXISTS", channel.doneID())); done {
+		return "", false
+	}
+
+	claimed, err := conn.Do("SET", string(channel)+":expired", 1, "EX", redisKeyExpire, "NX")
+	if err != nil || claimed == nil {
+		return "", false
+	}
+	return string(channel), true
+}
@@ -0,0 +1,95 @@
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/heroku/busl/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedisQueue(t *testing.T) {
+	name, _ := util.NewUUID()
+	q := NewRedisQueue(name)
+
+	assert.Nil(t, q.Push([]byte("first"), time.Now()))
+	assert.Nil(t, q.Push([]byte("later"), time.Now().Add(time.Hour)))
+	assert.Nil(t, q.Push([]byte("soon"), time.Now().Add(50*time.Millisecond)))
+
+	item, err := q.Pop()
+	assert.Nil(t, err)
+	assert.Equal(t, "first", string(item))
+	assert.Nil(t, q.Ack(item))
+
+	item, err = q.Pop()
+	assert.Nil(t, err)
+	assert.Nil(t, item)
+
+	time.Sleep(100 * time.Millisecond)
+	item, err = q.Pop()
+	assert.Nil(t, err)
+	assert.Equal(t, "soon", string(item))
+}
+
+func TestRedisQueueRecover(t *testing.T) {
+	name, _ := util.NewUUID()
+	stopped := NewRedisQueue(name)
+
+	assert.Nil(t, stopped.Push([]byte("unacked"), time.Now()))
+	item, _ := stopped.Pop()
+	assert.Equal(t, "unacked", string(item))
+
+	// Items of a running instance are left alone
+	q := NewRedisQueue(name)
+	assert.Nil(t, q.Recover())
+	item, _ = q.Pop()
+	assert.Nil(t, item)
+
+	// Popped but never acknowledged, as if busl had stopped
+	conn := redisPool.Get()
+	conn.Do("DEL", stopped.aliveID(stopped.instance))
+	conn.Close()
+
+	assert.Nil(t, q.Recover())
+	item, err := q.Pop()
+	assert.Nil(t, err)
+	assert.Equal(t, "unacked", string(item))
+
+	// Nor are items this instance is processing put back
+	assert.Nil(t, q.Recover())
+	assert.Nil(t, NewRedisQueue(name).Recover())
+	assert.Nil(t, q.Ack(item))
+	item, _ = q.Pop()
+	assert.Nil(t, item)
+}
+
+func TestExpiredEventFlags(t *testing.T) {
+	assert.Equal(t, "Ex", expiredEventFlags(""))
+	assert.Equal(t, "KlEx", expiredEventFlags("Kl"))
+	assert.Equal(t, "Ex", expiredEventFlags("Ex"))
+	assert.Equal(t, "KEA", expiredEventFlags("KEA"))
+	assert.Equal(t, "KAE", expiredEventFlags("KA"))
+}
+
+func TestExpiredStream(t *testing.T) {
+	uuid, _ := util.NewUUID()
+	assert.Nil(t, NewRedisRegistrar().Register(uuid))
+
+	_, ok := expiredStream(uuid + ":modified")
+	assert.False(t, ok)
+
+	key, ok := expiredStream(uuid + ":id")
+	assert.True(t, ok)
+	assert.Equal(t, uuid, key)
+
+	// Already claimed by another instance
+	_, ok = expiredStream(uuid + ":id")
+	assert.False(t, ok)
+
+	closed, _ := util.NewUUID()
+	assert.Nil(t, NewRedisRegistrar().Register(closed))
+	writer, _ := NewWriter(closed)
+	writer.Close()
+	_, ok = expiredStream(closed + ":id")
+	assert.False(t, ok)
+}
@@ -31,6 +31,34 @@ func (p *pool) Get() Conn {
 	return Conn{p.Pool.Get(), p}
 }
 
+// Dial opens a connection outside of the pool. Closing it closes the
+// network connection right away, interrupting any pending Receive.
+func (p *pool) Dial() (Conn, error) {
+	c, err := p.Pool.Dial()
+	if err != nil {
+		return Conn{}, err
+	}
+	n := atomic.AddInt64(&p.c, 1)
+	util.SampleWithData("redis.connections", n, "at=acquire")
+	return Conn{c, p}, nil
+}
+
+// PoolStats describes the redis connections of this node
+type PoolStats struct {
+	InUse   int64 // checked out of the pool or dialed for subscriptions
+	Open    int   // opened by the pool, idle ones included
+	MaxIdle int
+}
+
+// Stats returns the current state of the redis connection pool
+func Stats() PoolStats {
+	return PoolStats{
+		InUse:   atomic.LoadInt64(&redisPool.c),
+		Open:    redisPool.ActiveCount(),
+		MaxIdle: redisPool.MaxIdle,
+	}
+}
+
 type Conn struct {
 	redis.Conn
 	p *pool
@@ -106,6 +134,18 @@ func (c channel) killID() string {
 	return string(c) + ":kill"
 }
 
+func (c channel) modifiedID() string {
+	return string(c) + ":modified"
+}
+
+func (c channel) timingID() string {
+	return string(c) + ":timing"
+}
+
+func (c channel) contentTypeID() string {
+	return string(c) + ":type"
+}
+
 // RedisRegistrar is a channel storing data on redis
 type RedisRegistrar struct{}
 
@@ -122,7 +162,10 @@ func (rr *RedisRegistrar) Register(channelName string) (err error) {
 	defer conn.Close()
 
 	channel := channel(channelName)
-	_, err = conn.Do("SETEX", channel.id(), redisChannelExpire, make([]byte, 0))
+	conn.Send("MULTI")
+	conn.Send("SETEX", channel.id(), redisChannelExpire, make([]byte, 0))
+	conn.Send("SETEX", channel.modifiedID(), redisChannelExpire, time.Now().Unix())
+	_, err = conn.Do("EXEC")
 	if err != nil {
 		util.CountWithData("RedisRegistrar.Register.error", 1, "error=%s", err)
 	}
@@ -150,3 +193,35 @@ func Get(key string) ([]byte, error) {
 	channel := channel(key)
 	return redis.Bytes(conn.Do("GET", channel.id()))
 }
+
+// GetRange returns length bytes of a key value, starting at offset
+func GetRange(key string, offset, length int64) ([]byte, error) {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	channel := channel(key)
+	return redis.Bytes(conn.Do("GETRANGE", channel.id(), offset, offset+length-1))
+}
+
+// SetContentType records the content type of a stream, as given by
+// its publisher. The first one recorded is kept.
+func SetContentType(key, contentType string) error {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("SET", channel(key).contentTypeID(), contentType, "EX", redisChannelExpire, "NX")
+	return err
+}
+
+// ContentType returns the content type of a stream, which is empty
+// when its publisher didn't give one.
+func ContentType(key string) (string, error) {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	contentType, err := redis.String(conn.Do("GET", channel(key).contentTypeID()))
+	if err == redis.ErrNil {
+		return "", nil
+	}
+	return contentType, err
+}
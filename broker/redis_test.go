@@ -49,3 +49,19 @@ func TestRegisteredNoError(t *testing.T) {
 	_, err = NewWriter(uuid)
 	assert.Nil(t, err)
 }
+
+func TestContentType(t *testing.T) {
+	reg, uuid := newRegUUID()
+	reg.Register(uuid)
+
+	contentType, err := ContentType(uuid)
+	assert.Nil(t, err)
+	assert.Equal(t, "", contentType)
+
+	assert.Nil(t, SetContentType(uuid, "text/plain; charset=iso-8859-1"))
+	assert.Nil(t, SetContentType(uuid, "application/json"))
+
+	contentType, err = ContentType(uuid)
+	assert.Nil(t, err)
+	assert.Equal(t, "text/plain; charset=iso-8859-1", contentType)
+}
@@ -0,0 +1,78 @@
+package broker
+
+import (
+	"encoding/binary"
+	"sort"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Each write is recorded in the timing index of its stream as the time
+// it arrived, in milliseconds since the epoch, followed by its length.
+const timingRecordSize = 12
+
+func timingRecord(length int, t time.Time) []byte {
+	buf := make([]byte, timingRecordSize)
+	binary.BigEndian.PutUint64(buf, uint64(t.UnixNano()/int64(time.Millisecond)))
+	binary.BigEndian.PutUint32(buf[8:], uint32(length))
+	return buf
+}
+
+// Arrival is when the chunk of a stream starting at Offset was published
+type Arrival struct {
+	Offset int64
+	Length int64
+	Time   time.Time
+}
+
+// Timing tells when each chunk of a stream was published
+type Timing []Arrival
+
+// ParseTiming decodes a timing index, as returned by GetTiming
+func ParseTiming(index []byte) Timing {
+	timing := make(Timing, 0, len(index)/timingRecordSize)
+	var offset int64
+	for i := 0; i+timingRecordSize <= len(index); i += timingRecordSize {
+		ms := int64(binary.BigEndian.Uint64(index[i:]))
+		length := int64(binary.BigEndian.Uint32(index[i+8:]))
+		timing = append(timing, Arrival{
+			Offset: offset,
+			Length: length,
+			Time:   time.Unix(0, ms*int64(time.Millisecond)),
+		})
+		offset += length
+	}
+	return timing
+}
+
+// Find returns the index of the chunk holding offset, or -1 when none
+// was recorded there.
+func (t Timing) Find(offset int64) int {
+	i := sort.Search(len(t), func(i int) bool { return t[i].Offset > offset }) - 1
+	if i < 0 || offset >= t[i].Offset+t[i].Length {
+		return -1
+	}
+	return i
+}
+
+// At returns when the byte at offset was published, if known
+func (t Timing) At(offset int64) (time.Time, bool) {
+	if i := t.Find(offset); i >= 0 {
+		return t[i].Time, true
+	}
+	return time.Time{}, false
+}
+
+// GetTiming returns the timing index of a stream, which is empty for
+// streams published before timings were recorded.
+func GetTiming(key string) ([]byte, error) {
+	conn := redisPool.Get()
+	defer conn.Close()
+
+	index, err := redis.Bytes(conn.Do("GET", channel(key).timingID()))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	return index, err
+}
@@ -0,0 +1,66 @@
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/heroku/busl/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTiming(t *testing.T) {
+	uuid, _ := util.NewUUID()
+	assert.Nil(t, NewRedisRegistrar().Register(uuid))
+	writer, _ := NewWriter(uuid)
+
+	start := time.Now().Add(-time.Second)
+	writer.Write([]byte("hello"))
+	time.Sleep(50 * time.Millisecond)
+	writer.Write([]byte(" world"))
+	writer.Close()
+
+	index, err := GetTiming(uuid)
+	assert.Nil(t, err)
+	timing := ParseTiming(index)
+
+	assert.Equal(t, 2, len(timing))
+	assert.Equal(t, int64(0), timing[0].Offset)
+	assert.Equal(t, int64(5), timing[1].Offset)
+	assert.True(t, timing[0].Time.After(start))
+	assert.True(t, timing[1].Time.Sub(timing[0].Time) >= 40*time.Millisecond)
+
+	assert.Equal(t, 0, timing.Find(4))
+	assert.Equal(t, 1, timing.Find(5))
+	assert.Equal(t, -1, timing.Find(11))
+	at, ok := timing.At(7)
+	assert.True(t, ok)
+	assert.Equal(t, timing[1].Time, at)
+
+	_, ok = Timing{}.At(0)
+	assert.False(t, ok)
+}
+
+func TestTimingRenewed(t *testing.T) {
+	uuid, _ := util.NewUUID()
+	assert.Nil(t, NewRedisRegistrar().Register(uuid))
+	writer, _ := NewWriter(uuid)
+	writer.Write([]byte("hello"))
+
+	conn := redisPool.Get()
+	defer conn.Close()
+	conn.Do("EXPIRE", channel(uuid).timingID(), 5)
+	conn.Do("EXPIRE", channel(uuid).modifiedID(), 5)
+
+	// Reading renews the timing index and modification time along
+	// with the data
+	reader, _ := NewReader(uuid)
+	defer reader.Close()
+	reader.Read(make([]byte, 5))
+
+	for _, id := range []string{channel(uuid).timingID(), channel(uuid).modifiedID()} {
+		ttl, err := redis.Int64(conn.Do("TTL", id))
+		assert.Nil(t, err)
+		assert.True(t, ttl > 5)
+	}
+}
@@ -13,16 +13,31 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/heroku/busl/broker"
 	"github.com/heroku/busl/server"
+	"github.com/heroku/busl/trace"
+	"github.com/heroku/busl/util"
 	"github.com/heroku/rollbar"
 )
 
 var nonWordCharacters = regexp.MustCompile(`\W`)
 
+// How long to wait before recovering webhooks again after an error
+const webhookRecoverRetry = 5 * time.Second
+
 type cmdConfig struct {
 	RollbarEnvironment string
 	RollbarToken       string
 
+	LogFormat string
+	LogLevel  string
+
+	MetricsSinks string
+	StatsDAddr   string
+
+	TracingExporter string
+	OTLPEndpoint    string
+
 	HTTPPort         string
 	HTTPReadTimeout  time.Duration
 	HTTPWriteTimeout time.Duration
@@ -41,6 +56,25 @@ func main() {
 		rollbar.ServerRoot = "github.com/heroku/busl"
 	}
 
+	if err = setupLogging(cmdConf); err != nil {
+		log.Printf("%s: %v\n", os.Args[0], err)
+		os.Exit(1)
+	}
+
+	if err = setupMetrics(cmdConf, httpConf); err != nil {
+		log.Printf("%s: %v\n", os.Args[0], err)
+		os.Exit(1)
+	}
+
+	setupWebhooks(httpConf)
+
+	shutdownTracing, err := setupTracing(cmdConf)
+	if err != nil {
+		log.Printf("%s: %v\n", os.Args[0], err)
+		os.Exit(1)
+	}
+	defer shutdownTracing()
+
 	_, err = strconv.Atoi(cmdConf.HTTPPort)
 	if err != nil {
 		log.Printf("%s: $PORT must be an integer value.\n", os.Args[0])
@@ -50,7 +84,8 @@ func main() {
 	s := server.NewServer(httpConf)
 	s.ReadTimeout = cmdConf.HTTPReadTimeout
 	s.WriteTimeout = cmdConf.HTTPWriteTimeout
-	s.Start(cmdConf.HTTPPort, awaitSignals(syscall.SIGURG))
+	go reloadOnSignal(s, syscall.SIGHUP)
+	s.Start(cmdConf.HTTPPort, awaitSignals(syscall.SIGTERM, syscall.SIGINT))
 }
 
 func parseFlags() (*cmdConfig, *server.Config, error) {
@@ -61,19 +96,222 @@ func parseFlags() (*cmdConfig, *server.Config, error) {
 	cmdConf.RollbarToken = os.Getenv("ROLLBAR_TOKEN")
 
 	cmdConf.HTTPPort = os.Getenv("PORT")
+	cmdConf.StatsDAddr = os.Getenv("STATSD_ADDR")
+	cmdConf.TracingExporter = os.Getenv("TRACING_EXPORTER")
+	cmdConf.OTLPEndpoint = os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+	if cmdConf.OTLPEndpoint == "" {
+		cmdConf.OTLPEndpoint = "http://localhost:4318"
+	}
+	flag.StringVar(&cmdConf.LogFormat, "logFormat", util.FormatL2met, "Log format: l2met or json.")
+	flag.StringVar(&cmdConf.LogLevel, "logLevel", "info", "Minimum log level: debug, info, warn or error.")
+	flag.StringVar(&cmdConf.MetricsSinks, "metricsSinks", "log", "Comma separated metrics sinks: log, prometheus and statsd.")
 	flag.DurationVar(&cmdConf.HTTPReadTimeout, "httpReadTimeout", time.Hour, "Timeout for HTTP request reading")
 	flag.DurationVar(&cmdConf.HTTPWriteTimeout, "httpWriteTimeout", time.Hour, "Timeout for HTTP request writing")
 
 	httpConf.Credentials = os.Getenv("CREDS")
+	auth, err := authenticator(httpConf.Credentials)
+	if err != nil {
+		log.Printf("%s: %v\n", os.Args[0], err)
+		return nil, nil, err
+	}
+	httpConf.Authenticator = auth
 	httpConf.EnforceHTTPS = os.Getenv("ENFORCE_HTTPS") == "1"
+	httpConf.TrustProxy = os.Getenv("TRUST_PROXY") == "1"
 	flag.DurationVar(&httpConf.HeartbeatDuration, "subscribeHeartbeatDuration", time.Second*10, "Heartbeat interval for HTTP stream subscriptions.")
+	flag.DurationVar(&httpConf.MinHeartbeatDuration, "subscribeHeartbeatMin", time.Second, "Shortest heartbeat interval subscribers may ask for.")
+	flag.DurationVar(&httpConf.MaxHeartbeatDuration, "subscribeHeartbeatMax", time.Minute*5, "Longest heartbeat interval subscribers may ask for.")
 	httpConf.StorageBaseURL = getStorageBaseURL
+	httpConf.TokenSecret = os.Getenv("TOKEN_SECRET")
+	httpConf.RequireReadToken = os.Getenv("REQUIRE_READ_TOKEN") == "1"
+	httpConf.RequireCredentials = os.Getenv("REQUIRE_CREDENTIALS") == "1"
+	httpConf.CORS.AllowedOrigins = splitList(os.Getenv("CORS_ORIGINS"))
+	httpConf.CORS.AllowedMethods = splitList(os.Getenv("CORS_METHODS"))
+	httpConf.CORS.AllowedHeaders = splitList(os.Getenv("CORS_HEADERS"))
+	httpConf.CORS.AllowCredentials = os.Getenv("CORS_ALLOW_CREDENTIALS") == "1"
+	if err := httpConf.CORS.Validate(); err != nil {
+		log.Printf("%s: %v\n", os.Args[0], err)
+		return nil, nil, err
+	}
+	flag.DurationVar(&httpConf.CORS.MaxAge, "corsMaxAge", time.Minute*10, "How long browsers may cache CORS preflight responses.")
+	flag.Int64Var(&httpConf.RateLimits.RequestsPerSecond, "rateLimitRequests", 0, "Requests per second allowed per client IP or token, 0 for no limit.")
+	flag.Int64Var(&httpConf.RateLimits.SubscriptionsPerStream, "rateLimitStreamSubscriptions", 0, "Concurrent subscriptions allowed per stream, 0 for no limit.")
+	flag.Int64Var(&httpConf.RateLimits.SubscriptionsPerClient, "rateLimitClientSubscriptions", 0, "Concurrent subscriptions allowed per client, 0 for no limit.")
+	flag.Int64Var(&httpConf.RateLimits.PublishBytesPerSecond, "rateLimitPublishBytes", 0, "Bytes per second a publisher may send before being throttled, 0 for no limit.")
+	if os.Getenv("RATE_LIMIT_REDIS") == "1" {
+		httpConf.Limiter = broker.NewRedisLimiter()
+	}
+	httpConf.TLS.CertFile = os.Getenv("TLS_CERT_FILE")
+	httpConf.TLS.KeyFile = os.Getenv("TLS_KEY_FILE")
+	httpConf.TLS.ClientCAFile = os.Getenv("TLS_CLIENT_CA_FILE")
+	httpConf.TLS.CipherSuites = splitList(os.Getenv("TLS_CIPHER_SUITES"))
+	flag.StringVar(&httpConf.TLS.MinVersion, "tlsMinVersion", "1.2", "Minimum TLS version accepted: 1.0, 1.1, 1.2 or 1.3 (Go 1.12+ builds).")
+	flag.DurationVar(&httpConf.TLS.ReloadInterval, "tlsReloadInterval", time.Minute, "How often TLS certificate files are checked for changes.")
+	flag.DurationVar(&httpConf.DrainTimeout, "shutdownDrainTimeout", time.Second*25, "Time given to subscribers and publishers to disconnect on shutdown.")
+	httpConf.Webhooks.URLs = splitList(os.Getenv("WEBHOOK_URLS"))
+	httpConf.Webhooks.Secret = os.Getenv("WEBHOOK_SECRET")
+	flag.IntVar(&httpConf.Webhooks.MaxAttempts, "webhookMaxAttempts", 10, "Attempts made to deliver each webhook before giving up.")
+	flag.IntVar(&httpConf.Webhooks.Concurrency, "webhookConcurrency", 4, "Webhooks delivered at once.")
+	flag.DurationVar(&httpConf.TokenTTL, "streamTokenTTL", time.Hour*24, "Validity of the publish and read tokens handed out on stream creation.")
 
 	flag.Parse()
 
+	if err := httpConf.TLS.Validate(); err != nil {
+		log.Printf("%s: %v\n", os.Args[0], err)
+		return nil, nil, err
+	}
+
 	return cmdConf, httpConf, nil
 }
 
+// Combines every configured way of authenticating callers:
+//
+//   - CREDS: `user:password|user:password` basic auth credentials
+//   - AUTH_USERS_FILE: a file of `user:password` lines
+//   - AUTH_TOKENS: comma separated static bearer tokens
+//   - JWT_SECRETS, JWT_KEY_FILES: comma separated HMAC secrets and
+//     PEM / JWKS files used to validate JWTs, along with the optional
+//     JWT_ISSUER and JWT_AUDIENCE.
+func authenticator(creds string) (server.Authenticator, error) {
+	var auths []server.Authenticator
+
+	// Basic auth users listed in ADMIN_USERS may administer nodes
+	admins := splitList(os.Getenv("ADMIN_USERS"))
+	basic := func(auth server.Authenticator) server.Authenticator {
+		if len(admins) > 0 {
+			return server.NewAdminAuthenticator(auth, admins...)
+		}
+		return auth
+	}
+
+	if creds != "" {
+		auth, err := server.NewBasicAuthenticator(creds)
+		if err != nil {
+			return nil, err
+		}
+		auths = append(auths, basic(auth))
+	}
+
+	if path := os.Getenv("AUTH_USERS_FILE"); path != "" {
+		auth, err := server.LoadBasicAuthenticator(path)
+		if err != nil {
+			return nil, err
+		}
+		auths = append(auths, basic(auth))
+	}
+
+	if tokens := splitList(os.Getenv("AUTH_TOKENS")); len(tokens) > 0 {
+		auths = append(auths, server.NewBearerAuthenticator(tokens...))
+	}
+	if tokens := splitList(os.Getenv("ADMIN_TOKENS")); len(tokens) > 0 {
+		auths = append(auths, server.NewAdminAuthenticator(server.NewBearerAuthenticator(tokens...)))
+	}
+
+	secrets, keyFiles := splitList(os.Getenv("JWT_SECRETS")), splitList(os.Getenv("JWT_KEY_FILES"))
+	if len(secrets) > 0 || len(keyFiles) > 0 {
+		jwt := &server.JWTAuthenticator{
+			Issuer:   os.Getenv("JWT_ISSUER"),
+			Audience: os.Getenv("JWT_AUDIENCE"),
+		}
+		for _, secret := range secrets {
+			jwt.AddSecret([]byte(secret))
+		}
+		for _, path := range keyFiles {
+			if err := jwt.LoadKeys(path); err != nil {
+				return nil, err
+			}
+		}
+		auths = append(auths, jwt)
+	}
+
+	if len(auths) == 0 {
+		return nil, nil
+	}
+	return server.MultiAuthenticator(auths...), nil
+}
+
+func setupLogging(cmdConf *cmdConfig) error {
+	if err := util.SetLogLevel(cmdConf.LogLevel); err != nil {
+		return err
+	}
+	return util.SetLogFormat(cmdConf.LogFormat)
+}
+
+// Sends metrics to every configured sink. The prometheus sink gets
+// served on /metrics.
+func setupMetrics(cmdConf *cmdConfig, httpConf *server.Config) error {
+	var sinks []util.Sink
+	for _, name := range splitList(cmdConf.MetricsSinks) {
+		switch name {
+		case "log":
+			sinks = append(sinks, util.LogSink{})
+		case "prometheus":
+			sink := util.NewPrometheusSink()
+			httpConf.Metrics = sink
+			sinks = append(sinks, sink)
+		case "statsd":
+			sink, err := util.NewStatsDSink(cmdConf.StatsDAddr)
+			if err != nil {
+				return err
+			}
+			sinks = append(sinks, sink)
+		default:
+			return fmt.Errorf("unknown metrics sink %q", name)
+		}
+	}
+	util.SetSinks(sinks...)
+	return nil
+}
+
+// Delivers webhooks from a queue kept in redis, putting back the
+// deliveries left in flight by instances which stopped.
+func setupWebhooks(httpConf *server.Config) {
+	if !httpConf.Webhooks.Enabled() {
+		return
+	}
+	queue := broker.NewRedisQueue("busl:webhooks")
+	httpConf.Webhooks.Queue = queue
+	go recoverWebhooks(queue)
+}
+
+// Recovers deliveries for as long as busl runs, retrying sooner when
+// redis can't be reached.
+func recoverWebhooks(queue *broker.RedisQueue) {
+	for {
+		wait := broker.QueueLease
+		if err := queue.Recover(); err != nil {
+			log.Printf("%s: recovering webhooks: %v\n", os.Args[0], err)
+			wait = webhookRecoverRetry
+		}
+		time.Sleep(wait)
+	}
+}
+
+// Enables tracing when TRACING_EXPORTER is `stdout` or `otlp`. The
+// returned function flushes the remaining spans.
+func setupTracing(cmdConf *cmdConfig) (func(), error) {
+	switch cmdConf.TracingExporter {
+	case "":
+		return func() {}, nil
+	case "stdout":
+		trace.SetExporter(trace.NewWriterExporter(os.Stdout))
+		return func() {}, nil
+	case "otlp":
+		exporter := trace.NewOTLPExporter(cmdConf.OTLPEndpoint, "busl")
+		trace.SetExporter(exporter)
+		return func() { exporter.Shutdown() }, nil
+	}
+	return nil, fmt.Errorf("unknown tracing exporter %q", cmdConf.TracingExporter)
+}
+
+func splitList(s string) (list []string) {
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
 func getStorageBaseURL(r *http.Request) string {
 	prefix := strings.ToUpper(nonWordCharacters.ReplaceAllString(r.Host, "_"))
 	if v := os.Getenv(fmt.Sprintf("%v_STORAGE_BASE_URL", prefix)); v != "" {
@@ -83,6 +321,16 @@ func getStorageBaseURL(r *http.Request) string {
 	return os.Getenv("STORAGE_BASE_URL")
 }
 
+// Reloads the TLS certificates of s each time one of signals is received
+func reloadOnSignal(s *server.Server, signals ...os.Signal) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, signals...)
+	for sig := range c {
+		log.Printf("signals.received signal=%v\n", sig)
+		s.ReloadCertificates()
+	}
+}
+
 func awaitSignals(signals ...os.Signal) <-chan struct{} {
 	s := make(chan os.Signal, 1)
 	signal.Notify(s, signals...)
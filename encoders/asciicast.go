@@ -0,0 +1,163 @@
+package encoders
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+	"unicode/utf8"
+)
+
+// Events without a known arrival time are at least this far apart
+const syntheticEventInterval = 50 * time.Millisecond
+
+// Asciicast configures the rendering of a stream as an asciicast v2
+// recording, as played by asciinema.
+type Asciicast struct {
+	Width, Height int // 80x24 when zero
+
+	// Tells when the byte at offset was published, if known. Streams
+	// are otherwise timed as they are read.
+	Arrival func(offset int64) (time.Time, bool)
+}
+
+type asciicastHeader struct {
+	Version   int   `json:"version"`
+	Width     int   `json:"width"`
+	Height    int   `json:"height"`
+	Timestamp int64 `json:"timestamp"`
+}
+
+type asciicastEncoder struct {
+	io.ReadCloser // stores the original reader
+	config        Asciicast
+	offset        int64 // offset for Seek purposes
+
+	started bool
+	start   time.Time     // of the first event
+	last    time.Duration // of the previous event
+	partial []byte        // incomplete UTF-8 sequence ending the last read
+	out     bytes.Buffer  // encoded events, yet to be read
+	err     error
+}
+
+// NewAsciicastEncoder creates an encoder rendering the stream as an
+// asciicast v2 document: a header followed by `[time, "o", data]` events.
+func NewAsciicastEncoder(r io.ReadCloser, config Asciicast) Encoder {
+	if config.Width <= 0 {
+		config.Width = 80
+	}
+	if config.Height <= 0 {
+		config.Height = 24
+	}
+	if config.Arrival == nil {
+		config.Arrival = func(int64) (time.Time, bool) { return time.Time{}, false }
+	}
+	return &asciicastEncoder{ReadCloser: r, config: config}
+}
+
+func (r *asciicastEncoder) Seek(offset int64, whence int) (n int64, err error) {
+	if seeker, ok := r.ReadCloser.(io.ReadSeeker); ok {
+		r.offset, err = seeker.Seek(offset, whence)
+	} else {
+		// The underlying reader doesn't support seeking, but
+		// we should still update the offset so the times will
+		// properly reflect the adjusted offset.
+
+		if whence != io.SeekStart {
+			return 0, errors.New("Only SeekStart is supported")
+		}
+		r.offset += offset
+	}
+
+	return r.offset, err
+}
+
+func (r *asciicastEncoder) Read(p []byte) (n int, err error) {
+	if !r.started {
+		r.writeHeader()
+	}
+
+	for r.out.Len() == 0 && r.err == nil {
+		buf := make([]byte, len(p))
+		n, r.err = r.ReadCloser.Read(buf)
+		if n > 0 {
+			r.writeEvent(r.offset, buf[:n])
+			r.offset += int64(n)
+		}
+		if r.err == io.EOF && len(r.partial) > 0 {
+			r.writeEvent(r.offset, nil)
+		}
+	}
+
+	if r.out.Len() > 0 {
+		return r.out.Read(p)
+	}
+	return 0, r.err
+}
+
+func (r *asciicastEncoder) writeHeader() {
+	r.started = true
+	r.start = time.Now()
+	if t, ok := r.config.Arrival(r.offset); ok {
+		r.start = t
+	}
+
+	buf, _ := json.Marshal(&asciicastHeader{
+		Version:   2,
+		Width:     r.config.Width,
+		Height:    r.config.Height,
+		Timestamp: r.start.Unix(),
+	})
+	r.out.Write(buf)
+	r.out.WriteByte('\n')
+}
+
+// writeEvent outputs data read at offset, holding back an incomplete
+// UTF-8 sequence ending it until the next read.
+func (r *asciicastEncoder) writeEvent(offset int64, data []byte) {
+	offset -= int64(len(r.partial))
+	data = append(r.partial, data...)
+	r.partial = nil
+	if r.err != io.EOF {
+		cut := completeUTF8(data)
+		r.partial = append(r.partial, data[cut:]...)
+		data = data[:cut]
+	}
+	if len(data) == 0 {
+		return
+	}
+
+	var at time.Duration
+	if t, ok := r.config.Arrival(offset); ok {
+		at = t.Sub(r.start)
+	} else {
+		at = time.Since(r.start)
+		if at < r.last+syntheticEventInterval {
+			at = r.last + syntheticEventInterval
+		}
+	}
+	if at < r.last {
+		at = r.last
+	}
+	r.last = at
+
+	text, _ := json.Marshal(string(data))
+	fmt.Fprintf(&r.out, "[%.6f, \"o\", %s]\n", at.Seconds(), text)
+}
+
+// completeUTF8 returns the length of b without the incomplete UTF-8
+// sequence it may end with.
+func completeUTF8(b []byte) int {
+	for i := len(b) - 1; i >= 0 && i >= len(b)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(b[i]) {
+			if !utf8.FullRune(b[i:]) {
+				return i
+			}
+			break
+		}
+	}
+	return len(b)
+}
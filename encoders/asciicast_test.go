@@ -0,0 +1,54 @@
+package encoders
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAsciicast(t *testing.T) {
+	start := time.Unix(1500000000, 0)
+	arrivals := map[int64]time.Time{0: start, 6: start.Add(1500 * time.Millisecond)}
+
+	r := &readSeekerCloser{strings.NewReader("hello world")}
+	enc := NewAsciicastEncoder(&chunkedReader{r, []int{6, 5}}, Asciicast{
+		Width: 120,
+		Arrival: func(offset int64) (time.Time, bool) {
+			t, ok := arrivals[offset]
+			return t, ok
+		},
+	})
+
+	assert.Equal(t, `{"version":2,"width":120,"height":24,"timestamp":1500000000}
+[0.000000, "o", "hello "]
+[1.500000, "o", "world"]
+`, readstring(enc))
+}
+
+func TestAsciicastSynthetic(t *testing.T) {
+	r := &readSeekerCloser{strings.NewReader("aéb")}
+	// The second read splits the two bytes of é
+	enc := NewAsciicastEncoder(&chunkedReader{r, []int{2, 2}}, Asciicast{})
+
+	lines := strings.Split(readstring(enc), "\n")
+	assert.Equal(t, 4, len(lines))
+	assert.Contains(t, lines[0], `"width":80,"height":24`)
+	assert.Equal(t, `[0.050000, "o", "a"]`, lines[1])
+	assert.Equal(t, `[0.100000, "o", "éb"]`, lines[2])
+}
+
+// chunkedReader returns reads of the given sizes
+type chunkedReader struct {
+	*readSeekerCloser
+	sizes []int
+}
+
+func (r *chunkedReader) Read(p []byte) (int, error) {
+	if len(r.sizes) > 0 {
+		p = p[:r.sizes[0]]
+		r.sizes = r.sizes[1:]
+	}
+	return r.readSeekerCloser.Read(p)
+}
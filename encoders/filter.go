@@ -0,0 +1,205 @@
+package encoders
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"regexp"
+	"time"
+)
+
+// Lines longer than this are split as if they ended there
+const maxLineLength = 64 * 1024
+
+// LineFilter keeps the lines of a stream matching a pattern, or not
+// matching it when inverted, along with Context lines around them.
+type LineFilter struct {
+	Pattern *regexp.Regexp
+	Invert  bool
+	Context int
+}
+
+func (f *LineFilter) keep(line []byte) bool {
+	return f.Pattern.Match(bytes.TrimRight(line, "\r\n")) != f.Invert
+}
+
+// offsetReader is implemented by readers which don't return every
+// byte of their source, telling where in the source they are.
+type offsetReader interface {
+	Offset() int64
+}
+
+// line is a line of the source, which starts at offset
+type line struct {
+	data     []byte
+	offset   int64
+	number   int64
+	received time.Time // when its first byte was read
+}
+
+// lineSplitter cuts a source into lines
+type lineSplitter struct {
+	offset   int64     // in the source, of the next line
+	number   int64     // of the next line
+	partial  []byte    // beginning of a line yet to end
+	received time.Time // of the partial line
+}
+
+// split calls fn with the complete lines of buf, read at the given
+// time, following the partial one left over. That last one is complete
+// too once the source is done.
+func (s *lineSplitter) split(buf []byte, read time.Time, done bool, fn func(line)) {
+	if len(s.partial) == 0 {
+		s.received = read
+	}
+	s.partial = append(s.partial, buf...)
+
+	for {
+		i := bytes.IndexByte(s.partial, '\n')
+		if i < 0 && len(s.partial) > maxLineLength {
+			i = maxLineLength - 1
+		}
+		if i < 0 {
+			break
+		}
+		s.emit(s.partial[:i+1], fn)
+		s.partial = s.partial[i+1:]
+		s.received = read
+	}
+
+	if done && len(s.partial) > 0 {
+		s.emit(s.partial, fn)
+		s.partial = nil
+	}
+}
+
+func (s *lineSplitter) emit(data []byte, fn func(line)) {
+	fn(line{data: append([]byte(nil), data...), offset: s.offset, number: s.number, received: s.received})
+	s.offset += int64(len(data))
+	// Parts of overly long lines keep the same number
+	if data[len(data)-1] == '\n' {
+		s.number++
+	}
+}
+
+// lineSelector applies a filter to successive lines
+type lineSelector struct {
+	filter *LineFilter
+	before []line // lines preceding the next match, for context
+	after  int    // lines still to keep after the last match
+}
+
+// selectLine appends to out the lines kept once l is known
+func (s *lineSelector) selectLine(l line, out []line) []line {
+	switch {
+	case s.filter == nil:
+		out = append(out, l)
+	case s.filter.keep(l.data):
+		out = append(out, s.before...)
+		out = append(out, l)
+		s.before = s.before[:0]
+		s.after = s.filter.Context
+	case s.after > 0:
+		out = append(out, l)
+		s.after--
+	case s.filter.Context > 0:
+		if len(s.before) == s.filter.Context {
+			s.before = append(s.before[:0], s.before[1:]...)
+		}
+		s.before = append(s.before, l)
+	}
+	return out
+}
+
+type filterReader struct {
+	io.ReadCloser
+	lines    lineSplitter
+	selector lineSelector
+	out      []line // lines kept, yet to be read
+}
+
+// NewFilterReader returns the lines of r which the filter keeps
+func NewFilterReader(r io.ReadCloser, filter *LineFilter) io.ReadCloser {
+	return &filterReader{ReadCloser: r, selector: lineSelector{filter: filter}}
+}
+
+func (r *filterReader) Seek(offset int64, whence int) (n int64, err error) {
+	if seeker, ok := r.ReadCloser.(io.ReadSeeker); ok {
+		r.lines.offset, err = seeker.Seek(offset, whence)
+	} else {
+		if whence != io.SeekStart {
+			return 0, errors.New("Only SeekStart is supported")
+		}
+		r.lines.offset += offset
+	}
+	return r.lines.offset, err
+}
+
+// Offset returns the position in the source to resume reading from:
+// after the bytes read and the lines left out, but before the lines
+// which may still be kept.
+func (r *filterReader) Offset() int64 {
+	switch {
+	case len(r.out) > 0:
+		return r.out[0].offset
+	case len(r.selector.before) > 0:
+		return r.selector.before[0].offset
+	}
+	return r.lines.offset
+}
+
+// lineReader is implemented by readers which can return whole lines,
+// along with where they are in their source.
+type lineReader interface {
+	readLine() (line, error)
+}
+
+// fill reads the source until some line is kept
+func (r *filterReader) fill(size int) (err error) {
+	for len(r.out) == 0 {
+		if err != nil {
+			return err
+		}
+
+		buf := make([]byte, size)
+		var m int
+		m, err = r.ReadCloser.Read(buf)
+		r.lines.split(buf[:m], time.Now(), err == io.EOF, func(l line) {
+			r.out = r.selector.selectLine(l, r.out)
+		})
+	}
+	return err
+}
+
+// readLine returns the next line kept, or what wasn't read of it
+func (r *filterReader) readLine() (line, error) {
+	if err := r.fill(32 * 1024); len(r.out) == 0 {
+		return line{}, err
+	}
+
+	l := r.out[0]
+	r.out = r.out[1:]
+	return l, nil
+}
+
+func (r *filterReader) Read(p []byte) (n int, err error) {
+	if err = r.fill(len(p)); len(r.out) == 0 {
+		return 0, err
+	}
+
+	for len(r.out) > 0 && n < len(p) {
+		c := copy(p[n:], r.out[0].data)
+		n += c
+		r.out[0].data = r.out[0].data[c:]
+		r.out[0].offset += int64(c)
+		if len(r.out[0].data) == 0 {
+			r.out = r.out[1:]
+		}
+	}
+
+	// Errors are only returned once every kept line was read
+	if len(r.out) > 0 {
+		err = nil
+	}
+	return n, err
+}
@@ -0,0 +1,44 @@
+package encoders
+
+import (
+	"io"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type filterTable struct {
+	filter LineFilter
+	input  string
+	output string
+}
+
+var testFilterData = []filterTable{
+	{LineFilter{Pattern: regexp.MustCompile("err")}, "ok\nerr 1\nok\nerr 2", "err 1\nerr 2"},
+	{LineFilter{Pattern: regexp.MustCompile("err"), Invert: true}, "ok\nerr 1\nok\nerr 2", "ok\nok\n"},
+	{LineFilter{Pattern: regexp.MustCompile("^err$")}, "ok\r\nerr\r\n", "err\r\n"},
+	{LineFilter{Pattern: regexp.MustCompile("3"), Context: 1}, "1\n2\n3\n4\n5\n", "2\n3\n4\n"},
+	{LineFilter{Pattern: regexp.MustCompile("[25]"), Context: 2}, "1\n2\n3\n4\n5\n6\n", "1\n2\n3\n4\n5\n6\n"},
+	{LineFilter{Pattern: regexp.MustCompile("none")}, "1\n2\n", ""},
+}
+
+func TestFilter(t *testing.T) {
+	for _, data := range testFilterData {
+		filter := data.filter
+		r := NewFilterReader(&readSeekerCloser{strings.NewReader(data.input)}, &filter)
+		assert.Equal(t, data.output, readstring(r))
+	}
+}
+
+func TestFilterSSEOffsets(t *testing.T) {
+	filter := &LineFilter{Pattern: regexp.MustCompile("err")}
+	r := NewFilterReader(&readSeekerCloser{strings.NewReader("ok\nerr\nok\nok\nerr\nok\nok")}, filter)
+	enc := NewSSEEncoder(r, SSE{})
+	enc.Seek(3, io.SeekStart)
+
+	// Ids are offsets in the unfiltered stream, past the lines left out
+	// but before the last one, which may not be complete yet
+	assert.Equal(t, "id: 20\ndata: err\ndata: err\ndata: \n\n", readstring(enc))
+}
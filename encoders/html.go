@@ -0,0 +1,312 @@
+package encoders
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// HTMLStyle styles the classes the HTML encoder outputs
+const HTMLStyle = `pre.ansi{background:#1e1e1e;color:#d4d4d4;padding:1em;white-space:pre-wrap}
+.ansi-bold{font-weight:bold}.ansi-faint{opacity:.7}.ansi-italic{font-style:italic}.ansi-underline{text-decoration:underline}
+.ansi-fg-0{color:#000}.ansi-fg-1{color:#cd3131}.ansi-fg-2{color:#0dbc79}.ansi-fg-3{color:#e5e510}
+.ansi-fg-4{color:#2472c8}.ansi-fg-5{color:#bc3fbc}.ansi-fg-6{color:#11a8cd}.ansi-fg-7{color:#e5e5e5}
+.ansi-fg-8{color:#666}.ansi-fg-9{color:#f14c4c}.ansi-fg-10{color:#23d18b}.ansi-fg-11{color:#f5f543}
+.ansi-fg-12{color:#3b8eea}.ansi-fg-13{color:#d670d6}.ansi-fg-14{color:#29b8db}.ansi-fg-15{color:#fff}
+.ansi-bg-0{background:#000}.ansi-bg-1{background:#cd3131}.ansi-bg-2{background:#0dbc79}.ansi-bg-3{background:#e5e510}
+.ansi-bg-4{background:#2472c8}.ansi-bg-5{background:#bc3fbc}.ansi-bg-6{background:#11a8cd}.ansi-bg-7{background:#e5e5e5}
+.ansi-bg-8{background:#666}.ansi-bg-9{background:#f14c4c}.ansi-bg-10{background:#23d18b}.ansi-bg-11{background:#f5f543}
+.ansi-bg-12{background:#3b8eea}.ansi-bg-13{background:#d670d6}.ansi-bg-14{background:#29b8db}.ansi-bg-15{background:#fff}`
+
+const (
+	htmlHeader = "<!DOCTYPE html>\n<html><head><meta charset=\"utf-8\"><style>\n" + HTMLStyle + "\n</style></head>\n<body><pre class=\"ansi\">"
+	htmlFooter = "</pre></body></html>\n"
+)
+
+// HTML configures the rendering of ANSI output as HTML
+type HTML struct {
+	// Wraps the output in a document, styling it, instead of
+	// returning a fragment to be put in a `pre`.
+	Document bool
+}
+
+// States of the ANSI escape sequences parser
+const (
+	ansiText = iota
+	ansiEscape
+	ansiCSI
+	ansiOSC
+	ansiOSCEscape
+)
+
+// sgr is the graphic rendition ANSI sequences set
+type sgr struct {
+	bold, faint, italic, underline bool
+	fg, bg                         string // class suffix, or CSS color
+}
+
+func (s sgr) span() string {
+	var classes, styles []string
+	for _, attr := range []struct {
+		set  bool
+		name string
+	}{{s.bold, "bold"}, {s.faint, "faint"}, {s.italic, "italic"}, {s.underline, "underline"}} {
+		if attr.set {
+			classes = append(classes, "ansi-"+attr.name)
+		}
+	}
+	for _, color := range []struct{ value, class, style string }{{s.fg, "fg", "color"}, {s.bg, "bg", "background"}} {
+		switch {
+		case color.value == "":
+		case color.value[0] == '#':
+			styles = append(styles, color.style+":"+color.value)
+		default:
+			classes = append(classes, "ansi-"+color.class+"-"+color.value)
+		}
+	}
+
+	if len(classes) == 0 && len(styles) == 0 {
+		return ""
+	}
+	span := "<span"
+	if len(classes) > 0 {
+		span += ` class="` + strings.Join(classes, " ") + `"`
+	}
+	if len(styles) > 0 {
+		span += ` style="` + strings.Join(styles, ";") + `"`
+	}
+	return span + ">"
+}
+
+type htmlEncoder struct {
+	io.ReadCloser // stores the original reader
+	config        HTML
+	offset        int64 // offset for Seek purposes
+
+	started bool
+	state   int
+	params  []byte // of the CSI sequence being parsed
+	sgr     sgr
+	open    bool         // whether a span is open
+	out     bytes.Buffer // encoded output, yet to be read
+	err     error
+}
+
+// NewHTMLEncoder creates an encoder rendering ANSI colors and styles as
+// HTML spans, other escape sequences being dropped. The state of the
+// terminal carries across reads, but isn't known before an offset
+// sought.
+func NewHTMLEncoder(r io.ReadCloser, config HTML) Encoder {
+	return &htmlEncoder{ReadCloser: r, config: config}
+}
+
+func (r *htmlEncoder) Seek(offset int64, whence int) (n int64, err error) {
+	if seeker, ok := r.ReadCloser.(io.ReadSeeker); ok {
+		r.offset, err = seeker.Seek(offset, whence)
+	} else {
+		if whence != io.SeekStart {
+			return 0, errors.New("Only SeekStart is supported")
+		}
+		r.offset += offset
+	}
+
+	return r.offset, err
+}
+
+func (r *htmlEncoder) Read(p []byte) (n int, err error) {
+	if !r.started {
+		r.started = true
+		if r.config.Document {
+			r.out.WriteString(htmlHeader)
+		}
+	}
+
+	for r.out.Len() == 0 && r.err == nil {
+		buf := make([]byte, len(p))
+		n, r.err = r.ReadCloser.Read(buf)
+		r.offset += int64(n)
+		r.encode(buf[:n])
+
+		if r.err == io.EOF {
+			r.closeSpan()
+			if r.config.Document {
+				r.out.WriteString(htmlFooter)
+			}
+		}
+	}
+
+	if r.out.Len() > 0 {
+		return r.out.Read(p)
+	}
+	return 0, r.err
+}
+
+func (r *htmlEncoder) encode(buf []byte) {
+	for _, b := range buf {
+		switch r.state {
+		case ansiText:
+			r.text(b)
+		case ansiEscape:
+			switch b {
+			case '[':
+				r.state = ansiCSI
+				r.params = r.params[:0]
+			case ']':
+				r.state = ansiOSC
+			default:
+				r.state = ansiText
+			}
+		case ansiCSI:
+			// Parameters and intermediate bytes, until a final byte
+			if b >= 0x20 && b <= 0x3f {
+				r.params = append(r.params, b)
+				continue
+			}
+			if b == 'm' {
+				r.setSGR(string(r.params))
+			}
+			r.state = ansiText
+		case ansiOSC:
+			switch b {
+			case 0x07:
+				r.state = ansiText
+			case 0x1b:
+				r.state = ansiOSCEscape
+			}
+		case ansiOSCEscape:
+			r.state = ansiText
+		}
+	}
+}
+
+func (r *htmlEncoder) text(b byte) {
+	var escaped string
+	switch b {
+	case 0x1b:
+		r.state = ansiEscape
+		return
+	case '\r', 0x07, 0x08:
+		// Terminal controls without an HTML equivalent
+		return
+	case '&':
+		escaped = "&amp;"
+	case '<':
+		escaped = "&lt;"
+	case '>':
+		escaped = "&gt;"
+	case '"':
+		escaped = "&quot;"
+	case '\'':
+		escaped = "&#39;"
+	}
+
+	r.openSpan()
+	if escaped != "" {
+		r.out.WriteString(escaped)
+	} else {
+		r.out.WriteByte(b)
+	}
+}
+
+// openSpan opens the span the current style needs, if any
+func (r *htmlEncoder) openSpan() {
+	if !r.open {
+		if span := r.sgr.span(); span != "" {
+			r.out.WriteString(span)
+			r.open = true
+		}
+	}
+}
+
+func (r *htmlEncoder) closeSpan() {
+	if r.open {
+		r.out.WriteString("</span>")
+		r.open = false
+	}
+}
+
+// setSGR applies a Select Graphic Rendition sequence
+func (r *htmlEncoder) setSGR(params string) {
+	r.closeSpan()
+
+	codes := strings.Split(params, ";")
+	for i := 0; i < len(codes); i++ {
+		code, _ := strconv.Atoi(codes[i])
+		switch {
+		case code == 0:
+			r.sgr = sgr{}
+		case code == 1:
+			r.sgr.bold = true
+		case code == 2:
+			r.sgr.faint = true
+		case code == 3:
+			r.sgr.italic = true
+		case code == 4:
+			r.sgr.underline = true
+		case code == 22:
+			r.sgr.bold, r.sgr.faint = false, false
+		case code == 23:
+			r.sgr.italic = false
+		case code == 24:
+			r.sgr.underline = false
+		case code >= 30 && code <= 37:
+			r.sgr.fg = strconv.Itoa(code - 30)
+		case code == 39:
+			r.sgr.fg = ""
+		case code >= 40 && code <= 47:
+			r.sgr.bg = strconv.Itoa(code - 40)
+		case code == 49:
+			r.sgr.bg = ""
+		case code >= 90 && code <= 97:
+			r.sgr.fg = strconv.Itoa(code - 90 + 8)
+		case code >= 100 && code <= 107:
+			r.sgr.bg = strconv.Itoa(code - 100 + 8)
+		case code == 38 || code == 48:
+			color, skip := extendedColor(codes[i+1:])
+			i += skip
+			if code == 38 {
+				r.sgr.fg = color
+			} else {
+				r.sgr.bg = color
+			}
+		}
+	}
+}
+
+// extendedColor parses the 256 colors (`5;n`) and true color
+// (`2;r;g;b`) parameters following 38 and 48, returning the color and
+// how many parameters it took.
+func extendedColor(params []string) (string, int) {
+	if len(params) >= 2 && params[0] == "5" {
+		n, _ := strconv.Atoi(params[1])
+		return xterm256(n), 2
+	}
+	if len(params) >= 4 && params[0] == "2" {
+		var rgb [3]int
+		for i := range rgb {
+			rgb[i], _ = strconv.Atoi(params[i+1])
+		}
+		return fmt.Sprintf("#%02x%02x%02x", rgb[0]&0xff, rgb[1]&0xff, rgb[2]&0xff), 4
+	}
+	return "", len(params)
+}
+
+// xterm256 returns the class suffix of the 16 basic colors, or the
+// CSS color of the others.
+func xterm256(n int) string {
+	switch {
+	case n < 0 || n > 255:
+		return ""
+	case n < 16:
+		return strconv.Itoa(n)
+	case n < 232:
+		levels := []int{0, 95, 135, 175, 215, 255}
+		n -= 16
+		return fmt.Sprintf("#%02x%02x%02x", levels[n/36], levels[n/6%6], levels[n%6])
+	}
+	gray := 8 + (n-232)*10
+	return fmt.Sprintf("#%02x%02x%02x", gray, gray, gray)
+}
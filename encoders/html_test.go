@@ -0,0 +1,44 @@
+package encoders
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type htmlTable struct {
+	input  string
+	output string
+}
+
+var testHTMLData = []htmlTable{
+	{"plain <b> & 'text'", "plain &lt;b&gt; &amp; &#39;text&#39;"},
+	{"\x1b[31mred\x1b[0m plain", `<span class="ansi-fg-1">red</span> plain`},
+	{"\x1b[1;92mbold\x1b[22m green\x1b[m", `<span class="ansi-bold ansi-fg-10">bold</span><span class="ansi-fg-10"> green</span>`},
+	{"\x1b[38;5;208mor\x1b[48;2;1;2;3mange", `<span style="color:#ff8700">or</span><span style="color:#ff8700;background:#010203">ange</span>`},
+	{"\x1b[2K\x1b]0;title\x07done\r\n", "done\n"},
+	{"\x1b[4mopen", `<span class="ansi-underline">open</span>`},
+	{"h\xc3\xa9", "h\xc3\xa9"},
+}
+
+func TestHTML(t *testing.T) {
+	for _, data := range testHTMLData {
+		r := &readSeekerCloser{strings.NewReader(data.input)}
+		assert.Equal(t, data.output, readstring(NewHTMLEncoder(r, HTML{})))
+	}
+}
+
+func TestHTMLAcrossReads(t *testing.T) {
+	// Reads split the escape sequence, which keeps applying after
+	r := &readSeekerCloser{strings.NewReader("\x1b[3" + "4mblue\nstill blue")}
+	enc := NewHTMLEncoder(&chunkedReader{r, []int{3, 5}}, HTML{})
+	assert.Equal(t, `<span class="ansi-fg-4">blue`+"\nstill blue</span>", readstring(enc))
+}
+
+func TestHTMLDocument(t *testing.T) {
+	r := &readSeekerCloser{strings.NewReader("hello")}
+	out := readstring(NewHTMLEncoder(r, HTML{Document: true}))
+	assert.True(t, strings.HasPrefix(out, "<!DOCTYPE html>"))
+	assert.True(t, strings.HasSuffix(out, "<pre class=\"ansi\">hello</pre></body></html>\n"))
+}
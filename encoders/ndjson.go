@@ -0,0 +1,115 @@
+package encoders
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"time"
+)
+
+// NDJSON configures the encoding of a stream as newline delimited JSON
+type NDJSON struct {
+	Channel string      // labels every line when set
+	Line    int64       // number of the line sought, 1 when zero
+	Filter  *LineFilter // keeps every line when nil
+
+	// Tells when the byte at offset was published, if known. Lines
+	// are otherwise timed as they are read.
+	Arrival func(offset int64) (time.Time, bool)
+}
+
+// ndjsonLine is what each line of the stream is encoded as
+type ndjsonLine struct {
+	Offset   int64     `json:"offset"`
+	Line     int64     `json:"line"`
+	Channel  string    `json:"channel,omitempty"`
+	Received time.Time `json:"time"`
+	Text     string    `json:"text"`
+}
+
+type ndjsonEncoder struct {
+	io.ReadCloser // stores the original reader
+	channel       string
+	arrival       func(offset int64) (time.Time, bool)
+	lines         lineSplitter
+	selector      lineSelector
+	out           bytes.Buffer // encoded lines, yet to be read
+	err           error
+}
+
+// NewNDJSONEncoder creates an encoder returning one JSON object per
+// line of the stream, with its offset, number and the time it was
+// published.
+func NewNDJSONEncoder(r io.ReadCloser, config NDJSON) Encoder {
+	if config.Arrival == nil {
+		config.Arrival = func(int64) (time.Time, bool) { return time.Time{}, false }
+	}
+	enc := &ndjsonEncoder{
+		ReadCloser: r,
+		channel:    config.Channel,
+		arrival:    config.Arrival,
+		selector:   lineSelector{filter: config.Filter},
+	}
+	enc.lines.number = config.Line
+	if enc.lines.number <= 0 {
+		enc.lines.number = 1
+	}
+	return enc
+}
+
+func (r *ndjsonEncoder) Seek(offset int64, whence int) (n int64, err error) {
+	if seeker, ok := r.ReadCloser.(io.ReadSeeker); ok {
+		r.lines.offset, err = seeker.Seek(offset, whence)
+	} else {
+		// The underlying reader doesn't support seeking, but
+		// we should still update the offset so the lines will
+		// properly reflect the adjusted offset.
+
+		if whence != io.SeekStart {
+			return 0, errors.New("Only SeekStart is supported")
+		}
+		r.lines.offset += offset
+	}
+
+	return r.lines.offset, err
+}
+
+func (r *ndjsonEncoder) Read(p []byte) (n int, err error) {
+	for r.out.Len() == 0 && r.err == nil {
+		buf := make([]byte, len(p))
+		n, r.err = r.ReadCloser.Read(buf)
+
+		var kept []line
+		r.lines.split(buf[:n], time.Now(), r.err == io.EOF, func(l line) {
+			kept = r.selector.selectLine(l, kept)
+		})
+		for _, l := range kept {
+			r.encode(l)
+		}
+	}
+
+	if r.out.Len() > 0 {
+		return r.out.Read(p)
+	}
+	return 0, r.err
+}
+
+func (r *ndjsonEncoder) encode(l line) {
+	data := bytes.TrimSuffix(l.data, []byte{'\n'})
+	data = bytes.TrimSuffix(data, []byte{'\r'})
+
+	received := l.received
+	if t, ok := r.arrival(l.offset); ok {
+		received = t
+	}
+	buf, _ := json.Marshal(&ndjsonLine{
+		Offset:   l.offset,
+		Line:     l.number,
+		Channel:  r.channel,
+		Received: received.UTC(),
+		Text:     string(data),
+	})
+	r.out.Write(buf)
+	r.out.WriteByte('\n')
+}
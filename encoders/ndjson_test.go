@@ -0,0 +1,72 @@
+package encoders
+
+import (
+	"bufio"
+	"encoding/json"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func readNDJSON(t *testing.T, enc Encoder) []ndjsonLine {
+	var lines []ndjsonLine
+	scanner := bufio.NewScanner(enc)
+	for scanner.Scan() {
+		var l ndjsonLine
+		assert.Nil(t, json.Unmarshal(scanner.Bytes(), &l))
+		lines = append(lines, l)
+	}
+	return lines
+}
+
+func TestNDJSON(t *testing.T) {
+	start := time.Now().Add(-time.Second)
+	r := &readSeekerCloser{strings.NewReader("hello\r\nworld\n\nlast")}
+	lines := readNDJSON(t, NewNDJSONEncoder(r, NDJSON{}))
+
+	assert.Equal(t, 4, len(lines))
+	for i, expected := range []ndjsonLine{
+		{Offset: 0, Line: 1, Text: "hello"},
+		{Offset: 7, Line: 2, Text: "world"},
+		{Offset: 13, Line: 3, Text: ""},
+		{Offset: 14, Line: 4, Text: "last"},
+	} {
+		assert.True(t, lines[i].Received.After(start))
+		lines[i].Received = time.Time{}
+		assert.Equal(t, expected, lines[i])
+	}
+}
+
+func TestNDJSONArrival(t *testing.T) {
+	published := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	r := &readSeekerCloser{strings.NewReader("hello\nworld\n")}
+	lines := readNDJSON(t, NewNDJSONEncoder(r, NDJSON{
+		Arrival: func(offset int64) (time.Time, bool) {
+			return published.Add(time.Duration(offset) * time.Second), offset < 6
+		},
+	}))
+
+	assert.Equal(t, 2, len(lines))
+	assert.Equal(t, published, lines[0].Received)
+	assert.True(t, lines[1].Received.After(published.Add(time.Hour)))
+}
+
+func TestNDJSONSeekAndFilter(t *testing.T) {
+	r := &readSeekerCloser{strings.NewReader("1\n2\nerror\n4\n")}
+	enc := NewNDJSONEncoder(r, NDJSON{
+		Channel: "build",
+		Line:    2,
+		Filter:  &LineFilter{Pattern: regexp.MustCompile("error")},
+	})
+	enc.Seek(2, 0)
+
+	lines := readNDJSON(t, enc)
+	assert.Equal(t, 1, len(lines))
+	assert.Equal(t, int64(4), lines[0].Offset)
+	assert.Equal(t, int64(3), lines[0].Line)
+	assert.Equal(t, "build", lines[0].Channel)
+	assert.Equal(t, "error", lines[0].Text)
+}
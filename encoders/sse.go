@@ -2,24 +2,85 @@ package encoders
 
 import (
 	"bytes"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
+	"sync"
+	"time"
+	"unicode/utf8"
 )
 
 const (
-	id   = "id: %d\n"
-	data = "data: %s\n"
+	id    = "id: %d\n"
+	data  = "data: %s\n"
+	event = "event: %s\n"
+	retry = "retry: %d\n\n"
 )
 
+// How events are cut out of a stream
+const (
+	// FrameChunks sends whatever was read at once as an event
+	FrameChunks = iota
+	// FrameRunes ends events on UTF-8 character boundaries
+	FrameRunes
+	// FrameLines ends events on line boundaries
+	FrameLines
+	// FrameLine sends each line as its own event, without its newline
+	FrameLine
+)
+
+// Incomplete lines or characters are held this long at most when the
+// framing doesn't say otherwise.
+const defaultMaxHold = time.Second
+
+// SSE configures the framing of server-sent events
+type SSE struct {
+	Framing int
+
+	// Data which doesn't end on a boundary of the framing is sent
+	// anyway once held this long, 1 second when zero.
+	MaxHold time.Duration
+
+	// Names data events when set
+	Event string
+
+	// Sent as the reconnection time when positive
+	Retry time.Duration
+
+	// Encodes data with base64, for any byte to get through as is:
+	// raw data can't hold carriage returns nor invalid UTF-8.
+	Base64 bool
+}
+
+// ssePiece is data read at once, which is contiguous in the source
+type ssePiece struct {
+	data []byte
+	end  int64 // offset in the source following data
+}
+
 type sseEncoder struct {
 	io.ReadCloser       // stores the original reader
 	offset        int64 // offset for Seek purposes
+	config        SSE
+
+	started   bool
+	pieces    chan ssePiece // read from the source, when framing
+	errs      chan error    // error which ended the source
+	closed    chan struct{}
+	closeOnce sync.Once
+	pending   []ssePiece // read but held until a boundary
+	held      time.Time  // when pending data started being held
+	err       error
+	out       bytes.Buffer // encoded events, yet to be read
 }
 
 // NewSSEEncoder creates a new server-sent event encoder
-func NewSSEEncoder(r io.ReadCloser) Encoder {
-	return &sseEncoder{ReadCloser: r}
+func NewSSEEncoder(r io.ReadCloser, config SSE) Encoder {
+	if config.MaxHold <= 0 {
+		config.MaxHold = defaultMaxHold
+	}
+	return &sseEncoder{ReadCloser: r, config: config, closed: make(chan struct{})}
 }
 
 func (r *sseEncoder) Seek(offset int64, whence int) (n int64, err error) {
@@ -40,25 +101,229 @@ func (r *sseEncoder) Seek(offset int64, whence int) (n int64, err error) {
 }
 
 func (r *sseEncoder) Read(p []byte) (n int, err error) {
-	// We assume SSE won't add more than twice the amount of data we get
-	q := make([]byte, len(p)/2)
-	n, err = r.ReadCloser.Read(q)
+	if !r.started {
+		r.started = true
+		if r.config.Retry > 0 {
+			r.out.WriteString(fmt.Sprintf(retry, r.config.Retry/time.Millisecond))
+		}
+		if r.config.Framing != FrameChunks {
+			r.pieces = make(chan ssePiece)
+			r.errs = make(chan error, 1)
+			go r.pump()
+		}
+	}
 
-	if n > 0 {
-		buf := format(r.offset, q[:n])
-		if len(buf) > len(p) {
-			return 0, errors.New("buffer length cannot be higher than bytes array")
+	for r.out.Len() == 0 {
+		if r.err != nil {
+			return 0, r.err
 		}
+		if r.config.Framing == FrameChunks {
+			r.readChunk(len(p))
+		} else {
+			r.readFramed()
+		}
+	}
+	return r.out.Read(p)
+}
 
+// readChunk encodes what a single read of the source returns
+func (r *sseEncoder) readChunk(size int) {
+	q := make([]byte, size)
+	var n int
+	n, r.err = r.ReadCloser.Read(q)
+
+	if n > 0 {
 		r.offset += int64(n)
-		n = copy(p, buf)
+		// Filtered readers skip parts of the source, which ids
+		// must still account for.
+		if o, ok := r.ReadCloser.(offsetReader); ok {
+			r.offset = o.Offset()
+		}
+		r.out.Write(r.format(r.offset, q[:n]))
+	}
+}
+
+// pump reads the source in the background, so that held data can be
+// sent in time even though nothing else comes.
+func (r *sseEncoder) pump() {
+	end := r.offset
+	for {
+		var piece ssePiece
+		var err error
+
+		// Filtered lines are contiguous in the source, while what is
+		// read at once may span lines left out.
+		if lr, ok := r.ReadCloser.(lineReader); ok {
+			var l line
+			l, err = lr.readLine()
+			piece = ssePiece{data: l.data, end: l.offset + int64(len(l.data))}
+		} else {
+			buf := make([]byte, 32*1024)
+			var n int
+			n, err = r.ReadCloser.Read(buf)
+			end += int64(n)
+			if o, ok := r.ReadCloser.(offsetReader); ok {
+				end = o.Offset()
+			}
+			piece = ssePiece{data: buf[:n], end: end}
+		}
+
+		if len(piece.data) > 0 {
+			select {
+			case r.pieces <- piece:
+			case <-r.closed:
+				return
+			}
+		}
+		if err != nil {
+			r.errs <- err
+			return
+		}
+	}
+}
+
+// readFramed waits for data to frame, or for the data held to expire
+func (r *sseEncoder) readFramed() {
+	var timeout <-chan time.Time
+	if len(r.pending) > 0 {
+		timer := time.NewTimer(r.config.MaxHold - time.Since(r.held))
+		defer timer.Stop()
+		timeout = timer.C
 	}
 
-	return n, err
+	select {
+	case piece := <-r.pieces:
+		if len(r.pending) == 0 {
+			r.held = time.Now()
+		}
+		r.pending = append(r.pending, piece)
+		r.frame(false, false)
+	case <-timeout:
+		r.frame(true, false)
+	case r.err = <-r.errs:
+		// Whatever is left won't be completed anymore
+		r.frame(false, true)
+	}
+}
+
+// frame encodes the pending data which ends on a boundary of the
+// framing. Once held too long, what ends on a character boundary is
+// sent anyway, and everything is once the source is done.
+func (r *sseEncoder) frame(expired, done bool) {
+	buf := r.pendingData()
+
+	switch r.config.Framing {
+	case FrameLine:
+		for {
+			i := bytes.IndexByte(buf, '\n')
+			if i < 0 {
+				break
+			}
+			// Encoded lines keep their newline, for the stream to be
+			// the concatenation of events.
+			data, end := r.take(i + 1)
+			if !r.config.Base64 {
+				data = bytes.TrimSuffix(bytes.TrimSuffix(data, []byte{'\n'}), []byte{'\r'})
+			}
+			r.writeEvent(end, data)
+			buf = buf[i+1:]
+		}
+	case FrameLines:
+		if i := bytes.LastIndexByte(buf, '\n'); i >= 0 {
+			data, end := r.take(i + 1)
+			r.writeEvent(end, data)
+			buf = buf[i+1:]
+		}
+	}
+
+	var n int
+	switch {
+	case done:
+		n = len(buf)
+	case expired, r.config.Framing == FrameRunes, len(buf) > maxLineLength:
+		n = runeBoundary(buf)
+	}
+	if n > 0 {
+		data, end := r.take(n)
+		r.writeEvent(end, data)
+	} else if expired {
+		// Only part of a character is left, which is held again
+		r.held = time.Now()
+	}
+}
+
+func (r *sseEncoder) Close() error {
+	r.closeOnce.Do(func() { close(r.closed) })
+	return r.ReadCloser.Close()
+}
+
+// pendingData returns the data of every pending piece
+func (r *sseEncoder) pendingData() []byte {
+	var buf []byte
+	for _, piece := range r.pending {
+		buf = append(buf, piece.data...)
+	}
+	return buf
+}
+
+// take removes n bytes of pending data, returning them along with the
+// offset following them in the source.
+func (r *sseEncoder) take(n int) (data []byte, end int64) {
+	for n > 0 {
+		piece := &r.pending[0]
+		c := n
+		if c > len(piece.data) {
+			c = len(piece.data)
+		}
+		data = append(data, piece.data[:c]...)
+		piece.data = piece.data[c:]
+		end = piece.end - int64(len(piece.data))
+		n -= c
+
+		if len(piece.data) == 0 {
+			r.pending = r.pending[1:]
+		}
+	}
+	if len(r.pending) > 0 {
+		r.held = time.Now()
+	}
+	return data, end
+}
+
+func (r *sseEncoder) writeEvent(pos int64, msg []byte) {
+	r.offset = pos
+	r.out.Write(r.format(pos, msg))
+}
+
+// runeBoundary returns the length of buf without the UTF-8 character
+// it may end in the middle of.
+func runeBoundary(buf []byte) int {
+	for i := len(buf) - 1; i >= 0 && i >= len(buf)-utf8.UTFMax; i-- {
+		if !utf8.RuneStart(buf[i]) {
+			continue
+		}
+		if utf8.FullRune(buf[i:]) {
+			return len(buf)
+		}
+		return i
+	}
+	return len(buf)
+}
+
+func (r *sseEncoder) format(pos int64, msg []byte) []byte {
+	if r.config.Base64 {
+		msg = []byte(base64.StdEncoding.EncodeToString(msg))
+	}
+	buf := format(pos, msg)
+	if r.config.Event == "" {
+		return buf
+	}
+	return append([]byte(fmt.Sprintf(event, r.config.Event)), buf...)
 }
 
+// format encodes msg as an event, whose id is the offset following it
 func format(pos int64, msg []byte) []byte {
-	buf := bytes.NewBufferString(fmt.Sprintf(id, pos+int64(len(msg))))
+	buf := bytes.NewBufferString(fmt.Sprintf(id, pos))
 
 	for _, line := range bytes.Split(msg, []byte{'\n'}) {
 		buf.WriteString(fmt.Sprintf(data, line))
@@ -3,8 +3,10 @@ package encoders
 import (
 	"io"
 	"io/ioutil"
+	"regexp"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -31,7 +33,7 @@ var (
 func TestSSENoNewline(t *testing.T) {
 	for _, data := range testSSEData {
 		r := &readSeekerCloser{strings.NewReader(data.input)}
-		enc := NewSSEEncoder(r)
+		enc := NewSSEEncoder(r, SSE{})
 		enc.Seek(data.offset, 0)
 		assert.Equal(t, data.output, readstring(enc))
 	}
@@ -47,7 +49,7 @@ func TestSSENonSeekableReader(t *testing.T) {
 	// Use LimitReader to hide the Seeker interface
 	lr := &limitedReadCloser{io.LimitReader(r, 11).(*io.LimitedReader)}
 
-	enc := NewSSEEncoder(lr)
+	enc := NewSSEEncoder(lr, SSE{})
 	enc.Seek(10, io.SeekStart)
 
 	// `id` should be 11 even though the underlying
@@ -55,6 +57,66 @@ func TestSSENonSeekableReader(t *testing.T) {
 	assert.Equal(t, "id: 11\ndata: d\n\n", readstring(enc))
 }
 
+func TestSSEFraming(t *testing.T) {
+	for _, data := range []struct {
+		config SSE
+		output string
+	}{
+		{SSE{Framing: FrameRunes}, "id: 1\ndata: a\n\nid: 5\ndata: é\ndata: b\n\nid: 8\ndata: c\ndata: d\n\n"},
+		{SSE{Framing: FrameLines}, "id: 4\ndata: aé\ndata: \n\nid: 7\ndata: bc\ndata: \n\nid: 8\ndata: d\n\n"},
+		{SSE{Framing: FrameLine}, "id: 4\ndata: aé\n\nid: 7\ndata: bc\n\nid: 8\ndata: d\n\n"},
+		{SSE{Framing: FrameLine, Event: "log", Retry: 2 * time.Second}, "retry: 2000\n\nevent: log\nid: 4\ndata: aé\n\nevent: log\nid: 7\ndata: bc\n\nevent: log\nid: 8\ndata: d\n\n"},
+	} {
+		// Reads split é, and lines
+		r := &chunkedReader{&readSeekerCloser{strings.NewReader("aé\nbc\nd")}, []int{2, 3, 3}}
+		enc := NewSSEEncoder(r, data.config)
+		assert.Equal(t, data.output, readstring(enc))
+	}
+}
+
+func TestSSEBase64(t *testing.T) {
+	input := "a\r\x00\xff\nb\n"
+	r := &readSeekerCloser{strings.NewReader(input)}
+	enc := NewSSEEncoder(r, SSE{Base64: true})
+	assert.Equal(t, "id: 7\ndata: YQ0A/wpiCg==\n\n", readstring(enc))
+
+	// Lines keep their newline
+	r = &readSeekerCloser{strings.NewReader(input)}
+	enc = NewSSEEncoder(r, SSE{Framing: FrameLine, Base64: true})
+	assert.Equal(t, "id: 5\ndata: YQ0A/wo=\n\nid: 7\ndata: Ygo=\n\n", readstring(enc))
+}
+
+func TestSSEFramingFiltered(t *testing.T) {
+	filter := &LineFilter{Pattern: regexp.MustCompile("err")}
+	r := NewFilterReader(&readSeekerCloser{strings.NewReader("ok\nerr1\nok\nerr2\nok\n")}, filter)
+	enc := NewSSEEncoder(r, SSE{Framing: FrameLine})
+
+	// Each line gets its own offset, even when read together
+	assert.Equal(t, "id: 8\ndata: err1\n\nid: 16\ndata: err2\n\n", readstring(enc))
+}
+
+func TestSSEMaxHold(t *testing.T) {
+	pr, pw := io.Pipe()
+	enc := NewSSEEncoder(pr, SSE{Framing: FrameLines, MaxHold: 50 * time.Millisecond})
+	defer enc.Close()
+
+	go pw.Write([]byte("ab\xc3"))
+	buf := make([]byte, 1024)
+	start := time.Now()
+	n, err := enc.Read(buf)
+	assert.Nil(t, err)
+	assert.True(t, time.Since(start) >= 50*time.Millisecond)
+
+	// The incomplete character is held further
+	assert.Equal(t, "id: 2\ndata: ab\n\n", string(buf[:n]))
+
+	go func() {
+		pw.Write([]byte("\xa9\n"))
+		pw.Close()
+	}()
+	assert.Equal(t, "id: 5\ndata: é\ndata: \n\n", readstring(enc))
+}
+
 func readstring(r io.Reader) string {
 	buf, _ := ioutil.ReadAll(r)
 	return string(buf)
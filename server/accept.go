@@ -0,0 +1,40 @@
+package server
+
+import (
+	"mime"
+	"strconv"
+	"strings"
+
+	"github.com/heroku/busl/util"
+)
+
+// Formats subscribers may ask for with Accept, getting the raw output
+// of streams otherwise
+var subscribeFormats = []string{
+	"text/event-stream", "application/x-ndjson", "text/html", "application/x-asciicast",
+}
+
+// negotiate returns the offer the media ranges of an Accept header
+// prefer, or an empty string when none of them is listed. Wildcards
+// don't pick any offer, leaving the raw output to clients such as curl.
+// Between offers of the same quality, the first one listed wins.
+func negotiate(accept string, offers []string) string {
+	best, bestQ := "", 0.0
+	for _, mediaRange := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(mediaRange))
+		if err != nil || !util.StringInSlice(offers, mediaType) {
+			continue
+		}
+
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		if q > bestQ {
+			best, bestQ = mediaType, q
+		}
+	}
+	return best
+}
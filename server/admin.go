@@ -0,0 +1,246 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/heroku/busl/broker"
+	"github.com/heroku/busl/trace"
+	"github.com/heroku/busl/util"
+)
+
+var errNoConnection = errors.New("No such connection")
+
+const (
+	rolePublisher  = "publisher"
+	roleSubscriber = "subscriber"
+)
+
+// connection is a publisher or subscriber currently served by this node
+type connection struct {
+	id         string
+	key        string
+	role       string
+	requestID  string
+	remoteAddr string
+	started    time.Time
+
+	bytes  int64        // sent or received so far, accessed atomically
+	offset func() int64 // position in the stream
+
+	closed    chan struct{} // closed when an operator disconnects it
+	closeOnce sync.Once
+}
+
+func (c *connection) close() {
+	c.closeOnce.Do(func() { close(c.closed) })
+}
+
+func (c *connection) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"id":          c.id,
+		"role":        c.role,
+		"request_id":  c.requestID,
+		"remote_addr": c.remoteAddr,
+		"offset":      c.offset(),
+		"bytes":       atomic.LoadInt64(&c.bytes),
+		"started_at":  c.started.UTC().Format(time.RFC3339),
+		"duration":    time.Since(c.started).Seconds(),
+	})
+}
+
+// countingWriter adds what goes through it to the bytes of a connection
+type countingWriter struct {
+	w    io.Writer
+	conn *connection
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	atomic.AddInt64(&c.conn.bytes, int64(n))
+	return n, err
+}
+
+// connections tracks the publishers and subscribers of this node
+type connections struct {
+	mu    sync.Mutex
+	byID  map[string]*connection
+	count uint64
+}
+
+func newConnection(r *http.Request, role string) *connection {
+	conn := &connection{
+		key:        key(r),
+		role:       role,
+		requestID:  r.Header.Get("Request-Id"),
+		remoteAddr: r.RemoteAddr,
+		started:    time.Now(),
+		closed:     make(chan struct{}),
+	}
+	conn.offset = func() int64 { return atomic.LoadInt64(&conn.bytes) }
+	return conn
+}
+
+// add registers conn, which must not be modified anymore
+func (c *connections) add(conn *connection) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.byID == nil {
+		c.byID = make(map[string]*connection)
+	}
+	c.count++
+	conn.id = strconv.FormatUint(c.count, 36)
+	c.byID[conn.id] = conn
+}
+
+func (c *connections) remove(conn *connection) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.byID, conn.id)
+}
+
+// disconnect closes the connection with the given id
+func (c *connections) disconnect(id string) error {
+	c.mu.Lock()
+	conn, ok := c.byID[id]
+	c.mu.Unlock()
+
+	if !ok {
+		return errNoConnection
+	}
+	conn.close()
+	return nil
+}
+
+// list returns the connections to key, or every connection when empty
+func (c *connections) list(key string) []*connection {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var list []*connection
+	for _, conn := range c.byID {
+		if key == "" || conn.key == key {
+			list = append(list, conn)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].started.Before(list[j].started) })
+	return list
+}
+
+// Uploads of stream output to storage
+var uploads struct {
+	inFlight, succeeded, failed int64
+}
+
+// admin only lets callers allowed to administer this node through
+func (s *Server) admin(fn http.HandlerFunc) http.HandlerFunc {
+	auth := s.authenticator()
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := authorize(auth, r, scopeAdmin, key(r)); err != nil {
+			util.CountWithData("server.auth.reject", 1, "scope=%s error=%q request_id=%q", scopeAdmin, err, r.Header.Get("Request-Id"))
+			handleError(w, r, err)
+			return
+		}
+		fn(w, r)
+	}
+}
+
+type adminStream struct {
+	Key         string        `json:"key"`
+	Publishers  []*connection `json:"publishers"`
+	Subscribers []*connection `json:"subscribers"`
+}
+
+func (s *Server) listStreams(w http.ResponseWriter, r *http.Request) {
+	streams := []*adminStream{}
+	byKey := map[string]*adminStream{}
+
+	for _, conn := range s.connections.list(r.URL.Query().Get("key")) {
+		stream, ok := byKey[conn.key]
+		if !ok {
+			stream = &adminStream{Key: conn.key, Publishers: []*connection{}, Subscribers: []*connection{}}
+			byKey[conn.key] = stream
+			streams = append(streams, stream)
+		}
+		if conn.role == rolePublisher {
+			stream.Publishers = append(stream.Publishers, conn)
+		} else {
+			stream.Subscribers = append(stream.Subscribers, conn)
+		}
+	}
+
+	writeJSON(w, map[string]interface{}{"streams": streams})
+}
+
+// forceCloseStream marks a stream as done, whether its publisher is
+// still around or not.
+func (s *Server) forceCloseStream(w http.ResponseWriter, r *http.Request) {
+	ctx, span := startSpan(r, "server.admin.close")
+	defer span.End()
+
+	writer, err := broker.NewWriterContext(ctx, key(r))
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	for _, conn := range s.connections.list(key(r)) {
+		if conn.role == rolePublisher {
+			conn.close()
+		}
+	}
+	length, err := broker.Len(writer)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	if err := writer.Close(); err != nil {
+		handleError(w, r, err)
+		return
+	}
+	s.notify(eventClosed, key(r), length)
+
+	util.CountWithData("server.admin.close", 1, "request_id=%q", r.Header.Get("Request-Id"))
+	go s.storeOutput(trace.Detach(ctx), key(r), requestURI(r), s.StorageBaseURL(r))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) disconnect(w http.ResponseWriter, r *http.Request) {
+	if err := s.connections.disconnect(mux.Vars(r)["id"]); err != nil {
+		handleError(w, r, err)
+		return
+	}
+	util.CountWithData("server.admin.disconnect", 1, "request_id=%q", r.Header.Get("Request-Id"))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) status(w http.ResponseWriter, r *http.Request) {
+	pool := broker.Stats()
+	writeJSON(w, map[string]interface{}{
+		"connections": len(s.connections.list("")),
+		"redis": map[string]interface{}{
+			"in_use":   pool.InUse,
+			"open":     pool.Open,
+			"max_idle": pool.MaxIdle,
+		},
+		"storage": map[string]interface{}{
+			"uploads_in_flight": atomic.LoadInt64(&uploads.inFlight),
+			"uploads_succeeded": atomic.LoadInt64(&uploads.succeeded),
+			"uploads_failed":    atomic.LoadInt64(&uploads.failed),
+		},
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
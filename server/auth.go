@@ -0,0 +1,238 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/heroku/authenticater"
+	"github.com/heroku/busl/util"
+)
+
+var (
+	errUnauthorized = errors.New("Unauthorized")
+	errForbidden    = errors.New("Forbidden")
+)
+
+// scopeCreate and scopeAdmin are only ever granted to authenticated
+// callers, there are no stream tokens for them.
+const (
+	scopeCreate tokenScope = "create"
+	scopeAdmin  tokenScope = "admin"
+)
+
+// Authenticator validates the credentials of a request
+type Authenticator interface {
+	// Authenticate returns who is behind the request, or
+	// errUnauthorized when credentials are missing or invalid.
+	Authenticate(r *http.Request) (*Identity, error)
+}
+
+// Identity is an authenticated caller. Each list holds the key
+// prefixes the caller may act on; a nil list grants every key, but for
+// Admin which must be granted explicitly.
+type Identity struct {
+	Name    string
+	Create  []string
+	Publish []string
+	Read    []string
+	Admin   []string
+}
+
+func (i *Identity) allows(scope tokenScope, key string) bool {
+	var prefixes []string
+	switch scope {
+	case scopeCreate:
+		prefixes = i.Create
+	case scopePublish:
+		prefixes = i.Publish
+	case scopeRead:
+		prefixes = i.Read
+	case scopeAdmin:
+		if i.Admin == nil {
+			return false
+		}
+		prefixes = i.Admin
+	}
+
+	if prefixes == nil {
+		return true
+	}
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func authorize(auth Authenticator, r *http.Request, scope tokenScope, key string) error {
+	identity, err := authenticate(auth, r)
+	if err != nil {
+		return err
+	}
+	if !identity.allows(scope, key) {
+		return errForbidden
+	}
+	return nil
+}
+
+type authenticationKey struct{}
+
+// authentication holds who is behind a request once authenticated
+type authentication struct {
+	once     sync.Once
+	identity *Identity
+	err      error
+}
+
+// authenticateOnce lets the credentials of each request be verified a
+// single time, however many of the middlewares need them.
+func authenticateOnce(fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		fn(w, r.WithContext(context.WithValue(r.Context(), authenticationKey{}, &authentication{})))
+	}
+}
+
+// authenticate returns who is behind the request, only asking auth the
+// first time when passed through authenticateOnce.
+func authenticate(auth Authenticator, r *http.Request) (*Identity, error) {
+	a, ok := r.Context().Value(authenticationKey{}).(*authentication)
+	if !ok {
+		return auth.Authenticate(r)
+	}
+	a.once.Do(func() {
+		a.identity, a.err = auth.Authenticate(r)
+	})
+	return a.identity, a.err
+}
+
+type basicAuthenticator struct {
+	*authenticater.BasicAuth
+}
+
+// NewBasicAuthenticator creates an authenticator for basic auth
+// credentials formatted as `user:password|user:password|...`
+func NewBasicAuthenticator(creds string) (Authenticator, error) {
+	auth, err := authenticater.NewBasicAuthFromString(creds)
+	if err != nil {
+		return nil, err
+	}
+	return &basicAuthenticator{auth}, nil
+}
+
+// LoadBasicAuthenticator creates an authenticator for the basic auth
+// users listed in path, one `user:password` per line. Blank lines and
+// lines starting with `#` are ignored.
+func LoadBasicAuthenticator(path string) (Authenticator, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	auth := authenticater.NewBasicAuth()
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("%s:%d: expected user:password", path, n)
+		}
+		auth.AddPrincipal(parts[0], parts[1])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return &basicAuthenticator{auth}, nil
+}
+
+func (a *basicAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	if !a.BasicAuth.Authenticate(r) {
+		return nil, errUnauthorized
+	}
+	user, _, _ := r.BasicAuth()
+	return &Identity{Name: user}, nil
+}
+
+type bearerAuthenticator struct {
+	tokens []string
+}
+
+// NewBearerAuthenticator creates an authenticator accepting any of the
+// given static tokens in an `Authorization: Bearer` header.
+func NewBearerAuthenticator(tokens ...string) Authenticator {
+	return &bearerAuthenticator{tokens: tokens}
+}
+
+func (a *bearerAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	token := bearerToken(r)
+	if token == "" {
+		return nil, errUnauthorized
+	}
+
+	for i, t := range a.tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			return &Identity{Name: fmt.Sprintf("token-%d", i)}, nil
+		}
+	}
+	return nil, errUnauthorized
+}
+
+func bearerToken(r *http.Request) string {
+	const prefix = "Bearer "
+	if h := r.Header.Get("Authorization"); len(h) > len(prefix) && strings.EqualFold(h[:len(prefix)], prefix) {
+		return strings.TrimSpace(h[len(prefix):])
+	}
+	return ""
+}
+
+type adminAuthenticator struct {
+	Authenticator
+	names []string
+}
+
+// NewAdminAuthenticator grants the admin scope on every key to the
+// callers auth accepts under one of names, or to all of them when no
+// name is given.
+func NewAdminAuthenticator(auth Authenticator, names ...string) Authenticator {
+	return &adminAuthenticator{Authenticator: auth, names: names}
+}
+
+func (a *adminAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	identity, err := a.Authenticator.Authenticate(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(a.names) == 0 || util.StringInSlice(a.names, identity.Name) {
+		identity.Admin = []string{""}
+	}
+	return identity, nil
+}
+
+type multiAuthenticator []Authenticator
+
+// MultiAuthenticator accepts requests any of the given authenticators
+// accepts, trying them in order.
+func MultiAuthenticator(auths ...Authenticator) Authenticator {
+	return multiAuthenticator(auths)
+}
+
+func (m multiAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	for _, auth := range m {
+		if identity, err := auth.Authenticate(r); err == nil {
+			return identity, nil
+		}
+	}
+	return nil, errUnauthorized
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/heroku/busl/util"
+)
+
+// CORS configures which browser origins may use busl. No origin is
+// allowed when AllowedOrigins is empty.
+type CORS struct {
+	// Exact origins or patterns such as `https://*.example.com`,
+	// `*` allows every origin.
+	AllowedOrigins   []string
+	AllowedMethods   []string // defaults to every method busl serves
+	AllowedHeaders   []string // defaults to the headers busl understands
+	AllowCredentials bool
+	MaxAge           time.Duration // how long browsers may cache preflights
+}
+
+var errCORSCredentials = errors.New("CORS credentials can't be allowed for every origin")
+
+var (
+	defaultCORSMethods = []string{"GET", "HEAD", "POST", "PUT", "DELETE", "OPTIONS"}
+	defaultCORSHeaders = []string{
+		"Accept", "Accept-Encoding", "Authorization", "Content-Type", "Content-Length",
+		"Last-Event-ID", "Range", "Request-ID", "X-CSRF-Token", headerToken,
+	}
+
+	// Response headers browsers are allowed to read
+	corsExposedHeaders = []string{
+		"Cache-Control", "Content-Length", "Content-Type", "ETag", "Expires",
+		"Last-Modified", "Request-ID", "Retry-After",
+		headerStreamLength, headerStreamDone, headerPublishToken, headerReadToken,
+	}
+)
+
+// Validate refuses to allow credentials along with every origin, which
+// would let any site act with the credentials of its visitors.
+func (c *CORS) Validate() error {
+	if c.AllowCredentials && util.StringInSlice(c.AllowedOrigins, "*") {
+		return errCORSCredentials
+	}
+	return nil
+}
+
+func (c *CORS) allowsOrigin(origin string) bool {
+	for _, pattern := range c.AllowedOrigins {
+		if pattern == "*" || strings.EqualFold(pattern, origin) {
+			return true
+		}
+		if ok, _ := path.Match(strings.ToLower(pattern), strings.ToLower(origin)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *CORS) methods() []string {
+	if len(c.AllowedMethods) == 0 {
+		return defaultCORSMethods
+	}
+	return c.AllowedMethods
+}
+
+func (c *CORS) headers() []string {
+	if len(c.AllowedHeaders) == 0 {
+		return defaultCORSHeaders
+	}
+	return c.AllowedHeaders
+}
+
+// Sets the CORS headers common to every response.
+func (c *CORS) addHeaders(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Vary", "Origin")
+
+	origin := r.Header.Get("Origin")
+	if origin == "" || !c.allowsOrigin(origin) {
+		return
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	w.Header().Set("Access-Control-Expose-Headers", strings.Join(corsExposedHeaders, ", "))
+	if c.AllowCredentials {
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+// Answers preflight requests. The origin related headers are already
+// set by addDefaultHeaders.
+func (s *Server) preflight(w http.ResponseWriter, r *http.Request) {
+	c := &s.CORS
+	origin, method := r.Header.Get("Origin"), r.Header.Get("Access-Control-Request-Method")
+
+	if origin == "" || !c.allowsOrigin(origin) || method == "" || !util.StringInSlice(c.methods(), strings.ToUpper(method)) {
+		util.CountWithData("server.cors.reject", 1, "origin=%q method=%q", origin, method)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	for _, header := range strings.Split(r.Header.Get("Access-Control-Request-Headers"), ",") {
+		header = http.CanonicalHeaderKey(strings.TrimSpace(header))
+		if header != "" && !containsHeader(c.headers(), header) {
+			util.CountWithData("server.cors.reject", 1, "origin=%q header=%q", origin, header)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+	}
+
+	w.Header().Set("Access-Control-Allow-Methods", strings.Join(c.methods(), ", "))
+	w.Header().Set("Access-Control-Allow-Headers", strings.Join(c.headers(), ", "))
+	if c.MaxAge > 0 {
+		w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(c.MaxAge.Seconds())))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func containsHeader(headers []string, header string) bool {
+	for _, h := range headers {
+		if http.CanonicalHeaderKey(h) == header {
+			return true
+		}
+	}
+	return false
+}
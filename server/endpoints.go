@@ -4,11 +4,14 @@ import (
 	"bufio"
 	"fmt"
 	"io"
-	"log"
 	"net"
 	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
 
 	"github.com/heroku/busl/broker"
+	"github.com/heroku/busl/trace"
 	"github.com/heroku/busl/util"
 )
 
@@ -21,20 +24,85 @@ func (s *Server) createStream(w http.ResponseWriter, r *http.Request) {
 		handleError(w, r, err)
 		return
 	}
+	if err := setContentType(r); err != nil {
+		handleError(w, r, err)
+		return
+	}
 	util.Count("put.create.success")
+	s.notify(eventCreated, key(r), -1)
+	s.issueTokens(w, key(r))
 	w.WriteHeader(http.StatusCreated)
 }
 
+// Records the content type the publisher gave when creating the stream,
+// or else when first publishing to it.
+func setContentType(r *http.Request) error {
+	if contentType := r.Header.Get("Content-Type"); contentType != "" {
+		return broker.SetContentType(key(r), contentType)
+	}
+	return nil
+}
+
 func (s *Server) health(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "OK")
 }
 
+// Headers describing the stream on HEAD requests
+const (
+	headerStreamLength = "Busl-Stream-Length"
+	headerStreamDone   = "Busl-Stream-Done"
+)
+
+func (s *Server) head(w http.ResponseWriter, r *http.Request) {
+	info, err := s.stat(r)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	if info.length >= 0 {
+		w.Header().Set(headerStreamLength, strconv.FormatInt(info.length, 10))
+		// The length is only final once the publisher is done.
+		if info.done {
+			w.Header().Set("Content-Length", strconv.FormatInt(info.length, 10))
+		}
+	}
+	w.Header().Set(headerStreamDone, strconv.FormatBool(info.done))
+	if !info.modTime.IsZero() {
+		w.Header().Set("Last-Modified", info.modTime.UTC().Format(http.TimeFormat))
+	}
+	if info.etag != "" {
+		w.Header().Set("ETag", info.etag)
+	}
+	if info.contentType != "" {
+		w.Header().Set("Content-Type", info.contentType)
+	}
+	util.CountWithData("server.head", 1, "request_id=%q", r.Header.Get("Request-Id"))
+	w.WriteHeader(http.StatusOK)
+}
+
+// Number of subscriptions currently being served
+var activeSubscribers int64
+
 func (s *Server) publish(w http.ResponseWriter, r *http.Request) {
-	writer, err := broker.NewWriter(key(r))
+	var written int64
+	defer func(start time.Time) {
+		util.MeasureWithData("server.pub", time.Since(start), "request_id=%q", r.Header.Get("Request-Id"))
+		requestLogger(r).Info("server.pub.end", util.Fields{"bytes": written, "duration": time.Since(start)})
+	}(time.Now())
+
+	ctx, span := startSpan(r, "server.publish")
+	defer span.End()
+
+	writer, err := broker.NewWriterContext(ctx, key(r))
 	if err != nil {
 		handleError(w, r, err)
 		return
 	}
+	if err := setContentType(r); err != nil {
+		handleError(w, r, err)
+		return
+	}
 
 	body := bufio.NewReader(r.Body)
 	defer r.Body.Close()
@@ -52,7 +120,42 @@ func (s *Server) publish(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	_, err = io.Copy(writer, body)
+	conn := newConnection(r, rolePublisher)
+	conn.offset = func() int64 { return wl + atomic.LoadInt64(&conn.bytes) }
+	s.connections.add(conn)
+	defer s.connections.remove(conn)
+
+	// Copy in the background so publishes still running late in the
+	// drain, or disconnected by an operator, can be stopped.
+	var out io.Writer = &countingWriter{writer, conn}
+	if wl == 0 {
+		out = &firstByteWriter{Writer: out, fn: func() { s.notify(eventFirstByte, key(r), -1) }}
+	}
+	rw := &resumableWriter{Writer: out}
+	copied := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(rw, s.throttle(body))
+		copied <- err
+	}()
+
+	select {
+	case err = <-copied:
+		written = rw.bytesWritten()
+	case <-s.resuming:
+		written = rw.stop()
+		util.CountWithData("server.pub.resume", 1, "request_id=%q", r.Header.Get("Request-Id"))
+		resumeLater(w, wl+written)
+		s.interruptBody(r)
+		<-copied
+		return
+	case <-conn.closed:
+		written = rw.stop()
+		util.CountWithData("server.pub.disconnect", 1, "request_id=%q", r.Header.Get("Request-Id"))
+		abortPublish(w, http.StatusGone, "Disconnected by an operator.")
+		s.interruptBody(r)
+		<-copied
+		return
+	}
 
 	if err == io.ErrUnexpectedEOF {
 		util.CountWithData("server.pub.read.eoferror", 1, "msg=%q request_id=%q", err, r.Header.Get("Request-Id"))
@@ -67,16 +170,17 @@ func (s *Server) publish(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err != nil {
-		log.Printf("%#v", err)
 		http.Error(w, "Unhandled error, please try again.", http.StatusInternalServerError)
 		logError(r, err)
 		return
 	}
 
 	util.CountWithData("server.pub.read.end", 1, "request_id=%q", r.Header.Get("Request-Id"))
-	writer.Close()
+	if err := writer.Close(); err == nil {
+		s.notify(eventClosed, key(r), wl+written)
+	}
 	// Asynchronously upload the output to our defined storage backend.
-	go storeOutput(key(r), requestURI(r), s.StorageBaseURL(r))
+	go s.storeOutput(trace.Detach(ctx), key(r), requestURI(r), s.StorageBaseURL(r))
 }
 
 func (s *Server) subscribe(w http.ResponseWriter, r *http.Request) {
@@ -85,7 +189,26 @@ func (s *Server) subscribe(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	rd, err := s.newReader(w, r)
+	var written int64
+	util.Sample("server.sub.active", atomic.AddInt64(&activeSubscribers, 1))
+	defer func(start time.Time) {
+		util.Sample("server.sub.active", atomic.AddInt64(&activeSubscribers, -1))
+		util.MeasureWithData("server.sub", time.Since(start), "request_id=%q", r.Header.Get("Request-Id"))
+		requestLogger(r).Info("server.sub.end", util.Fields{"bytes": written, "duration": time.Since(start)})
+	}(time.Now())
+
+	ctx, span := startSpan(r, "server.subscribe")
+	defer span.End()
+
+	// Get the offset from Last-Event-ID:, Range: or tail
+	o, err := s.startOffset(ctx, r)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	conn := newConnection(r, roleSubscriber)
+	rd, err := s.newReader(ctx, w, r, o, conn.closed)
 	if rd != nil {
 		defer rd.Close()
 	}
@@ -93,7 +216,32 @@ func (s *Server) subscribe(w http.ResponseWriter, r *http.Request) {
 		handleError(w, r, err)
 		return
 	}
-	_, err = io.Copy(newWriteFlusher(w), rd)
+	var out io.Writer = &countingWriter{newWriteFlusher(w), conn}
+
+	// Event ids are the offset following them
+	var events *eventWriter
+	if w.Header().Get("Content-Type") == "text/event-stream" {
+		events = &eventWriter{Writer: out, id: strconv.FormatInt(o, 10)}
+		out = events
+		conn.offset = func() int64 {
+			id, _ := strconv.ParseInt(events.lastID(), 10, 64)
+			return id
+		}
+	} else {
+		conn.offset = func() int64 { return o + atomic.LoadInt64(&conn.bytes) }
+	}
+	s.connections.add(conn)
+	defer s.connections.remove(conn)
+
+	written, err = io.Copy(out, rd)
+
+	if err == errDraining {
+		util.CountWithData("server.sub.drain", 1, "request_id=%q", r.Header.Get("Request-Id"))
+		if events != nil {
+			reconnect(w, events.lastID())
+		}
+		return
+	}
 
 	netErr, ok := err.(net.Error)
 	if ok && netErr.Timeout() {
@@ -108,18 +256,27 @@ func (s *Server) subscribe(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) closeStream(w http.ResponseWriter, r *http.Request) {
-	writer, err := broker.NewWriter(key(r))
+	ctx, span := startSpan(r, "server.close")
+	defer span.End()
+
+	writer, err := broker.NewWriterContext(ctx, key(r))
 	if err != nil {
 		handleError(w, r, err)
 		return
 	}
 
 	util.CountWithData("server.close", 1, "request_id=%q", r.Header.Get("Request-Id"))
+	length, err := broker.Len(writer)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
 	err = writer.Close()
 	if err != nil {
 		handleError(w, r, err)
 		return
 	}
+	s.notify(eventClosed, key(r), length)
 	// Asynchronously upload the output to our defined storage backend.
-	go storeOutput(key(r), requestURI(r), s.StorageBaseURL(r))
+	go s.storeOutput(trace.Detach(ctx), key(r), requestURI(r), s.StorageBaseURL(r))
 }
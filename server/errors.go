@@ -10,7 +10,11 @@ import (
 	"github.com/heroku/rollbar"
 )
 
-var errNoContent = errors.New("No Content")
+var (
+	errNoContent      = errors.New("No Content")
+	errInvalidFilter  = errors.New("Invalid grep pattern or context")
+	errInvalidFraming = errors.New("Invalid SSE framing, hold, event, retry or encoding")
+)
 
 const asciiGone = `░░░░░░░░░░██░░░░░░░░░░██░░░░░░░░
 ░░░░░░░░██░░██░░░░░░██░░██░░░░░░
@@ -39,6 +43,24 @@ func handleError(w http.ResponseWriter, r *http.Request, err error) {
 
 		http.Error(w, message, http.StatusNotFound)
 
+	case errNoConnection:
+		http.Error(w, err.Error()+".", http.StatusNotFound)
+
+	case errUnauthorized:
+		http.Error(w, "Unauthorized.", http.StatusUnauthorized)
+
+	case errForbidden:
+		http.Error(w, "Not allowed for this stream.", http.StatusForbidden)
+
+	case errMissingToken:
+		http.Error(w, "A stream token is required.", http.StatusUnauthorized)
+
+	case errInvalidToken, errExpiredToken, errClientCert:
+		http.Error(w, err.Error()+".", http.StatusForbidden)
+
+	case errInvalidFilter, errInvalidReplay, errInvalidTail, errInvalidMulti, errInvalidFraming, errInvalidKeepAlive:
+		http.Error(w, err.Error()+".", http.StatusBadRequest)
+
 	case storage.ErrRange:
 		w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
 
@@ -56,6 +78,7 @@ func handleError(w http.ResponseWriter, r *http.Request, err error) {
 }
 
 func logError(req *http.Request, err error) {
+	requestLogger(req).Error("server.error", util.Fields{"error": err})
 	rollbar.ErrorWithExtras(rollbar.ERR, err, map[string]interface{}{
 		"request_id": req.Header.Get("Request-Id"),
 		"key":        key(req),
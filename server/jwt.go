@@ -0,0 +1,373 @@
+package server
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	// Register the hashes used by the supported algorithms
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+)
+
+// JWTClaims is the `busl` claim restricting which key prefixes a
+// token holder may create, publish to, read or administer. Tokens
+// without it are unrestricted but for administration; an omitted list
+// grants nothing.
+type JWTClaims struct {
+	Create  []string `json:"create"`
+	Publish []string `json:"publish"`
+	Read    []string `json:"read"`
+	Admin   []string `json:"admin"`
+}
+
+type jwtClaims struct {
+	Subject   string          `json:"sub"`
+	Issuer    string          `json:"iss"`
+	Audience  json.RawMessage `json:"aud"`
+	ExpiresAt *int64          `json:"exp"`
+	NotBefore *int64          `json:"nbf"`
+	Busl      *JWTClaims      `json:"busl"`
+}
+
+type jwtHeader struct {
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+}
+
+// jwtKey is either an HMAC secret ([]byte), an *rsa.PublicKey or an
+// *ecdsa.PublicKey.
+type jwtKey struct {
+	id  string
+	key interface{}
+}
+
+// JWTAuthenticator validates JWTs passed as `Authorization: Bearer`
+type JWTAuthenticator struct {
+	Issuer   string // required `iss` when set
+	Audience string // required `aud` when set
+
+	keys []jwtKey
+}
+
+// AddSecret registers an HMAC secret for HS256, HS384 and HS512 tokens
+func (a *JWTAuthenticator) AddSecret(secret []byte) {
+	a.keys = append(a.keys, jwtKey{key: secret})
+}
+
+// LoadKeys registers the RSA and ECDSA public keys found in path,
+// either a PEM file (public keys or certificates) or a JWKS document.
+func (a *JWTAuthenticator) LoadKeys(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var keys []jwtKey
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		keys, err = parseJWKS(data)
+	} else {
+		keys, err = parsePEMKeys(data)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("%s: no keys found", path)
+	}
+
+	a.keys = append(a.keys, keys...)
+	return nil
+}
+
+// Authenticate implements Authenticator
+func (a *JWTAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	token := bearerToken(r)
+	if token == "" {
+		return nil, errUnauthorized
+	}
+
+	claims, err := a.verify(token, time.Now())
+	if err != nil {
+		return nil, errUnauthorized
+	}
+
+	identity := &Identity{Name: claims.Subject}
+	if c := claims.Busl; c != nil {
+		identity.Create = nonNil(c.Create)
+		identity.Publish = nonNil(c.Publish)
+		identity.Read = nonNil(c.Read)
+		identity.Admin = nonNil(c.Admin)
+	}
+	return identity, nil
+}
+
+// An empty, non nil list grants no key at all.
+func nonNil(prefixes []string) []string {
+	if prefixes == nil {
+		return []string{}
+	}
+	return prefixes
+}
+
+var (
+	errJWTMalformed = errors.New("jwt: malformed token")
+	errJWTSignature = errors.New("jwt: invalid signature")
+	errJWTExpired   = errors.New("jwt: token expired or not yet valid")
+	errJWTClaims    = errors.New("jwt: unexpected issuer or audience")
+)
+
+func (a *JWTAuthenticator) verify(token string, now time.Time) (*jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errJWTMalformed
+	}
+
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, errJWTMalformed
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errJWTMalformed
+	}
+
+	signed := []byte(parts[0] + "." + parts[1])
+	if !a.verifySignature(header, signed, signature) {
+		return nil, errJWTSignature
+	}
+
+	var claims jwtClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, errJWTMalformed
+	}
+	if claims.ExpiresAt != nil && now.Unix() >= *claims.ExpiresAt {
+		return nil, errJWTExpired
+	}
+	if claims.NotBefore != nil && now.Unix() < *claims.NotBefore {
+		return nil, errJWTExpired
+	}
+	if a.Issuer != "" && claims.Issuer != a.Issuer {
+		return nil, errJWTClaims
+	}
+	if a.Audience != "" && !hasAudience(claims.Audience, a.Audience) {
+		return nil, errJWTClaims
+	}
+	return &claims, nil
+}
+
+// Hashes for the supported HS*, RS* and ES* algorithms
+var jwtHashes = map[string]crypto.Hash{
+	"256": crypto.SHA256,
+	"384": crypto.SHA384,
+	"512": crypto.SHA512,
+}
+
+func (a *JWTAuthenticator) verifySignature(header jwtHeader, signed, signature []byte) bool {
+	if len(header.Algorithm) != 5 {
+		return false
+	}
+	hash, ok := jwtHashes[header.Algorithm[2:]]
+	if !ok {
+		return false
+	}
+
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+
+	for _, k := range a.keys {
+		if header.KeyID != "" && k.id != "" && k.id != header.KeyID {
+			continue
+		}
+
+		switch key := k.key.(type) {
+		case []byte:
+			if header.Algorithm[:2] == "HS" {
+				mac := hmac.New(hash.New, key)
+				mac.Write(signed)
+				if hmac.Equal(signature, mac.Sum(nil)) {
+					return true
+				}
+			}
+		case *rsa.PublicKey:
+			if header.Algorithm[:2] == "RS" && rsa.VerifyPKCS1v15(key, hash, digest, signature) == nil {
+				return true
+			}
+		case *ecdsa.PublicKey:
+			size := (key.Curve.Params().BitSize + 7) / 8
+			if header.Algorithm[:2] == "ES" && len(signature) == 2*size {
+				r := new(big.Int).SetBytes(signature[:size])
+				s := new(big.Int).SetBytes(signature[size:])
+				if ecdsa.Verify(key, digest, r, s) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// `aud` is either a single string or an array of strings
+func hasAudience(raw json.RawMessage, audience string) bool {
+	var single string
+	if json.Unmarshal(raw, &single) == nil {
+		return single == audience
+	}
+
+	var list []string
+	if json.Unmarshal(raw, &list) == nil {
+		for _, aud := range list {
+			if aud == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func parsePEMKeys(data []byte) ([]jwtKey, error) {
+	var keys []jwtKey
+	for {
+		var block *pem.Block
+		if block, data = pem.Decode(data); block == nil {
+			return keys, nil
+		}
+
+		var key interface{}
+		var err error
+		switch block.Type {
+		case "PUBLIC KEY":
+			key, err = x509.ParsePKIXPublicKey(block.Bytes)
+		case "RSA PUBLIC KEY":
+			key, err = parsePKCS1PublicKey(block.Bytes)
+		case "CERTIFICATE":
+			var cert *x509.Certificate
+			if cert, err = x509.ParseCertificate(block.Bytes); err == nil {
+				key = cert.PublicKey
+			}
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch key.(type) {
+		case *rsa.PublicKey, *ecdsa.PublicKey:
+			keys = append(keys, jwtKey{key: key})
+		default:
+			return nil, fmt.Errorf("unsupported %T key", key)
+		}
+	}
+}
+
+// parsePKCS1PublicKey decodes an `RSA PUBLIC KEY` block, which the
+// x509 package of Go 1.8 can't parse yet.
+func parsePKCS1PublicKey(der []byte) (*rsa.PublicKey, error) {
+	key := &rsa.PublicKey{}
+	rest, err := asn1.Unmarshal(der, key)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) > 0 || key.N == nil || key.N.Sign() <= 0 || key.E <= 0 {
+		return nil, errors.New("invalid RSA public key")
+	}
+	return key, nil
+}
+
+type jwk struct {
+	KeyType string `json:"kty"`
+	KeyID   string `json:"kid"`
+	N       string `json:"n"`
+	E       string `json:"e"`
+	Curve   string `json:"crv"`
+	X       string `json:"x"`
+	Y       string `json:"y"`
+	K       string `json:"k"`
+}
+
+func parseJWKS(data []byte) ([]jwtKey, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+
+	var keys []jwtKey
+	for _, k := range set.Keys {
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, jwtKey{id: k.KeyID, key: key})
+	}
+	return keys, nil
+}
+
+func (k jwk) publicKey() (interface{}, error) {
+	switch k.KeyType {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+		curve, ok := curves[k.Curve]
+		if !ok {
+			return nil, fmt.Errorf("unsupported curve %q", k.Curve)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+
+	case "oct":
+		return base64.RawURLEncoding.DecodeString(k.K)
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.KeyType)
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
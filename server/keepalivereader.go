@@ -1,13 +1,53 @@
 package server
 
 import (
+	"errors"
 	"io"
+	"net/http"
 	"time"
 
-	"github.com/heroku/busl/broker"
 	"github.com/heroku/busl/util"
 )
 
+var errInvalidKeepAlive = errors.New("Invalid heartbeat or keepalive")
+
+// Returns the heartbeat interval and the packet sent with it, as asked
+// for through the `heartbeat` and `keepalive` query parameters. The
+// packet is ack by default, and comment is the one of the format, if
+// it has any.
+//
+// HTTP/2 pings can't be sent by handlers, so `ping` is refused like any
+// unknown packet.
+func (s *Server) keepAlive(r *http.Request, ack, comment []byte) (time.Duration, []byte, error) {
+	query := r.URL.Query()
+	interval := s.HeartbeatDuration
+	if v := query.Get("heartbeat"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 ||
+			(s.MinHeartbeatDuration > 0 && d < s.MinHeartbeatDuration) ||
+			(s.MaxHeartbeatDuration > 0 && d > s.MaxHeartbeatDuration) {
+			return 0, nil, errInvalidKeepAlive
+		}
+		interval = d
+	}
+
+	switch query.Get("keepalive") {
+	case "":
+		return interval, ack, nil
+	case "none":
+		return interval, nil, nil
+	case "null":
+		return interval, []byte{0}, nil
+	case "newline":
+		return interval, []byte("\n"), nil
+	case "comment":
+		if comment != nil {
+			return interval, comment, nil
+		}
+	}
+	return 0, nil, errInvalidKeepAlive
+}
+
 type payload struct {
 	p   []byte
 	n   int
@@ -20,10 +60,12 @@ type keepAliveReader struct {
 	interval time.Duration // duration before sending an ack
 	ch       chan *payload // where all the original reads go to
 	done     <-chan bool   // closeNotifier
-	eof      bool          // marked true when we hit EOF
+	stop     <-chan struct{}
+	draining <-chan struct{}
+	eof      bool // marked true when we hit EOF
 }
 
-func newKeepAliveReader(r io.Reader, packet []byte, interval time.Duration, done <-chan bool) io.ReadCloser {
+func newKeepAliveReader(r io.Reader, packet []byte, interval time.Duration, done <-chan bool, stop, draining <-chan struct{}) io.ReadCloser {
 	ch := make(chan *payload, 100)
 
 	go func() {
@@ -38,7 +80,7 @@ func newKeepAliveReader(r io.Reader, packet []byte, interval time.Duration, done
 		}
 	}()
 
-	return &keepAliveReader{r: r, ch: ch, done: done, packet: packet, interval: interval}
+	return &keepAliveReader{r: r, ch: ch, done: done, stop: stop, draining: draining, packet: packet, interval: interval}
 }
 
 func (r *keepAliveReader) Read(p []byte) (int, error) {
@@ -46,8 +88,13 @@ func (r *keepAliveReader) Read(p []byte) (int, error) {
 		return 0, io.EOF
 	}
 
-	timer := time.NewTimer(r.interval)
-	defer timer.Stop()
+	// Without a packet to send, reads only wait for the stream
+	var heartbeat <-chan time.Time
+	if len(r.packet) > 0 {
+		timer := time.NewTimer(r.interval)
+		defer timer.Stop()
+		heartbeat = timer.C
+	}
 
 	select {
 	case payload := <-r.ch:
@@ -61,15 +108,24 @@ func (r *keepAliveReader) Read(p []byte) (int, error) {
 
 		return payload.n, payload.err
 
-	case <-timer.C:
+	case <-heartbeat:
+		// Streams are only kept by their publisher writing to them,
+		// for abandoned ones to expire even though followed.
 		util.Count("server.sub.keepAlive")
-		broker.RenewExpiry(r.r)
 		return copy(p, r.packet), nil
 
 	case <-r.done:
 		util.Count("server.sub.clientClosed")
 		r.eof = true
 		return 0, io.EOF
+
+	case <-r.stop:
+		r.eof = true
+		return 0, io.EOF
+
+	case <-r.draining:
+		r.eof = true
+		return 0, errDraining
 	}
 }
 
@@ -2,18 +2,24 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"path"
+	"regexp"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/mux"
-	"github.com/heroku/authenticater"
 	"github.com/heroku/busl/broker"
 	"github.com/heroku/busl/encoders"
 	"github.com/heroku/busl/storage"
+	"github.com/heroku/busl/trace"
 	"github.com/heroku/busl/util"
 )
 
@@ -23,7 +29,7 @@ func (s *Server) enforceHTTPS(fn http.HandlerFunc) http.HandlerFunc {
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
-		if proto := r.Header.Get("X-Forwarded-Proto"); proto != "https" {
+		if proto := r.Header.Get("X-Forwarded-Proto"); proto != "https" && r.TLS == nil {
 			url := r.URL
 			url.Host = r.Host
 			url.Scheme = "https"
@@ -36,32 +42,108 @@ func (s *Server) enforceHTTPS(fn http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
+// auth requires stream creation to be authenticated whenever
+// credentials or an authenticator are configured.
 func (s *Server) auth(fn http.HandlerFunc) http.HandlerFunc {
-	if s.Credentials == "" {
+	auth := s.authenticator()
+	if auth == nil {
 		return fn
 	}
 
-	auth, err := authenticater.NewBasicAuthFromString(s.Credentials)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := authorize(auth, r, scopeCreate, key(r)); err != nil {
+			util.CountWithData("server.auth.reject", 1, "scope=%s error=%q request_id=%q", scopeCreate, err, r.Header.Get("Request-Id"))
+			handleError(w, r, err)
+			return
+		}
+		fn(w, r)
+	}
+}
+
+// authorize lets requests through when they carry a stream token of
+// the given scope, or credentials allowed to act on the key. Unless
+// credentials are required or a token secret is configured, streams
+// stay open to anyone knowing their key.
+func (s *Server) authorize(scope tokenScope, fn http.HandlerFunc) http.HandlerFunc {
+	if !s.guarded() {
+		return fn
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := s.access(r, scope, key(r)); err != nil {
+			util.CountWithData("server.auth.reject", 1, "scope=%s error=%q request_id=%q", scope, err, r.Header.Get("Request-Id"))
+			handleError(w, r, err)
+			return
+		}
+		fn(w, r)
+	}
+}
+
+// guarded tells whether streams are protected beyond their creation
+func (s *Server) guarded() bool {
+	return s.TokenSecret != "" || (s.RequireCredentials && s.authenticator() != nil)
+}
+
+// access checks the request may act on key. A valid stream token is
+// always enough. Otherwise credentials are required when configured so,
+// and tokens when their scope needs one, in which case credentials
+// allowed to act on the key may stand in for them.
+func (s *Server) access(r *http.Request, scope tokenScope, key string) error {
+	auth := s.authenticator()
+	tokens := requestTokens(r)
+
+	var tokenErr error
+	if s.TokenSecret != "" && len(tokens) > 0 {
+		if tokenErr = s.verifyTokens(tokens, key, scope); tokenErr == nil {
+			return nil
+		}
+	}
+
+	credentialsRequired := s.RequireCredentials && auth != nil
+	tokenRequired := s.TokenSecret != "" && (scope != scopeRead || s.RequireReadToken)
+	switch {
+	case !credentialsRequired && !tokenRequired:
+		return nil
+	case auth != nil && (credentialsRequired || r.Header.Get("Authorization") != ""):
+		return authorize(auth, r, scope, key)
+	case tokenErr != nil:
+		return tokenErr
+	}
+	return errMissingToken
+}
+
+func (s *Server) authenticator() Authenticator {
+	if s.Authenticator != nil {
+		return s.Authenticator
+	}
+	if s.Credentials == "" {
+		return nil
+	}
+
+	auth, err := NewBasicAuthenticator(s.Credentials)
 	if err != nil {
 		log.Fatalf("server.middleware error=%v", err)
 		return nil
 	}
-	return authenticater.WrapAuth(auth, fn)
+	return auth
 }
 
 func logRequest(fn http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		logger := util.NewResponseLogger(r, w)
-		fn(logger, r)
+		fn(logger, r.WithContext(util.WithLogger(r.Context(), logger.Logger)))
 		logger.WriteLog()
 	}
 }
 
+// requestLogger returns the logger of the request, with its stream key
+func requestLogger(r *http.Request) *util.Logger {
+	return util.LoggerFromContext(r.Context()).With(util.Fields{"key": key(r)})
+}
+
 func (s *Server) addDefaultHeaders(fn http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if origin := r.Header.Get("Origin"); origin != "" {
-			w.Header().Set("Access-Control-Allow-Origin", origin)
-		}
+		s.CORS.addHeaders(w, r)
 
 		requestID := r.Header.Get("Request-ID")
 		if requestID == "" {
@@ -69,10 +151,6 @@ func (s *Server) addDefaultHeaders(fn http.HandlerFunc) http.HandlerFunc {
 		}
 		w.Header().Set("Request-ID", requestID)
 
-		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token")
-		w.Header().Set("Access-Control-Expose-Headers", "Cache-Control, Content-Type, Expires, Last-Modified")
-		w.Header().Set("Access-Control-Allow-Credentials", "true")
 		fn(w, r)
 	}
 }
@@ -97,38 +175,60 @@ func offset(r *http.Request) (int64, error) {
 	return strconv.ParseInt(off, 10, 64)
 }
 
+// Query parameters consumed by busl itself, which must not leak
+// into the storage backend URL.
+var reservedParams = []string{"token", "poll", "offset", "wait", "grep", "invert", "context", "replay", "speed", "cols", "rows", "format", "download", "tail", "key", "prefix", "framing", "hold", "event", "retry", "encoding", "heartbeat", "keepalive"}
+
 // Given URL:
-//   http://build-output.heroku.com/streams/1/2/3?foo=bar
+//   http://build-output.heroku.com/streams/1/2/3?foo=bar&token=abc
 //
 // Returns:
 //   1/2/3?foo=bar
 func requestURI(r *http.Request) string {
-	res := key(r)
+	return streamURI(r, key(r))
+}
 
-	if r.URL.RawQuery != "" {
-		res += "?" + r.URL.RawQuery
+// Returns the storage URI of any stream, carrying the query parameters
+// of the request like requestURI.
+func streamURI(r *http.Request, key string) string {
+	res := key
+
+	if query := storageQuery(r.URL.RawQuery); query != "" {
+		res += "?" + query
 	}
 
 	return res
 }
 
+// Removes the reserved parameters from the raw query while keeping
+// the rest untouched, as it may be a signed storage URL.
+func storageQuery(rawQuery string) string {
+	if rawQuery == "" {
+		return ""
+	}
+
+	var params []string
+	for _, param := range strings.Split(rawQuery, "&") {
+		name := strings.SplitN(param, "=", 2)[0]
+		if !util.StringInSlice(reservedParams, name) {
+			params = append(params, param)
+		}
+	}
+	return strings.Join(params, "&")
+}
+
 func key(r *http.Request) string {
 	return mux.Vars(r)["key"]
 }
 
-// Returns a broker or blob reader.
-func (s *Server) newStorageReader(w http.ResponseWriter, r *http.Request) (io.ReadCloser, error) {
-	// Get the offset from Last-Event-ID: or Range:
-	o, err := offset(r)
-	if err != nil {
-		return nil, err
-	}
-
-	rd, err := broker.NewReader(key(r))
+// Returns a broker or blob reader of the stream key, positioned at
+// offset o.
+func (s *Server) newStorageReader(ctx context.Context, r *http.Request, key string, o int64) (io.ReadCloser, error) {
+	rd, err := broker.NewReaderContext(ctx, key)
 
 	// Not cached in the broker anymore, try the storage backend as a fallback.
 	if err == broker.ErrNotRegistered {
-		return storage.Get(requestURI(r), s.StorageBaseURL(r), o)
+		return storage.GetContext(ctx, streamURI(r, key), s.StorageBaseURL(r), o)
 	}
 
 	if o > 0 {
@@ -139,8 +239,173 @@ func (s *Server) newStorageReader(w http.ResponseWriter, r *http.Request) (io.Re
 	return rd, err
 }
 
-func (s *Server) newReader(w http.ResponseWriter, r *http.Request) (io.ReadCloser, error) {
-	rd, err := s.newStorageReader(w, r)
+// Most context lines which may be asked for around matches
+const maxFilterContext = 100
+
+// Returns the filter given through the `grep`, `invert` and `context`
+// query parameters, if any.
+func lineFilter(r *http.Request) (*encoders.LineFilter, error) {
+	query := r.URL.Query()
+	if query.Get("grep") == "" {
+		return nil, nil
+	}
+
+	pattern, err := regexp.Compile(query.Get("grep"))
+	if err != nil {
+		return nil, errInvalidFilter
+	}
+	filter := &encoders.LineFilter{Pattern: pattern, Invert: query.Get("invert") == "true"}
+
+	if v := query.Get("context"); v != "" {
+		filter.Context, err = strconv.Atoi(v)
+		if err != nil || filter.Context < 0 || filter.Context > maxFilterContext {
+			return nil, errInvalidFilter
+		}
+	}
+	return filter, nil
+}
+
+// Bounds of the SSE framing parameters
+const (
+	maxSSEHold  = 10 * time.Second
+	maxSSERetry = time.Hour
+)
+
+var sseFramings = map[string]int{
+	"":       encoders.FrameChunks,
+	"chunks": encoders.FrameChunks,
+	"utf8":   encoders.FrameRunes,
+	"lines":  encoders.FrameLines,
+	"line":   encoders.FrameLine,
+}
+
+// Returns the framing of server-sent events given through the
+// `framing`, `hold`, `event`, `retry` and `encoding` query parameters.
+func sseConfig(r *http.Request) (encoders.SSE, error) {
+	query := r.URL.Query()
+	framing, ok := sseFramings[query.Get("framing")]
+	if !ok {
+		return encoders.SSE{}, errInvalidFraming
+	}
+	config := encoders.SSE{Framing: framing, Event: query.Get("event")}
+	if strings.ContainsAny(config.Event, "\r\n") {
+		return config, errInvalidFraming
+	}
+	switch query.Get("encoding") {
+	case "":
+	case "base64":
+		config.Base64 = true
+	default:
+		return config, errInvalidFraming
+	}
+
+	var err error
+	if v := query.Get("hold"); v != "" {
+		config.MaxHold, err = time.ParseDuration(v)
+		if err != nil || config.MaxHold <= 0 || config.MaxHold > maxSSEHold {
+			return config, errInvalidFraming
+		}
+	}
+	if v := query.Get("retry"); v != "" {
+		config.Retry, err = time.ParseDuration(v)
+		if err != nil || config.Retry <= 0 || config.Retry > maxSSERetry {
+			return config, errInvalidFraming
+		}
+	}
+	return config, nil
+}
+
+func filtered(rd io.ReadCloser, filter *encoders.LineFilter) io.ReadCloser {
+	if filter == nil {
+		return rd
+	}
+	return encoders.NewFilterReader(rd, filter)
+}
+
+// Returns the number of the line at offset o, counting those before it
+// in the broker or the storage backend.
+func (s *Server) lineNumber(ctx context.Context, r *http.Request, o int64) (int64, error) {
+	if o == 0 {
+		return 1, nil
+	}
+
+	var rd io.Reader
+	if buf, err := broker.Get(key(r)); err == nil {
+		rd = bytes.NewReader(buf)
+	} else {
+		body, err := storage.GetContext(ctx, requestURI(r), s.StorageBaseURL(r), 0)
+		if err != nil {
+			return 0, err
+		}
+		defer body.Close()
+		rd = body
+	}
+
+	lines := int64(1)
+	buf := make([]byte, 32*1024)
+	rd = io.LimitReader(rd, o)
+	for {
+		n, err := rd.Read(buf)
+		lines += int64(bytes.Count(buf[:n], []byte{'\n'}))
+		if err == io.EOF {
+			return lines, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// streamInfo is what a HEAD request reports about a stream.
+type streamInfo struct {
+	length      int64
+	done        bool
+	modTime     time.Time
+	etag        string
+	contentType string
+}
+
+// Returns the stream metadata from the broker, or from the storage
+// backend when the broker doesn't know about the key anymore.
+func (s *Server) stat(r *http.Request) (*streamInfo, error) {
+	info, err := broker.Stat(key(r))
+	if err == broker.ErrNotRegistered {
+		blob, err := storage.StatContext(r.Context(), requestURI(r), s.StorageBaseURL(r))
+		if err != nil {
+			return nil, err
+		}
+		return &streamInfo{length: blob.Length, done: true, modTime: blob.ModTime, etag: blob.ETag, contentType: storedType(blob.ContentType)}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	state := "open"
+	if info.Done {
+		state = "done"
+	}
+	return &streamInfo{
+		length:      info.Length,
+		done:        info.Done,
+		modTime:     info.ModTime,
+		etag:        fmt.Sprintf(`W/"%d-%s"`, info.Length, state),
+		contentType: info.ContentType,
+	}, nil
+}
+
+// Returns the type stored streams were given by their publisher. S3
+// reports objects stored without any as binary/octet-stream.
+func storedType(contentType string) string {
+	if contentType == "binary/octet-stream" {
+		return ""
+	}
+	return contentType
+}
+
+// Returns the reader sent to subscribers from offset o, ending when
+// stop is closed.
+func (s *Server) newReader(ctx context.Context, w http.ResponseWriter, r *http.Request, o int64, stop <-chan struct{}) (io.ReadCloser, error) {
+	rd, err := s.newStorageReader(ctx, r, key(r), o)
 	if err != nil {
 		if rd != nil {
 			rd.Close()
@@ -151,45 +416,160 @@ func (s *Server) newReader(w http.ResponseWriter, r *http.Request) (io.ReadClose
 	// For default requests, we use a null byte for sending
 	// the keepalive ack.
 	ack := []byte{0}
+	var comment []byte // of the format, if it has any
 
-	o, err := offset(r)
+	if broker.NoContent(rd, o) {
+		rd.Close()
+		return nil, errNoContent
+	}
+	contentType := storedType(storage.ContentType(rd))
+
+	filter, err := lineFilter(r)
 	if err != nil {
 		rd.Close()
 		return nil, err
 	}
 
-	if broker.NoContent(rd, o) {
+	speed, err := replaySpeed(r)
+	if err != nil {
 		rd.Close()
-		return nil, errNoContent
+		return nil, err
+	}
+	accept := negotiate(r.Header.Get("Accept"), subscribeFormats)
+	switch r.URL.Query().Get("format") {
+	case "html":
+		accept = "text/html"
+	case "cast":
+		accept = "application/x-asciicast"
+	}
+	var timing broker.Timing
+	if speed > 0 || accept == "application/x-asciicast" || accept == "application/x-ndjson" {
+		if timing, err = s.timing(ctx, r); err != nil {
+			rd.Close()
+			return nil, err
+		}
+		rd = newReplayReader(rd, timing, speed)
 	}
 
 	var encoder encoders.Encoder
-	if r.Header.Get("Accept") == "text/event-stream" {
+	switch accept {
+	case "text/event-stream":
+		config, err := sseConfig(r)
+		if err != nil {
+			rd.Close()
+			return nil, err
+		}
 		w.Header().Set("Content-Type", "text/event-stream")
 		w.Header().Set("Cache-Control", "no-cache")
 
-		encoder = encoders.NewSSEEncoder(rd)
-		encoder.(io.Seeker).Seek(o, 0)
+		encoder = encoders.NewSSEEncoder(filtered(rd, filter), config)
 
 		// For SSE, we change the ack to a :keepalive
 		ack = []byte(":keepalive\n")
-	} else {
-		encoder = encoders.NewTextEncoder(rd)
+		comment = ack
+	case "application/x-ndjson":
+		line, err := s.lineNumber(ctx, r, o)
+		if err != nil {
+			rd.Close()
+			return nil, err
+		}
+		w.Header().Set("Content-Type", "application/x-ndjson")
+
+		encoder = encoders.NewNDJSONEncoder(rd, encoders.NDJSON{
+			Channel: key(r),
+			Line:    line,
+			Filter:  filter,
+			Arrival: timing.At,
+		})
+
+		// An empty line, which NDJSON parsers skip
+		ack = []byte("\n")
+	case "text/html":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+
+		encoder = encoders.NewHTMLEncoder(filtered(rd, filter), encoders.HTML{Document: true})
+
+		// An empty comment, which browsers don't render
+		ack = []byte("<!---->")
+		comment = ack
+	case "application/x-asciicast":
+		w.Header().Set("Content-Type", "application/x-asciicast")
+		if r.URL.Query().Get("download") == "1" {
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", path.Base(key(r))+".cast"))
+		}
+		cols, _ := strconv.Atoi(r.URL.Query().Get("cols"))
+		rows, _ := strconv.Atoi(r.URL.Query().Get("rows"))
+
+		encoder = encoders.NewAsciicastEncoder(rd, encoders.Asciicast{
+			Width:   cols,
+			Height:  rows,
+			Arrival: timing.At,
+		})
+
+		// Recordings can't hold anything but events
+		ack = nil
+	default:
+		// Raw output is sent as the type its publisher gave
+		if contentType == "" {
+			contentType, _ = broker.ContentType(key(r))
+		}
+		if contentType != "" {
+			w.Header().Set("Content-Type", contentType)
+		}
+
+		encoder = encoders.NewTextEncoder(filtered(rd, filter))
 	}
 	encoder.Seek(o, io.SeekStart)
 
+	interval, packet, err := s.keepAlive(r, ack, comment)
+	if err != nil {
+		encoder.Close()
+		return nil, err
+	}
+
 	done := w.(http.CloseNotifier).CloseNotify()
-	return newKeepAliveReader(encoder, ack, s.HeartbeatDuration, done), nil
+	return newKeepAliveReader(encoder, packet, interval, done, stop, s.draining), nil
 }
 
-func storeOutput(channel string, requestURI string, storageBase string) {
+func (s *Server) storeOutput(ctx context.Context, channel string, requestURI string, storageBase string) {
 	defer util.TimerEnd(util.TimerStart("server.storeOutput"))
+	atomic.AddInt64(&uploads.inFlight, 1)
+	defer atomic.AddInt64(&uploads.inFlight, -1)
+
+	ctx, span := trace.Start(ctx, "server.storeOutput", trace.KindInternal)
+	defer span.End()
+	span.SetAttribute("busl.key", channel)
 
 	if buf, err := broker.Get(channel); err == nil {
-		if err := storage.Put(requestURI, storageBase, bytes.NewBuffer(buf)); err != nil {
+		contentType, _ := broker.ContentType(channel)
+		if err := storage.PutTypedContext(ctx, requestURI, storageBase, contentType, bytes.NewBuffer(buf)); err != nil {
+			atomic.AddInt64(&uploads.failed, 1)
+			span.SetError(err)
 			util.CountWithData("server.storeOutput.put.error", 1, "err=%s", err.Error())
+		} else {
+			atomic.AddInt64(&uploads.succeeded, 1)
+			s.notify(eventArchived, channel, int64(len(buf)))
+
+			if err := archiveTiming(ctx, channel, storageBase); err != nil {
+				util.CountWithData("server.storeOutput.timing.error", 1, "err=%s", err.Error())
+			}
 		}
 	} else {
+		atomic.AddInt64(&uploads.failed, 1)
+		span.SetError(err)
 		util.CountWithData("server.storeOutput.get.error", 1, "err=%s", err.Error())
 	}
 }
+
+// Starts a server span for the request, continuing the trace of the
+// caller if it sent a `traceparent` header.
+//
+// The request itself is left untouched: mux keys its route variables
+// on the request pointer, which r.WithContext would change.
+func startSpan(r *http.Request, name string) (context.Context, *trace.Span) {
+	ctx, span := trace.Start(trace.Extract(r.Context(), r.Header), name, trace.KindServer)
+	span.SetAttribute("busl.key", key(r))
+	span.SetAttribute("http.method", r.Method)
+	span.SetAttribute("request_id", r.Header.Get("Request-Id"))
+	return ctx, span
+}
@@ -0,0 +1,391 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/heroku/busl/broker"
+	"github.com/heroku/busl/storage"
+	"github.com/heroku/busl/util"
+)
+
+// Most streams a single multiplexed subscription may follow
+const maxMultiStreams = 100
+
+// Name of the events telling a stream ended, which no stream followed
+// may be keyed with
+const multiDoneEvent = "done"
+
+var errInvalidMulti = errors.New("Invalid streams, expected up to 100 keys or a prefix")
+
+// Ids of multiplexed events hold the offset of every stream, encoded
+// as `<key>=<offset>&...`.
+func parseMultiID(id string) (map[string]int64, error) {
+	values, err := url.ParseQuery(id)
+	if err != nil {
+		return nil, errInvalidMulti
+	}
+
+	offsets := map[string]int64{}
+	for key := range values {
+		o, err := strconv.ParseInt(values.Get(key), 10, 64)
+		if err != nil || o < 0 {
+			return nil, errInvalidMulti
+		}
+		offsets[key] = o
+	}
+	return offsets, nil
+}
+
+func formatMultiID(offsets map[string]int64) string {
+	values := url.Values{}
+	for key, o := range offsets {
+		values.Set(key, strconv.FormatInt(o, 10))
+	}
+	return values.Encode()
+}
+
+// Returns the keys given through the `key` query parameters, along
+// with those of the streams starting with `prefix`.
+func multiKeys(r *http.Request) ([]string, error) {
+	query := r.URL.Query()
+	keys := query["key"]
+	if prefix := query.Get("prefix"); prefix != "" {
+		streams, err := broker.Streams(prefix, maxMultiStreams+1)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, streams...)
+	}
+
+	sort.Strings(keys)
+	unique := keys[:0]
+	for i, key := range keys {
+		// Keys are event names, which can't span lines
+		if key == "" || key == multiDoneEvent || strings.ContainsAny(key, "\r\n") {
+			return nil, errInvalidMulti
+		}
+		if i == 0 || key != keys[i-1] {
+			unique = append(unique, key)
+		}
+	}
+	if len(unique) == 0 || len(unique) > maxMultiStreams {
+		return nil, errInvalidMulti
+	}
+	return unique, nil
+}
+
+// authorizeMulti checks the caller may read every stream asked for
+// before calling fn.
+func (s *Server) authorizeMulti(fn http.HandlerFunc) http.HandlerFunc {
+	if !s.guarded() {
+		return fn
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := s.accessMulti(r); err != nil {
+			util.CountWithData("server.auth.reject", 1, "scope=%s error=%q request_id=%q", scopeRead, err, r.Header.Get("Request-Id"))
+			handleError(w, r, err)
+			return
+		}
+		fn(w, r)
+	}
+}
+
+// accessMulti checks the request may read every stream it asks for.
+// Stream tokens are only valid for a single key, so prefixes need
+// credentials allowed to read any stream under them.
+func (s *Server) accessMulti(r *http.Request) error {
+	query := r.URL.Query()
+	if prefix := query.Get("prefix"); prefix != "" {
+		auth := s.authenticator()
+		switch {
+		case auth != nil && (s.RequireCredentials || r.Header.Get("Authorization") != ""):
+			if err := authorize(auth, r, scopeRead, prefix); err != nil {
+				return err
+			}
+		case s.TokenSecret != "" && s.RequireReadToken:
+			return errForbidden
+		}
+	}
+
+	for _, key := range query["key"] {
+		if err := s.access(r, scopeRead, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// subscribeMulti interleaves several streams as server-sent events,
+// named after the key of their stream. Each event id holds the offset
+// of every stream, so that Last-Event-ID resumes all of them.
+func (s *Server) subscribeMulti(w http.ResponseWriter, r *http.Request) {
+	if _, ok := w.(http.Flusher); !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	ctx, span := startSpan(r, "server.subscribeMulti")
+	defer span.End()
+
+	keys, err := multiKeys(r)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	comment := []byte(":keepalive\n")
+	interval, packet, err := s.keepAlive(r, comment, comment)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	resume := map[string]int64{}
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		if resume, err = parseMultiID(id); err != nil {
+			handleError(w, r, err)
+			return
+		}
+	}
+
+	var written int64
+	util.Sample("server.sub.active", atomic.AddInt64(&activeSubscribers, 1))
+	defer func(start time.Time) {
+		util.Sample("server.sub.active", atomic.AddInt64(&activeSubscribers, -1))
+		util.MeasureWithData("server.sub.multi", time.Since(start), "streams=%d request_id=%q", len(keys), r.Header.Get("Request-Id"))
+		requestLogger(r).Info("server.sub.end", util.Fields{"bytes": written, "streams": len(keys), "duration": time.Since(start)})
+	}(time.Now())
+
+	readers := map[string]io.ReadCloser{}
+	offsets := map[string]int64{}
+	closeReaders := func() {
+		for _, rd := range readers {
+			rd.Close()
+		}
+	}
+	for _, key := range keys {
+		o := resume[key]
+		offsets[key] = o
+		rd, err := s.newStorageReader(ctx, r, key, o)
+		if err == storage.ErrRange {
+			// Already read to its end
+			continue
+		}
+		if err != nil {
+			if rd != nil {
+				rd.Close()
+			}
+			closeReaders()
+			handleError(w, r, err)
+			return
+		}
+		if broker.NoContent(rd, o) {
+			rd.Close()
+			continue
+		}
+		readers[key] = rd
+	}
+	if len(readers) == 0 {
+		handleError(w, r, errNoContent)
+		return
+	}
+
+	// Each stream is listed on its own by the admin endpoints, all of
+	// them ending together.
+	multi := newMultiReader(readers, offsets)
+	out := &eventWriter{Writer: newWriteFlusher(w), sent: multi.sent}
+	stop := make(chan struct{})
+	var stopOnce sync.Once
+	for key := range readers {
+		key, start := key, offsets[key]
+		conn := newConnection(r, roleSubscriber)
+		conn.key = key
+		conn.offset = func() int64 { return multi.offset(key, start) }
+		s.connections.add(conn)
+		defer s.connections.remove(conn)
+
+		go func() {
+			select {
+			case <-conn.closed:
+				stopOnce.Do(func() { close(stop) })
+			case <-stop:
+			}
+		}()
+	}
+	defer stopOnce.Do(func() { close(stop) })
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	done := w.(http.CloseNotifier).CloseNotify()
+	rd := newKeepAliveReader(multi, packet, interval, done, stop, s.draining)
+	defer rd.Close()
+
+	written, err = io.Copy(out, rd)
+	if err == errDraining {
+		util.CountWithData("server.sub.drain", 1, "request_id=%q", r.Header.Get("Request-Id"))
+		reconnect(w, multi.lastID())
+		return
+	}
+	if err != nil {
+		logError(r, err)
+	}
+	util.CountWithData("server.sub.read.finish", 1, "msg=%q request_id=%q", err, r.Header.Get("Request-Id"))
+}
+
+type multiChunk struct {
+	key  string
+	data []byte
+	err  error
+}
+
+// multiReader formats what several streams publish as events, in the
+// order it comes in. Once a stream is done, a `done` event carries its
+// key. It keeps the offsets each event ends at, until told the event
+// was sent.
+type multiReader struct {
+	readers map[string]io.ReadCloser
+	offsets map[string]int64
+	chunks  chan multiChunk
+	closed  chan struct{}
+	active  int // streams not done yet
+	out     bytes.Buffer
+
+	mu      sync.Mutex
+	pending []map[string]int64 // offsets at the end of unsent events
+	last    map[string]int64   // offsets at the end of the last event sent
+}
+
+func newMultiReader(readers map[string]io.ReadCloser, offsets map[string]int64) *multiReader {
+	m := &multiReader{
+		readers: readers,
+		offsets: offsets,
+		chunks:  make(chan multiChunk),
+		closed:  make(chan struct{}),
+		active:  len(readers),
+		last:    copyOffsets(offsets),
+	}
+	for key, rd := range readers {
+		go m.read(key, rd)
+	}
+	return m
+}
+
+func (m *multiReader) read(key string, rd io.Reader) {
+	for {
+		buf := make([]byte, 32*1024)
+		n, err := rd.Read(buf)
+		// Broker readers return nothing on subscription messages
+		if n == 0 && err == nil {
+			continue
+		}
+
+		select {
+		case m.chunks <- multiChunk{key, buf[:n], err}:
+		case <-m.closed:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (m *multiReader) Read(p []byte) (int, error) {
+	for m.out.Len() == 0 {
+		if m.active == 0 {
+			return 0, io.EOF
+		}
+
+		var chunk multiChunk
+		select {
+		case chunk = <-m.chunks:
+		case <-m.closed:
+			return 0, io.EOF
+		}
+		if len(chunk.data) > 0 {
+			m.offsets[chunk.key] += int64(len(chunk.data))
+			m.event(chunk.key, chunk.data)
+		}
+		switch chunk.err {
+		case nil:
+		case io.EOF:
+			m.active--
+			m.event(multiDoneEvent, []byte(chunk.key))
+		default:
+			return 0, chunk.err
+		}
+	}
+	return m.out.Read(p)
+}
+
+func (m *multiReader) event(name string, data []byte) {
+	m.mu.Lock()
+	m.pending = append(m.pending, copyOffsets(m.offsets))
+	m.mu.Unlock()
+
+	m.out.WriteString("event: " + name + "\n")
+	m.out.WriteString("id: " + formatMultiID(m.offsets) + "\n")
+	for _, line := range bytes.Split(data, []byte{'\n'}) {
+		m.out.WriteString("data: ")
+		m.out.Write(line)
+		m.out.WriteString("\n")
+	}
+	m.out.WriteString("\n")
+}
+
+func (m *multiReader) Close() error {
+	close(m.closed)
+	for _, rd := range m.readers {
+		rd.Close()
+	}
+	return nil
+}
+
+// sent records that the next events got written to the subscriber
+func (m *multiReader) sent(events int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if events > len(m.pending) {
+		events = len(m.pending)
+	}
+	if events > 0 {
+		m.last = m.pending[events-1]
+		m.pending = m.pending[events:]
+	}
+}
+
+// lastID returns the id of the last event sent, which is where to
+// resume every stream from.
+func (m *multiReader) lastID() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return formatMultiID(m.last)
+}
+
+// offset returns where the stream key was sent up to
+func (m *multiReader) offset(key string, start int64) int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if o, ok := m.last[key]; ok {
+		return o
+	}
+	return start
+}
+
+func copyOffsets(offsets map[string]int64) map[string]int64 {
+	copied := make(map[string]int64, len(offsets))
+	for key, o := range offsets {
+		copied[key] = o
+	}
+	return copied
+}
@@ -0,0 +1,164 @@
+package server
+
+import (
+	"encoding/base64"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/heroku/busl/broker"
+	"github.com/heroku/busl/storage"
+	"github.com/heroku/busl/util"
+)
+
+const (
+	maxPollWait  = time.Minute
+	maxPollBytes = 64 * 1024
+)
+
+// pollResponse is what long-polling subscribers get on each request
+type pollResponse struct {
+	Data     string `json:"data"`
+	Encoding string `json:"encoding,omitempty"` // base64 when data isn't UTF-8
+	Offset   int64  `json:"offset"`             // to poll from next
+	Done     bool   `json:"done"`
+}
+
+// poll serves clients unable to hold a streaming response open: it
+// returns what is available after `offset`, waiting up to `wait` for
+// something to be published when there is nothing yet.
+func (s *Server) poll(w http.ResponseWriter, r *http.Request) {
+	ctx, span := startSpan(r, "server.poll")
+	defer span.End()
+
+	query := r.URL.Query()
+	var (
+		o    int64
+		wait time.Duration
+		err  error
+	)
+	if v := query.Get("offset"); v != "" {
+		if o, err = strconv.ParseInt(v, 10, 64); err != nil || o < 0 {
+			http.Error(w, "Invalid offset.", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := query.Get("wait"); v != "" {
+		if wait, err = time.ParseDuration(v); err != nil || wait < 0 {
+			http.Error(w, "Invalid wait duration.", http.StatusBadRequest)
+			return
+		}
+		if wait > maxPollWait {
+			wait = maxPollWait
+		}
+	}
+
+	resp := &pollResponse{Offset: o}
+
+	// Stored streams are done, and read until the storage backend
+	// has nothing past the offset.
+	info, err := broker.Stat(key(r))
+	stored := err == broker.ErrNotRegistered
+	if err != nil && !stored {
+		handleError(w, r, err)
+		return
+	}
+	if !stored && info.Done && o >= info.Length {
+		resp.Done = true
+		writeJSON(w, resp)
+		return
+	}
+	// What is already published is read right away, the wait only
+	// bounding how long that may take.
+	if stored || o < info.Length {
+		wait = maxPollWait
+	}
+
+	rd, err := s.newStorageReader(ctx, r, key(r), o)
+	if err == storage.ErrRange {
+		// Nothing stored past the offset
+		resp.Done = true
+		writeJSON(w, resp)
+		return
+	}
+	if err != nil {
+		if rd != nil {
+			rd.Close()
+		}
+		handleError(w, r, err)
+		return
+	}
+	defer rd.Close()
+
+	buf := make([]byte, maxPollBytes)
+	n, err := readWithin(rd, buf, wait)
+	if err != nil && err != io.EOF {
+		handleError(w, r, err)
+		return
+	}
+	data := buf[:n]
+	if err == nil {
+		// The rest of a character cut off comes with the next poll
+		if end := completeRunes(data); end > 0 {
+			data = data[:end]
+		}
+	}
+	if utf8.Valid(data) {
+		resp.Data = string(data)
+	} else {
+		resp.Data = base64.StdEncoding.EncodeToString(data)
+		resp.Encoding = "base64"
+	}
+	resp.Offset += int64(len(data))
+	resp.Done = err == io.EOF || (!stored && info.Done && resp.Offset >= info.Length)
+
+	util.CountWithData("server.poll", 1, "bytes=%d request_id=%q", n, r.Header.Get("Request-Id"))
+	writeJSON(w, resp)
+}
+
+// completeRunes returns the length of buf without the UTF-8 character
+// it may end in the middle of.
+func completeRunes(buf []byte) int {
+	for i := len(buf) - 1; i >= 0 && i >= len(buf)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(buf[i]) {
+			if utf8.FullRune(buf[i:]) {
+				return len(buf)
+			}
+			return i
+		}
+	}
+	return len(buf)
+}
+
+// readWithin reads what is available from rd, waiting up to wait for
+// something to be. rd gets closed when nothing came in time.
+func readWithin(rd io.ReadCloser, p []byte, wait time.Duration) (int, error) {
+	type result struct {
+		n   int
+		err error
+	}
+	read := make(chan result, 1)
+	go func() {
+		for {
+			// Broker readers return nothing on subscription messages
+			n, err := rd.Read(p)
+			if n > 0 || err != nil {
+				read <- result{n, err}
+				return
+			}
+		}
+	}()
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case res := <-read:
+		return res.n, res.err
+	case <-timer.C:
+		rd.Close()
+		return 0, nil
+	}
+}
@@ -0,0 +1,273 @@
+package server
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/heroku/busl/util"
+)
+
+// RateLimits configures how much a single client may use busl.
+// Zero values disable the corresponding limit.
+type RateLimits struct {
+	RequestsPerSecond      int64 // per client IP, or per verified credentials or token
+	SubscriptionsPerStream int64 // concurrent subscriptions to a single stream
+	SubscriptionsPerClient int64 // concurrent subscriptions from a single client
+	PublishBytesPerSecond  int64 // publishers get throttled above this rate
+}
+
+// Limiter keeps the counters rate limits are enforced with
+type Limiter interface {
+	// Allow records an event for key in the current window and
+	// reports whether limit is still respected. When it isn't, the
+	// returned duration is how long until the window resets.
+	Allow(key string, limit int64, window time.Duration) (bool, time.Duration, error)
+
+	// Acquire takes one of the limit slots for key, and Release
+	// gives it back.
+	Acquire(key string, limit int64) (bool, error)
+	Release(key string) error
+}
+
+func (s *Server) limiter() Limiter {
+	if s.Limiter == nil {
+		s.Limiter = NewMemoryLimiter()
+	}
+	return s.Limiter
+}
+
+// limitRequests rejects clients going over RequestsPerSecond.
+func (s *Server) limitRequests(fn http.HandlerFunc) http.HandlerFunc {
+	limit := s.RateLimits.RequestsPerSecond
+	if limit <= 0 {
+		return fn
+	}
+	limiter := s.limiter()
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" || r.URL.Path == "/metrics" {
+			fn(w, r)
+			return
+		}
+
+		ok, retry, err := limiter.Allow("requests:"+s.client(r), limit, time.Second)
+		if err != nil {
+			// Don't take the service down with the limiter
+			util.CountWithData("server.ratelimit.error", 1, "error=%q", err)
+		} else if !ok {
+			tooManyRequests(w, r, "requests", retry)
+			return
+		}
+		fn(w, r)
+	}
+}
+
+// limitSubscriptions caps the concurrent subscriptions per stream and
+// per client.
+func (s *Server) limitSubscriptions(fn http.HandlerFunc) http.HandlerFunc {
+	limits := map[string]int64{
+		"stream": s.RateLimits.SubscriptionsPerStream,
+		"client": s.RateLimits.SubscriptionsPerClient,
+	}
+	if limits["stream"] <= 0 && limits["client"] <= 0 {
+		return fn
+	}
+	limiter := s.limiter()
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		slots := map[string]string{
+			"stream": "subscriptions:stream:" + key(r),
+			"client": "subscriptions:client:" + s.client(r),
+		}
+
+		for name, limit := range limits {
+			// Multiplexed subscriptions only count against clients
+			if limit <= 0 || (name == "stream" && key(r) == "") {
+				continue
+			}
+
+			ok, err := limiter.Acquire(slots[name], limit)
+			if err != nil {
+				util.CountWithData("server.ratelimit.error", 1, "error=%q", err)
+				continue
+			}
+			if !ok {
+				tooManyRequests(w, r, "subscriptions."+name, time.Second)
+				return
+			}
+			defer limiter.Release(slots[name])
+		}
+		fn(w, r)
+	}
+}
+
+// throttle slows reads from a publisher down to PublishBytesPerSecond.
+func (s *Server) throttle(r io.Reader) io.Reader {
+	if s.RateLimits.PublishBytesPerSecond <= 0 {
+		return r
+	}
+	return &throttledReader{r: r, rate: s.RateLimits.PublishBytesPerSecond, start: time.Now()}
+}
+
+func tooManyRequests(w http.ResponseWriter, r *http.Request, limit string, retry time.Duration) {
+	util.CountWithData("server.ratelimit.reject", 1, "limit=%s request_id=%q", limit, r.Header.Get("Request-Id"))
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retry.Seconds()))))
+	http.Error(w, "Too many requests, please try again later.", http.StatusTooManyRequests)
+}
+
+// Identifies the client behind a request: the credentials or stream
+// token it presents once verified, otherwise its IP address. Anything
+// unverified would let clients get a fresh limit with each request.
+func (s *Server) client(r *http.Request) string {
+	if credentials := r.Header.Get("Authorization"); credentials != "" {
+		if auth := s.authenticator(); auth != nil {
+			if _, err := authenticate(auth, r); err == nil {
+				return "token:" + hash(credentials)
+			}
+		}
+	}
+	if t := token(r); t != "" && s.TokenSecret != "" {
+		scope := tokenScope(strings.SplitN(t, ".", 2)[0])
+		if s.verifyToken(t, requestKey(r), scope) == nil {
+			return "token:" + hash(t)
+		}
+	}
+
+	// A trusted proxy, such as the Heroku router, appends the address
+	// it got the request from to X-Forwarded-For. Clients could send
+	// anything there otherwise.
+	if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" && s.TrustProxy {
+		parts := strings.Split(fwd, ",")
+		return "ip:" + strings.TrimSpace(parts[len(parts)-1])
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// Returns the stream key of the request, even before it is routed
+func requestKey(r *http.Request) string {
+	if k := key(r); k != "" {
+		return k
+	}
+	if strings.HasPrefix(r.URL.Path, "/streams/") {
+		return strings.TrimPrefix(r.URL.Path, "/streams/")
+	}
+	return ""
+}
+
+func hash(s string) string {
+	sum := sha1.Sum([]byte(s))
+	return hex.EncodeToString(sum[:8])
+}
+
+type throttledReader struct {
+	r     io.Reader
+	rate  int64 // bytes per second
+	start time.Time
+	n     int64 // bytes read so far
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if int64(len(p)) > t.rate {
+		p = p[:t.rate]
+	}
+
+	n, err := t.r.Read(p)
+	t.n += int64(n)
+
+	expected := time.Duration(float64(t.n) / float64(t.rate) * float64(time.Second))
+	if wait := expected - time.Since(t.start); wait > 0 {
+		util.Count("server.pub.throttle")
+		time.Sleep(wait)
+	}
+	return n, err
+}
+
+type memoryWindow struct {
+	end   time.Time
+	count int64
+}
+
+// MemoryLimiter keeps rate limiting counters in memory, which only
+// limits clients per busl instance.
+type MemoryLimiter struct {
+	mutex   sync.Mutex
+	windows map[string]*memoryWindow
+	slots   map[string]int64
+	swept   time.Time
+}
+
+// NewMemoryLimiter creates an in-memory limiter
+func NewMemoryLimiter() *MemoryLimiter {
+	return &MemoryLimiter{
+		windows: make(map[string]*memoryWindow),
+		slots:   make(map[string]int64),
+		swept:   time.Now(),
+	}
+}
+
+// Allow implements Limiter
+func (l *MemoryLimiter) Allow(key string, limit int64, window time.Duration) (bool, time.Duration, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	l.sweep(now)
+
+	w, ok := l.windows[key]
+	if !ok || !now.Before(w.end) {
+		w = &memoryWindow{end: now.Add(window)}
+		l.windows[key] = w
+	}
+	w.count++
+
+	return w.count <= limit, w.end.Sub(now), nil
+}
+
+// Drops the expired windows every minute so the map doesn't grow
+// with every client ever seen.
+func (l *MemoryLimiter) sweep(now time.Time) {
+	if now.Sub(l.swept) < time.Minute {
+		return
+	}
+	for key, w := range l.windows {
+		if !now.Before(w.end) {
+			delete(l.windows, key)
+		}
+	}
+	l.swept = now
+}
+
+// Acquire implements Limiter
+func (l *MemoryLimiter) Acquire(key string, limit int64) (bool, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.slots[key] >= limit {
+		return false, nil
+	}
+	l.slots[key]++
+	return true, nil
+}
+
+// Release implements Limiter
+func (l *MemoryLimiter) Release(key string) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.slots[key]--; l.slots[key] <= 0 {
+		delete(l.slots, key)
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/heroku/busl/broker"
+	"github.com/heroku/busl/storage"
+	"github.com/heroku/busl/util"
+)
+
+var errInvalidReplay = errors.New("Invalid replay mode or speed")
+
+// Returns how fast the stream should be replayed, through the `replay`
+// and `speed` query parameters, or 0 when it shouldn't be paced.
+func replaySpeed(r *http.Request) (float64, error) {
+	query := r.URL.Query()
+	switch query.Get("replay") {
+	case "":
+		return 0, nil
+	case "realtime":
+	default:
+		return 0, errInvalidReplay
+	}
+
+	speed := 1.0
+	if v := query.Get("speed"); v != "" {
+		var err error
+		speed, err = strconv.ParseFloat(strings.TrimSuffix(v, "x"), 64)
+		if err != nil || speed <= 0 {
+			return 0, errInvalidReplay
+		}
+	}
+	return speed, nil
+}
+
+// Where the timing index of a stream gets archived. Request paths are
+// cleaned before being routed, so no stream key holds an empty path
+// segment, and no stream gets archived over an index. The query of the
+// request, which may presign the URL of the output, isn't valid for it.
+func timingURI(key string) string {
+	return "timing//" + key
+}
+
+// Returns the timing index of the stream from the broker, or from the
+// storage backend once archived. It is empty when none was recorded.
+func (s *Server) timing(ctx context.Context, r *http.Request) (broker.Timing, error) {
+	index, err := broker.GetTiming(key(r))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(index) == 0 {
+		rd, err := storage.GetContext(ctx, timingURI(key(r)), s.StorageBaseURL(r), 0)
+		if err != nil {
+			// Streams archived before timings were recorded
+			util.CountWithData("server.replay.timing.missing", 1, "error=%q request_id=%q", err, r.Header.Get("Request-Id"))
+			return nil, nil
+		}
+		defer rd.Close()
+		if index, err = ioutil.ReadAll(rd); err != nil {
+			return nil, err
+		}
+	}
+	return broker.ParseTiming(index), nil
+}
+
+// replayReader paces a stream as it was published, speed times faster.
+// Without a speed, it only splits reads where chunks were published.
+type replayReader struct {
+	io.ReadCloser
+	timing broker.Timing
+	speed  float64
+
+	offset int64
+	chunk  int // last chunk returned, -1 before the first one
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newReplayReader(rd io.ReadCloser, timing broker.Timing, speed float64) io.ReadCloser {
+	return &replayReader{ReadCloser: rd, timing: timing, speed: speed, chunk: -1, closed: make(chan struct{})}
+}
+
+func (r *replayReader) Seek(offset int64, whence int) (n int64, err error) {
+	if seeker, ok := r.ReadCloser.(io.ReadSeeker); ok {
+		r.offset, err = seeker.Seek(offset, whence)
+	} else {
+		if whence != io.SeekStart {
+			return 0, errors.New("Only SeekStart is supported")
+		}
+		r.offset += offset
+	}
+	return r.offset, err
+}
+
+func (r *replayReader) Read(p []byte) (int, error) {
+	if i := r.timing.Find(r.offset); i >= 0 {
+		if r.speed > 0 && r.chunk >= 0 && i > r.chunk {
+			wait := time.Duration(float64(r.timing[i].Time.Sub(r.timing[r.chunk].Time)) / r.speed)
+			if !r.wait(wait) {
+				return 0, io.EOF
+			}
+		}
+		r.chunk = i
+
+		// Stop at the end of the chunk, for the next one to be paced
+		if end := r.timing[i].Offset + r.timing[i].Length - r.offset; int64(len(p)) > end {
+			p = p[:end]
+		}
+	}
+
+	n, err := r.ReadCloser.Read(p)
+	r.offset += int64(n)
+	return n, err
+}
+
+// wait returns false when the reader got closed while waiting
+func (r *replayReader) wait(d time.Duration) bool {
+	if d <= 0 {
+		return true
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-r.closed:
+		return false
+	}
+}
+
+func (r *replayReader) Close() error {
+	r.closeOnce.Do(func() { close(r.closed) })
+	return r.ReadCloser.Close()
+}
+
+// Archives the timing index of a stream along with its output
+func archiveTiming(ctx context.Context, channel, storageBase string) error {
+	index, err := broker.GetTiming(channel)
+	if err != nil || len(index) == 0 {
+		return err
+	}
+	return storage.PutContext(ctx, timingURI(channel), storageBase, bytes.NewReader(index))
+}
@@ -1,64 +1,170 @@
 package server
 
 import (
+	"context"
 	"log"
 	"net/http"
+	"sync"
 	"time"
 
-	"github.com/braintree/manners"
 	"github.com/gorilla/mux"
 )
 
 // Config holds all the server options
 type Config struct {
-	EnforceHTTPS      bool
-	Credentials       string
+	EnforceHTTPS  bool
+	TrustProxy    bool // reads client addresses from X-Forwarded-For
+	Credentials   string
+	Authenticator Authenticator // takes precedence over Credentials
+
+	// Requires credentials, or a stream token, to read, publish and
+	// close streams too, instead of only to create them
+	RequireCredentials bool
+
 	HeartbeatDuration time.Duration
 	StorageBaseURL    func(*http.Request) string
+
+	// Bound the heartbeat interval subscribers may ask for, not
+	// bounded when zero.
+	MinHeartbeatDuration time.Duration
+	MaxHeartbeatDuration time.Duration
+
+	// Signs per-stream publish and read tokens. Streams are open
+	// to anyone knowing their key when empty.
+	TokenSecret      string
+	TokenTTL         time.Duration
+	RequireReadToken bool
+
+	Metrics    http.Handler // served on /metrics when set
+	CORS       CORS
+	RateLimits RateLimits
+	Limiter    Limiter // keeps rate limiting counters in memory when nil
+
+	// Bounds graceful shutdown, 30 seconds when zero
+	DrainTimeout time.Duration
+
+	TLS TLS // serves HTTPS when certificate files are set
+
+	Webhooks Webhooks
 }
 
 // Server is a launchable api listener
 type Server struct {
-	*manners.GracefulServer
+	*http.Server
 	*Config
+
+	draining  chan struct{} // closed once shutdown starts
+	resuming  chan struct{} // closed when in-flight publishes must stop
+	drainOnce sync.Once
+
+	reloadCerts  chan struct{}
+	connections  connections
+	netConns     netConns
+	webhookQueue Queue
 }
 
 // NewServer creates a new server instance
 func NewServer(config *Config) *Server {
-	return &Server{
-		GracefulServer: manners.NewServer(),
-		Config:         config,
+	queue := config.Webhooks.Queue
+	if queue == nil {
+		queue = NewMemoryQueue()
 	}
+
+	s := &Server{
+		Server:   &http.Server{},
+		Config:   config,
+		draining: make(chan struct{}),
+		resuming: make(chan struct{}),
+
+		reloadCerts:  make(chan struct{}, 1),
+		webhookQueue: queue,
+	}
+	s.ConnState = s.netConns.track
+	return s
 }
 
-// Start starts the server instance
+// Start starts the server instance, returning once it has been drained
 func (s *Server) Start(port string, shutdown <-chan struct{}) {
 	log.Printf("http.start.port=%s\n", port)
 	s.Handler = s.router()
-	go s.listenForShutdown(shutdown)
+
+	drained := make(chan struct{})
+	go func() {
+		s.listenForShutdown(shutdown)
+		close(drained)
+	}()
+
+	if s.Webhooks.Enabled() {
+		go s.deliverWebhooks(s.draining)
+		go s.watchExpired(s.draining)
+	}
 
 	s.Addr = ":" + port
-	if err := s.ListenAndServe(); err != nil {
+	serve := s.ListenAndServe
+	if s.TLS.Enabled() {
+		serve = s.listenAndServeTLS
+	}
+	if err := serve(); err != http.ErrServerClosed {
 		log.Fatalf("server.server error=%v", err)
 	}
+	<-drained
 }
 
 func (s *Server) listenForShutdown(shutdown <-chan struct{}) {
 	log.Println("http.graceful.await")
 	<-shutdown
 	log.Println("http.graceful.shutdown")
-	s.Close()
+	if err := s.drain(); err != nil {
+		log.Printf("http.graceful.timeout error=%v", err)
+	}
+}
+
+// drain stops accepting connections and hands subscribers off right
+// away. Publishes get most of the drain timeout to finish before being
+// told to resume, and connections still open when it expires are closed.
+func (s *Server) drain() error {
+	timeout := s.DrainTimeout
+	if timeout <= 0 {
+		timeout = defaultDrainTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	s.drainOnce.Do(func() { close(s.draining) })
+	resume := time.AfterFunc(timeout-timeout/10, func() { close(s.resuming) })
+	defer resume.Stop()
+
+	if err := s.Shutdown(ctx); err != nil {
+		s.Close()
+		return err
+	}
+	return nil
 }
 
 func (s *Server) router() http.Handler {
 	r := mux.NewRouter()
 
 	r.HandleFunc("/health", s.addDefaultHeaders(s.health))
+	if s.Metrics != nil {
+		r.Handle("/metrics", s.Metrics).Methods("GET")
+	}
+
+	r.HandleFunc("/streams/{key:.+}", s.addDefaultHeaders(s.authorize(scopeRead, s.poll))).Methods("GET").Queries("poll", "true")
+	r.HandleFunc("/streams/{key:.+}", s.addDefaultHeaders(s.authorize(scopeRead, s.limitSubscriptions(s.subscribe)))).Methods("GET")
+	r.HandleFunc("/streams/{key:.+}", s.addDefaultHeaders(s.authorize(scopeRead, s.head))).Methods("HEAD")
+	r.HandleFunc("/multi", s.addDefaultHeaders(s.authorizeMulti(s.limitSubscriptions(s.subscribeMulti)))).Methods("GET")
+	r.HandleFunc("/view/{key:.+}", s.addDefaultHeaders(s.authorize(scopeRead, s.view))).Methods("GET")
+	r.HandleFunc("/streams/{key:.+}", s.addDefaultHeaders(s.requireClientCert(s.authorize(scopePublish, s.publish)))).Methods("POST")
+	r.HandleFunc("/streams/{key:.+}", s.addDefaultHeaders(s.requireClientCert(s.authorize(scopePublish, s.closeStream)))).Methods("DELETE")
+	r.HandleFunc("/streams/{key:.+}", s.addDefaultHeaders(s.requireClientCert(s.auth(s.createStream)))).Methods("PUT")
+	r.HandleFunc("/streams/{key:.+}", s.addDefaultHeaders(s.preflight)).Methods("OPTIONS")
 
-	r.HandleFunc("/streams/{key:.+}", s.addDefaultHeaders(s.subscribe)).Methods("GET")
-	r.HandleFunc("/streams/{key:.+}", s.addDefaultHeaders(s.publish)).Methods("POST")
-	r.HandleFunc("/streams/{key:.+}", s.addDefaultHeaders(s.closeStream)).Methods("DELETE")
-	r.HandleFunc("/streams/{key:.+}", s.auth(s.addDefaultHeaders(s.createStream))).Methods("PUT")
+	if s.authenticator() != nil {
+		r.HandleFunc("/admin/status", s.addDefaultHeaders(s.requireClientCert(s.admin(s.status)))).Methods("GET")
+		r.HandleFunc("/admin/streams", s.addDefaultHeaders(s.requireClientCert(s.admin(s.listStreams)))).Methods("GET")
+		r.HandleFunc("/admin/streams/{key:.+}", s.addDefaultHeaders(s.requireClientCert(s.admin(s.forceCloseStream)))).Methods("DELETE")
+		r.HandleFunc("/admin/connections/{id}", s.addDefaultHeaders(s.requireClientCert(s.admin(s.disconnect)))).Methods("DELETE")
+	}
 
-	return logRequest(s.enforceHTTPS(r.ServeHTTP))
+	return logRequest(authenticateOnce(s.enforceHTTPS(s.limitRequests(r.ServeHTTP))))
 }
@@ -1,16 +1,40 @@
 package server
 
 import (
+	"bufio"
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/heroku/busl/broker"
+	"github.com/heroku/busl/encoders"
 	"github.com/heroku/busl/util"
 	"github.com/stretchr/testify/assert"
 )
@@ -406,6 +430,93 @@ func TestPutWithBackend(t *testing.T) {
 	assert.Equal(t, <-put, []byte("hello world"))
 }
 
+func TestContentType(t *testing.T) {
+	uuid, _ := util.NewUUID()
+
+	stored := make(chan string, 1)
+	storage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PUT" && r.URL.Path == "/"+uuid {
+			stored <- r.Header.Get("Content-Type")
+		}
+	}))
+	defer storage.Close()
+
+	baseServer.StorageBaseURL = func(*http.Request) string { return storage.URL }
+	defer func() {
+		baseServer.StorageBaseURL = func(*http.Request) string { return "" }
+	}()
+
+	server := httptest.NewServer(baseServer.router())
+	defer server.Close()
+
+	request, _ := http.NewRequest("PUT", server.URL+"/streams/"+uuid, nil)
+	request.Header.Set("Content-Type", "text/csv; charset=iso-8859-1")
+	resp, err := http.DefaultClient.Do(request)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	// Only the first type given is kept
+	request, _ = http.NewRequest("POST", server.URL+"/streams/"+uuid, strings.NewReader("a,b\n"))
+	request.Header.Set("Content-Type", "application/json")
+	resp, err = http.DefaultClient.Do(request)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/csv; charset=iso-8859-1", <-stored)
+
+	resp, err = http.Get(server.URL + "/streams/" + uuid)
+	assert.Nil(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "a,b\n", string(body))
+	assert.Equal(t, "text/csv; charset=iso-8859-1", resp.Header.Get("Content-Type"))
+
+	resp, err = http.Head(server.URL + "/streams/" + uuid)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, "text/csv; charset=iso-8859-1", resp.Header.Get("Content-Type"))
+
+	// Encoded subscriptions keep their own type
+	request, _ = http.NewRequest("GET", server.URL+"/streams/"+uuid, nil)
+	request.Header.Set("Accept", "text/event-stream")
+	resp, err = http.DefaultClient.Do(request)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+}
+
+func TestStoredContentType(t *testing.T) {
+	uuid, _ := util.NewUUID()
+
+	// Presigned GET URLs don't allow HEAD requests
+	storage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Content-Type", "text/csv")
+		w.Write([]byte("a,b\n"))
+	}))
+	defer storage.Close()
+
+	baseServer.StorageBaseURL = func(*http.Request) string { return storage.URL }
+	defer func() {
+		baseServer.StorageBaseURL = func(*http.Request) string { return "" }
+	}()
+
+	server := httptest.NewServer(baseServer.router())
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/streams/" + uuid)
+	assert.Nil(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "a,b\n", string(body))
+	assert.Equal(t, "text/csv", resp.Header.Get("Content-Type"))
+}
+
 func TestAuthentication(t *testing.T) {
 	baseServer.Credentials = "u:pass1|u:pass2"
 	defer func() {
@@ -492,3 +603,1687 @@ func TestCloseStream(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, 200, r.StatusCode)
 }
+
+func TestHead(t *testing.T) {
+	server := httptest.NewServer(baseServer.router())
+	defer server.Close()
+
+	client := &http.Client{Transport: &http.Transport{}}
+
+	uuid, _ := util.NewUUID()
+	url := server.URL + "/streams/" + uuid
+
+	// curl -I <url>/streams/<uuid>
+	resp, err := client.Head(url)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	// curl -XPUT <url>/streams/<uuid>
+	request, _ := http.NewRequest("PUT", url, nil)
+	resp, err = client.Do(request)
+	assert.Nil(t, err)
+	resp.Body.Close()
+
+	writer, err := broker.NewWriter(uuid)
+	assert.Nil(t, err)
+	writer.Write([]byte("hello"))
+
+	resp, err = client.Head(url)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "5", resp.Header.Get("Busl-Stream-Length"))
+	assert.Equal(t, "false", resp.Header.Get("Busl-Stream-Done"))
+	assert.Equal(t, `W/"5-open"`, resp.Header.Get("ETag"))
+	assert.NotEmpty(t, resp.Header.Get("Last-Modified"))
+
+	writer.Close()
+
+	resp, err = client.Head(url)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(5), resp.ContentLength)
+	assert.Equal(t, "true", resp.Header.Get("Busl-Stream-Done"))
+	assert.Equal(t, `W/"5-done"`, resp.Header.Get("ETag"))
+}
+
+func TestHeadStored(t *testing.T) {
+	uuid, _ := util.NewUUID()
+
+	// Presigned GET URLs don't allow HEAD requests
+	storage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Header().Set("ETag", `"abc"`)
+		w.Header().Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+		w.Header().Set("Content-Type", "text/csv")
+		if r.Header.Get("Range") == "bytes=0-0" {
+			w.Header().Set("Content-Range", "bytes 0-0/4")
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write([]byte("a"))
+			return
+		}
+		w.Write([]byte("a,b\n"))
+	}))
+	defer storage.Close()
+
+	baseServer.StorageBaseURL = func(*http.Request) string { return storage.URL }
+	defer func() {
+		baseServer.StorageBaseURL = func(*http.Request) string { return "" }
+	}()
+
+	server := httptest.NewServer(baseServer.router())
+	defer server.Close()
+
+	resp, err := http.Head(server.URL + "/streams/" + uuid)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, int64(4), resp.ContentLength)
+	assert.Equal(t, "true", resp.Header.Get("Busl-Stream-Done"))
+	assert.Equal(t, `"abc"`, resp.Header.Get("ETag"))
+	assert.Equal(t, "Mon, 02 Jan 2006 15:04:05 GMT", resp.Header.Get("Last-Modified"))
+	assert.Equal(t, "text/csv", resp.Header.Get("Content-Type"))
+}
+
+func TestStreamTokens(t *testing.T) {
+	baseServer.TokenSecret = "secret"
+	baseServer.RequireReadToken = true
+	defer func() {
+		baseServer.TokenSecret = ""
+		baseServer.RequireReadToken = false
+	}()
+
+	server := httptest.NewServer(baseServer.router())
+	defer server.Close()
+
+	client := &http.Client{Transport: &http.Transport{}}
+
+	uuid, _ := util.NewUUID()
+	url := server.URL + "/streams/" + uuid
+
+	// curl -XPUT <url>/streams/<uuid>
+	request, _ := http.NewRequest("PUT", url, nil)
+	resp, err := client.Do(request)
+	assert.Nil(t, err)
+	resp.Body.Close()
+
+	publishToken := resp.Header.Get("Busl-Publish-Token")
+	readToken := resp.Header.Get("Busl-Read-Token")
+	assert.NotEmpty(t, publishToken)
+	assert.NotEmpty(t, readToken)
+
+	// Missing and mismatched tokens are rejected
+	resp, err = http.Post(url, "text/plain", bytes.NewBufferString("hello"))
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	resp, err = http.Post(url+"?token="+readToken, "text/plain", bytes.NewBufferString("hello"))
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	resp, err = http.Get(url)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	// Matching tokens are accepted
+	req, _ := http.NewRequest("POST", url, bytes.NewBufferString("hello"))
+	req.Header.Set("Busl-Token", publishToken)
+	resp, err = client.Do(req)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, err = http.Get(url + "?token=" + readToken)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, []byte("hello"), body)
+}
+
+func TestAuthorizeCredentialsOrTokens(t *testing.T) {
+	config := *baseServer.Config
+	config.Credentials = "u:pass"
+	config.TokenSecret = "secret"
+	config.RequireCredentials = true
+	server := httptest.NewServer(NewServer(&config).router())
+	defer server.Close()
+
+	uuid, _ := util.NewUUID()
+	url := server.URL + "/streams/" + uuid
+
+	request, _ := http.NewRequest("PUT", url, nil)
+	request.SetBasicAuth("u", "pass")
+	resp, err := http.DefaultClient.Do(request)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	publishToken := resp.Header.Get("Busl-Publish-Token")
+
+	// Leaving credentials out doesn't skip authentication
+	for _, method := range []string{"GET", "POST", "HEAD"} {
+		request, _ = http.NewRequest(method, url, nil)
+		resp, err = http.DefaultClient.Do(request)
+		assert.Nil(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode, method)
+	}
+	for _, query := range []string{"key=" + uuid, "prefix=" + uuid} {
+		resp, err = http.Get(server.URL + "/multi?" + query)
+		assert.Nil(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode, query)
+	}
+
+	// A valid token is enough, even along with invalid credentials
+	request, _ = http.NewRequest("POST", url, bytes.NewBufferString("hello"))
+	request.SetBasicAuth("u", "wrong")
+	request.Header.Set("Busl-Token", publishToken)
+	resp, err = http.DefaultClient.Do(request)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	request, _ = http.NewRequest("GET", url, nil)
+	request.SetBasicAuth("u", "pass")
+	resp, err = http.DefaultClient.Do(request)
+	assert.Nil(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "hello", string(body))
+}
+
+func TestCredentialsOnlyGuardCreation(t *testing.T) {
+	config := *baseServer.Config
+	config.Credentials = "u:pass"
+	server := httptest.NewServer(NewServer(&config).router())
+	defer server.Close()
+
+	uuid, _ := util.NewUUID()
+	url := server.URL + "/streams/" + uuid
+
+	request, _ := http.NewRequest("PUT", url, nil)
+	resp, err := http.DefaultClient.Do(request)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	request.SetBasicAuth("u", "pass")
+	resp, err = http.DefaultClient.Do(request)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	// Publishers and subscribers go without credentials, as they did
+	// before busl knew more than basic auth
+	resp, err = http.Post(url, "text/plain", bytes.NewBufferString("hello"))
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, err = http.Get(url)
+	assert.Nil(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "hello", string(body))
+
+	resp, err = http.Get(server.URL + "/multi?key=" + uuid)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestVerifyToken(t *testing.T) {
+	s := NewServer(&Config{TokenSecret: "secret"})
+
+	valid := s.newToken("1/2/3", scopePublish, time.Now().Add(time.Minute))
+	assert.Nil(t, s.verifyToken(valid, "1/2/3", scopePublish))
+	assert.Equal(t, errInvalidToken, s.verifyToken(valid, "1/2/4", scopePublish))
+	assert.Equal(t, errInvalidToken, s.verifyToken(valid, "1/2/3", scopeRead))
+	assert.Equal(t, errMissingToken, s.verifyToken("", "1/2/3", scopePublish))
+
+	expired := s.newToken("1/2/3", scopePublish, time.Now().Add(-time.Minute))
+	assert.Equal(t, errExpiredToken, s.verifyToken(expired, "1/2/3", scopePublish))
+}
+
+func TestStorageQuery(t *testing.T) {
+	assert.Equal(t, "", storageQuery(""))
+	assert.Equal(t, "", storageQuery("token=abc"))
+	assert.Equal(t, "X-Amz-Signature=a%2Fb&foo", storageQuery("token=abc&X-Amz-Signature=a%2Fb&foo"))
+}
+
+func TestBearerAuthentication(t *testing.T) {
+	baseServer.Authenticator = NewBearerAuthenticator("secret-token")
+	defer func() {
+		baseServer.Authenticator = nil
+	}()
+
+	server := httptest.NewServer(baseServer.router())
+	defer server.Close()
+
+	client := &http.Client{Transport: &http.Transport{}}
+
+	for token, status := range map[string]int{
+		"":             http.StatusUnauthorized,
+		"invalid":      http.StatusUnauthorized,
+		"secret-token": http.StatusCreated,
+	} {
+		request, _ := http.NewRequest("PUT", server.URL+"/streams/1/2/3", nil)
+		if token != "" {
+			request.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := client.Do(request)
+		assert.Nil(t, err)
+		resp.Body.Close()
+		assert.Equal(t, status, resp.StatusCode)
+	}
+}
+
+func TestJWTAuthenticator(t *testing.T) {
+	auth := &JWTAuthenticator{Audience: "busl"}
+	auth.AddSecret([]byte("secret"))
+
+	sign := func(claims string) string {
+		header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+		payload := base64.RawURLEncoding.EncodeToString([]byte(claims))
+		mac := hmac.New(sha256.New, []byte("secret"))
+		mac.Write([]byte(header + "." + payload))
+		return header + "." + payload + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+	}
+
+	request := func(token string) *http.Request {
+		r, _ := http.NewRequest("PUT", "/streams/builds/1", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		return r
+	}
+
+	valid := sign(`{"sub":"ci","aud":["busl"],"busl":{"create":["builds/"],"read":[""]}}`)
+	identity, err := auth.Authenticate(request(valid))
+	assert.Nil(t, err)
+	assert.Equal(t, "ci", identity.Name)
+
+	assert.True(t, identity.allows(scopeCreate, "builds/1"))
+	assert.True(t, identity.allows(scopeRead, "deploys/1"))
+	assert.False(t, identity.allows(scopeCreate, "deploys/1"))
+	assert.False(t, identity.allows(scopePublish, "builds/1"))
+
+	// Tokens without a busl claim are unrestricted, but for admin
+	identity, err = auth.Authenticate(request(sign(`{"sub":"admin","aud":"busl"}`)))
+	assert.Nil(t, err)
+	assert.True(t, identity.allows(scopePublish, "deploys/1"))
+	assert.False(t, identity.allows(scopeAdmin, "deploys/1"))
+
+	for _, token := range []string{
+		sign(`{"sub":"ci","aud":"other"}`),
+		sign(fmt.Sprintf(`{"sub":"ci","aud":"busl","exp":%d}`, time.Now().Add(-time.Minute).Unix())),
+		valid[:len(valid)-2],
+		"not-a-jwt",
+	} {
+		_, err := auth.Authenticate(request(token))
+		assert.Equal(t, errUnauthorized, err)
+	}
+}
+
+func TestParsePEMKeys(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	assert.Nil(t, err)
+	pkcs1, _ := asn1.Marshal(key.PublicKey)
+	pkix, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	data := append(pem.EncodeToMemory(&pem.Block{Type: "RSA PUBLIC KEY", Bytes: pkcs1}),
+		pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pkix})...)
+
+	keys, err := parsePEMKeys(data)
+	assert.Nil(t, err)
+	assert.Len(t, keys, 2)
+	for _, k := range keys {
+		assert.Equal(t, &key.PublicKey, k.key)
+	}
+
+	_, err = parsePEMKeys(pem.EncodeToMemory(&pem.Block{Type: "RSA PUBLIC KEY", Bytes: []byte("junk")}))
+	assert.Error(t, err)
+}
+
+func TestRateLimitRequests(t *testing.T) {
+	s := NewServer(&Config{
+		HeartbeatDuration: time.Second,
+		StorageBaseURL:    func(*http.Request) string { return "" },
+		RateLimits:        RateLimits{RequestsPerSecond: 2},
+	})
+	server := httptest.NewServer(s.router())
+	defer server.Close()
+
+	uuid, _ := util.NewUUID()
+	for i, status := range []int{http.StatusNotFound, http.StatusNotFound, http.StatusTooManyRequests} {
+		// Unverified credentials or forwarded addresses don't get
+		// clients a limit of their own
+		req, _ := http.NewRequest("GET", server.URL+"/streams/"+uuid+"?token=read.1."+strconv.Itoa(i), nil)
+		req.Header.Set("Authorization", "Bearer "+strconv.Itoa(i))
+		req.Header.Set("X-Forwarded-For", "10.0.0."+strconv.Itoa(i))
+		resp, err := http.DefaultClient.Do(req)
+		assert.Nil(t, err)
+		resp.Body.Close()
+		assert.Equal(t, status, resp.StatusCode)
+		if status == http.StatusTooManyRequests {
+			assert.Equal(t, "1", resp.Header.Get("Retry-After"))
+		}
+	}
+
+	// Health checks are never limited
+	resp, err := http.Get(server.URL + "/health")
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestRateLimitTrustProxy(t *testing.T) {
+	s := NewServer(&Config{
+		HeartbeatDuration: time.Second,
+		StorageBaseURL:    func(*http.Request) string { return "" },
+		RateLimits:        RateLimits{RequestsPerSecond: 1},
+		TrustProxy:        true,
+	})
+	server := httptest.NewServer(s.router())
+	defer server.Close()
+
+	uuid, _ := util.NewUUID()
+	for _, fwd := range []string{"10.0.0.1", "10.0.0.2", "1.2.3.4, 10.0.0.3"} {
+		req, _ := http.NewRequest("GET", server.URL+"/streams/"+uuid, nil)
+		req.Header.Set("X-Forwarded-For", fwd)
+		resp, err := http.DefaultClient.Do(req)
+		assert.Nil(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	}
+}
+
+type countingAuthenticator struct {
+	Authenticator
+	calls int32
+}
+
+func (a *countingAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	atomic.AddInt32(&a.calls, 1)
+	return a.Authenticator.Authenticate(r)
+}
+
+func TestRateLimitAuthenticatesOnce(t *testing.T) {
+	auth := &countingAuthenticator{Authenticator: NewBearerAuthenticator("secret")}
+	s := NewServer(&Config{
+		HeartbeatDuration:  time.Second,
+		StorageBaseURL:     func(*http.Request) string { return "" },
+		RateLimits:         RateLimits{RequestsPerSecond: 10},
+		Authenticator:      auth,
+		RequireCredentials: true,
+	})
+	server := httptest.NewServer(s.router())
+	defer server.Close()
+
+	uuid, _ := util.NewUUID()
+	req, _ := http.NewRequest("GET", server.URL+"/streams/"+uuid, nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&auth.calls))
+}
+
+func TestRateLimitSubscriptions(t *testing.T) {
+	s := NewServer(&Config{
+		HeartbeatDuration: time.Second,
+		StorageBaseURL:    func(*http.Request) string { return "" },
+		RateLimits:        RateLimits{SubscriptionsPerStream: 1},
+	})
+	server := httptest.NewServer(s.router())
+	defer server.Close()
+
+	uuid, _ := util.NewUUID()
+	registrar := broker.NewRedisRegistrar()
+	registrar.Register(uuid)
+
+	first, err := http.Get(server.URL + "/streams/" + uuid)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, first.StatusCode)
+
+	resp, err := http.Get(server.URL + "/streams/" + uuid)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+
+	writer, _ := broker.NewWriter(uuid)
+	writer.Close()
+	ioutil.ReadAll(first.Body)
+	first.Body.Close()
+}
+
+func TestThrottledReader(t *testing.T) {
+	start := time.Now()
+	r := &throttledReader{r: bytes.NewReader(make([]byte, 300)), rate: 1000, start: start}
+	n, err := io.Copy(ioutil.Discard, r)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(300), n)
+	assert.True(t, time.Since(start) >= 300*time.Millisecond)
+}
+
+func TestMemoryLimiter(t *testing.T) {
+	l := NewMemoryLimiter()
+
+	ok, _, _ := l.Allow("a", 1, time.Minute)
+	assert.True(t, ok)
+	ok, retry, _ := l.Allow("a", 1, time.Minute)
+	assert.False(t, ok)
+	assert.True(t, retry > 0)
+
+	ok, _ = l.Acquire("b", 1)
+	assert.True(t, ok)
+	ok, _ = l.Acquire("b", 1)
+	assert.False(t, ok)
+	l.Release("b")
+	ok, _ = l.Acquire("b", 1)
+	assert.True(t, ok)
+}
+
+func TestCORS(t *testing.T) {
+	s := NewServer(&Config{
+		HeartbeatDuration: time.Second,
+		StorageBaseURL:    func(*http.Request) string { return "" },
+		CORS: CORS{
+			AllowedOrigins: []string{"https://*.example.com"},
+			MaxAge:         time.Minute,
+		},
+	})
+	server := httptest.NewServer(s.router())
+	defer server.Close()
+
+	client := &http.Client{Transport: &http.Transport{}}
+
+	preflight := func(origin, method, headers string) *http.Response {
+		request, _ := http.NewRequest("OPTIONS", server.URL+"/streams/1/2/3", nil)
+		request.Header.Set("Origin", origin)
+		request.Header.Set("Access-Control-Request-Method", method)
+		if headers != "" {
+			request.Header.Set("Access-Control-Request-Headers", headers)
+		}
+		resp, err := client.Do(request)
+		assert.Nil(t, err)
+		resp.Body.Close()
+		return resp
+	}
+
+	resp := preflight("https://ci.example.com", "POST", "busl-token, content-type")
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Equal(t, "https://ci.example.com", resp.Header.Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "60", resp.Header.Get("Access-Control-Max-Age"))
+	assert.Contains(t, resp.Header.Get("Access-Control-Allow-Methods"), "DELETE")
+	assert.Empty(t, resp.Header.Get("Access-Control-Allow-Credentials"))
+
+	resp = preflight("https://evil.com", "POST", "")
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.Empty(t, resp.Header.Get("Access-Control-Allow-Origin"))
+
+	resp = preflight("https://ci.example.com", "PATCH", "")
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	resp = preflight("https://ci.example.com", "GET", "X-Unknown")
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	request, _ := http.NewRequest("HEAD", server.URL+"/streams/1/2/3", nil)
+	request.Header.Set("Origin", "https://ci.example.com")
+	resp, err := client.Do(request)
+	assert.Nil(t, err)
+	assert.Equal(t, "https://ci.example.com", resp.Header.Get("Access-Control-Allow-Origin"))
+	assert.Contains(t, resp.Header.Get("Access-Control-Expose-Headers"), "Busl-Stream-Length")
+
+	// Browsers get to read why a stream couldn't be created
+	config := *s.Config
+	config.Credentials = "u:pass"
+	authed := httptest.NewServer(NewServer(&config).router())
+	defer authed.Close()
+	request, _ = http.NewRequest("PUT", authed.URL+"/streams/1/2/3", nil)
+	request.Header.Set("Origin", "https://ci.example.com")
+	resp, err = client.Do(request)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Equal(t, "https://ci.example.com", resp.Header.Get("Access-Control-Allow-Origin"))
+
+	assert.Nil(t, s.CORS.Validate())
+	assert.Nil(t, (&CORS{AllowedOrigins: []string{"*"}}).Validate())
+	assert.Equal(t, errCORSCredentials, (&CORS{AllowedOrigins: []string{"*"}, AllowCredentials: true}).Validate())
+}
+
+func startDrainServer(t *testing.T, drainTimeout time.Duration) (*Server, string) {
+	config := *baseServer.Config
+	config.DrainTimeout = drainTimeout
+	s := NewServer(&config)
+	s.Handler = s.router()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	go s.Serve(ln)
+
+	return s, "http://" + ln.Addr().String()
+}
+
+func TestDrainSubscribers(t *testing.T) {
+	s, url := startDrainServer(t, time.Second)
+	uuid, _ := util.NewUUID()
+
+	registrar := broker.NewRedisRegistrar()
+	assert.Nil(t, registrar.Register(uuid))
+	writer, _ := broker.NewWriter(uuid)
+	writer.Write([]byte("hello"))
+
+	req, _ := http.NewRequest("GET", url+"/streams/"+uuid, nil)
+	req.Header.Set("Accept", "text/event-stream")
+	sse, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	defer sse.Body.Close()
+
+	text, err := http.Get(url + "/streams/" + uuid)
+	assert.Nil(t, err)
+	defer text.Body.Close()
+
+	events := bufio.NewReader(sse.Body)
+	for line, _ := events.ReadString('\n'); line != "\n"; line, _ = events.ReadString('\n') {
+	}
+	buf := make([]byte, 5)
+	io.ReadFull(text.Body, buf)
+
+	assert.Nil(t, s.drain())
+
+	rest, _ := ioutil.ReadAll(events)
+	assert.Equal(t, "retry: 1000\nevent: reconnect\nid: 5\ndata: 5\n\n", string(rest))
+	rest, err = ioutil.ReadAll(text.Body)
+	assert.Nil(t, err)
+	assert.Empty(t, rest)
+}
+
+// recordingWriter keeps each write apart
+type recordingWriter struct {
+	writes []string
+}
+
+func (w *recordingWriter) Write(p []byte) (int, error) {
+	w.writes = append(w.writes, string(p))
+	return len(p), nil
+}
+
+func TestEventWriter(t *testing.T) {
+	rd := ioutil.NopCloser(strings.NewReader("hello\nworld, and a longer line\n"))
+	encoder := encoders.NewSSEEncoder(rd, encoders.SSE{Framing: encoders.FrameLine})
+
+	// Reading events a few bytes at a time splits them
+	recorder := &recordingWriter{}
+	w := &eventWriter{Writer: recorder}
+	buf := make([]byte, 3)
+	for {
+		n, err := encoder.Read(buf)
+		w.Write(buf[:n])
+		assert.Contains(t, []string{"", "6", "31"}, w.lastID())
+		if err != nil {
+			break
+		}
+	}
+	w.Write([]byte(":keepalive\n"))
+
+	var out string
+	for _, write := range recorder.writes {
+		assert.True(t, write == ":keepalive\n" || strings.HasSuffix(write, "\n\n"), write)
+		out += write
+	}
+	assert.Equal(t, "31", w.lastID())
+	assert.Contains(t, out, "id: 6\ndata: hello\n\n")
+	assert.Contains(t, out, "id: 31\ndata: world, and a longer line\n\n")
+}
+
+func TestDrainPublishers(t *testing.T) {
+	s, url := startDrainServer(t, time.Second)
+	uuid, _ := util.NewUUID()
+
+	registrar := broker.NewRedisRegistrar()
+	assert.Nil(t, registrar.Register(uuid))
+
+	// Send a first chunk, then keep the request open
+	conn, err := net.Dial("tcp", strings.TrimPrefix(url, "http://"))
+	assert.Nil(t, err)
+	defer conn.Close()
+	fmt.Fprintf(conn, "POST /streams/%s HTTP/1.1\r\nHost: busl\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n", uuid)
+
+	for info, _ := broker.Stat(uuid); info.Length < 5; info, _ = broker.Stat(uuid) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	start := time.Now()
+	s.drain()
+	assert.True(t, time.Since(start) < 2*time.Second)
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, "5", resp.Header.Get("Busl-Stream-Length"))
+	assert.Equal(t, "1", resp.Header.Get("Retry-After"))
+}
+
+func newTestCert(t *testing.T, template *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, []byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	assert.Nil(t, err)
+	cert, _ := x509.ParseCertificate(der)
+
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	return cert, key,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func TestTLS(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "busl-tls")
+	defer os.RemoveAll(dir)
+	file := func(name string, data []byte) string {
+		path := filepath.Join(dir, name)
+		ioutil.WriteFile(path, data, 0600)
+		return path
+	}
+
+	ca, caKey, caPEM, _ := newTestCert(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "busl CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+	serverCert := func(serial int64) (*x509.Certificate, []byte, []byte) {
+		cert, _, certPEM, keyPEM := newTestCert(t, &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: "busl"},
+			IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}, ca, caKey)
+		return cert, certPEM, keyPEM
+	}
+	_, certPEM, keyPEM := serverCert(2)
+	_, _, clientPEM, clientKeyPEM := newTestCert(t, &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "publisher"},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+
+	config := *baseServer.Config
+	config.TLS = TLS{
+		CertFile:     file("cert.pem", certPEM),
+		KeyFile:      file("key.pem", keyPEM),
+		ClientCAFile: file("ca.pem", caPEM),
+	}
+	s := NewServer(&config)
+	certs, err := newCertReloader(config.TLS.CertFile, config.TLS.KeyFile)
+	assert.Nil(t, err)
+	tlsConfig, err := config.TLS.tlsConfig(certs)
+	assert.Nil(t, err)
+
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	go http.Serve(tls.NewListener(ln, tlsConfig), s.router())
+	defer ln.Close()
+	url := "https://" + ln.Addr().String()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	client := func(certs ...tls.Certificate) *http.Client {
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: certs}}}
+	}
+	uuid, _ := util.NewUUID()
+
+	// Subscribers and health checks don't need a client certificate
+	resp, err := client().Get(url + "/health")
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.True(t, resp.TLS.Version >= tls.VersionTLS12)
+
+	// Creating streams does
+	req, _ := http.NewRequest("PUT", url+"/streams/"+uuid, nil)
+	resp, err = client().Do(req)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	clientCert, _ := tls.X509KeyPair(clientPEM, clientKeyPEM)
+	req, _ = http.NewRequest("PUT", url+"/streams/"+uuid, nil)
+	resp, err = client(clientCert).Do(req)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	// Certificates are reloaded without restarting the listener
+	renewed, certPEM, keyPEM := serverCert(4)
+	file("cert.pem", certPEM)
+	file("key.pem", keyPEM)
+	assert.Nil(t, certs.reload())
+
+	resp, err = client().Get(url + "/health")
+	assert.Nil(t, err)
+	assert.Equal(t, renewed.SerialNumber, resp.TLS.PeerCertificates[0].SerialNumber)
+}
+
+func TestTLSConfig(t *testing.T) {
+	config, err := TLS{MinVersion: "1.1", CipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"}}.tlsConfig(&certReloader{})
+	assert.Nil(t, err)
+	assert.Equal(t, uint16(tls.VersionTLS11), config.MinVersion)
+	assert.Equal(t, []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}, config.CipherSuites)
+
+	_, err = TLS{MinVersion: "2.0"}.tlsConfig(&certReloader{})
+	assert.Error(t, err)
+	assert.Error(t, TLS{MinVersion: "2.0"}.Validate())
+	_, supported := tlsVersions["1.3"]
+	assert.Equal(t, supported, TLS{MinVersion: "1.3"}.Validate() == nil)
+	_, err = TLS{CipherSuites: []string{"TLS_NULL"}}.tlsConfig(&certReloader{})
+	assert.Error(t, err)
+}
+
+func TestAdmin(t *testing.T) {
+	basic, _ := NewBasicAuthenticator("admin:secret|user:secret")
+	config := *baseServer.Config
+	config.Authenticator = NewAdminAuthenticator(basic, "admin")
+	s := NewServer(&config)
+	server := httptest.NewUnstartedServer(s.router())
+	server.Config.ConnState = s.ConnState
+	server.Start()
+	defer server.Close()
+
+	uuid, _ := util.NewUUID()
+	registrar := broker.NewRedisRegistrar()
+	assert.Nil(t, registrar.Register(uuid))
+
+	admin := func(method, path string) *http.Response {
+		req, _ := http.NewRequest(method, server.URL+path, nil)
+		req.SetBasicAuth("admin", "secret")
+		resp, err := http.DefaultClient.Do(req)
+		assert.Nil(t, err)
+		return resp
+	}
+
+	// A publisher which sent 5 bytes, and a subscriber which got them
+	pub, err := net.Dial("tcp", strings.TrimPrefix(server.URL, "http://"))
+	assert.Nil(t, err)
+	defer pub.Close()
+	fmt.Fprintf(pub, "POST /streams/%s HTTP/1.1\r\nHost: busl\r\nAuthorization: Basic dXNlcjpzZWNyZXQ=\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n", uuid)
+
+	req, _ := http.NewRequest("GET", server.URL+"/streams/"+uuid, nil)
+	req.SetBasicAuth("user", "secret")
+	sub, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	defer sub.Body.Close()
+	buf := make([]byte, 5)
+	io.ReadFull(sub.Body, buf)
+	assert.Equal(t, "hello", string(buf))
+
+	resp, _ := http.Get(server.URL + "/admin/streams")
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	// Plain users don't get to administer nodes
+	req, _ = http.NewRequest("GET", server.URL+"/admin/streams", nil)
+	req.SetBasicAuth("user", "secret")
+	resp, _ = http.DefaultClient.Do(req)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	var list struct {
+		Streams []struct {
+			Key         string
+			Publishers  []map[string]interface{}
+			Subscribers []map[string]interface{}
+		}
+	}
+	resp = admin("GET", "/admin/streams?key="+uuid)
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	json.NewDecoder(resp.Body).Decode(&list)
+	resp.Body.Close()
+
+	assert.Len(t, list.Streams, 1)
+	stream := list.Streams[0]
+	assert.Equal(t, uuid, stream.Key)
+	assert.Len(t, stream.Publishers, 1)
+	assert.Len(t, stream.Subscribers, 1)
+	assert.Equal(t, float64(5), stream.Publishers[0]["offset"])
+	assert.Equal(t, float64(5), stream.Subscribers[0]["bytes"])
+	assert.NotEmpty(t, stream.Subscribers[0]["remote_addr"])
+
+	// Disconnecting the subscriber ends its response
+	resp = admin("DELETE", "/admin/connections/"+stream.Subscribers[0]["id"].(string))
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	rest, err := ioutil.ReadAll(sub.Body)
+	assert.Nil(t, err)
+	assert.Empty(t, rest)
+
+	resp = admin("DELETE", "/admin/connections/unknown")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	// Closing the stream stops its publisher
+	resp = admin("DELETE", "/admin/streams/"+uuid)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	published, err := http.ReadResponse(bufio.NewReader(pub), nil)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusGone, published.StatusCode)
+
+	// The publish handler returns without waiting for more of the body
+	for start := time.Now(); len(s.connections.list(uuid)) > 0; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatal("publisher still connected")
+		}
+	}
+
+	info, _ := broker.Stat(uuid)
+	assert.True(t, info.Done)
+
+	var status map[string]map[string]interface{}
+	resp = admin("GET", "/admin/status")
+	json.NewDecoder(resp.Body).Decode(&status)
+	resp.Body.Close()
+	assert.NotNil(t, status["redis"]["in_use"])
+	assert.NotNil(t, status["storage"]["uploads_in_flight"])
+}
+
+func TestWebhooks(t *testing.T) {
+	type received struct {
+		event     webhookEvent
+		header    http.Header
+		signature string
+	}
+	events := make(chan received, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		var event webhookEvent
+		json.Unmarshal(body, &event)
+		events <- received{event, r.Header, "sha256=" + signWebhook("secret", body)}
+	}))
+	defer receiver.Close()
+
+	config := *baseServer.Config
+	config.Webhooks = Webhooks{URLs: []string{receiver.URL}, Secret: "secret", Concurrency: 1}
+	s := NewServer(&config)
+	server := httptest.NewServer(s.router())
+	defer server.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	go s.deliverWebhooks(done)
+
+	uuid, _ := util.NewUUID()
+	req, _ := http.NewRequest("PUT", server.URL+"/streams/"+uuid, nil)
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	body, pw := io.Pipe()
+	go func() {
+		pw.Write([]byte("hello"))
+		pw.Close()
+	}()
+	resp, err = http.Post(server.URL+"/streams/"+uuid, "text/plain", body)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	for _, expected := range []string{eventCreated, eventFirstByte, eventClosed} {
+		select {
+		case r := <-events:
+			assert.Equal(t, expected, r.event.Type)
+			assert.Equal(t, uuid, r.event.Key)
+			assert.Equal(t, expected, r.header.Get(headerWebhookEvent))
+			assert.Equal(t, r.event.ID, r.header.Get(headerWebhookDelivery))
+			assert.Equal(t, r.signature, r.header.Get(headerWebhookSignature))
+			if expected == eventClosed {
+				assert.Equal(t, int64(5), *r.event.Length)
+			} else {
+				assert.Nil(t, r.event.Length)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no %s webhook received", expected)
+		}
+	}
+}
+
+func TestWebhookConcurrency(t *testing.T) {
+	// Each delivery waits for the other one to arrive
+	var arrived sync.WaitGroup
+	arrived.Add(2)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		arrived.Done()
+		arrived.Wait()
+	}))
+	defer receiver.Close()
+
+	queue := NewMemoryQueue()
+	config := *baseServer.Config
+	config.Webhooks = Webhooks{URLs: []string{receiver.URL}, Queue: queue, Concurrency: 2}
+	s := NewServer(&config)
+	s.notify(eventCreated, "first", -1)
+	s.notify(eventCreated, "second", -1)
+
+	done := make(chan struct{})
+	delivered := make(chan struct{})
+	go func() {
+		s.deliverWebhooks(done)
+		close(delivered)
+	}()
+
+	both := make(chan struct{})
+	go func() {
+		arrived.Wait()
+		close(both)
+	}()
+	select {
+	case <-both:
+	case <-time.After(webhookTimeout / 2):
+		t.Fatal("deliveries weren't sent at once")
+	}
+	close(done)
+	<-delivered
+}
+
+func TestWebhookRetries(t *testing.T) {
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer receiver.Close()
+
+	queue := NewMemoryQueue()
+	config := *baseServer.Config
+	config.Webhooks = Webhooks{URLs: []string{receiver.URL}, MaxAttempts: 2, Queue: queue}
+	s := NewServer(&config)
+
+	s.notify(eventExpired, "key", -1)
+	item, _ := queue.Pop()
+	s.deliverWebhook(http.DefaultClient, item)
+
+	// Retried later with a backoff
+	assert.Equal(t, 1, len(queue.items))
+	assert.True(t, queue.items[0].at.After(time.Now().Add(time.Second)))
+	var delivery webhookDelivery
+	json.Unmarshal(queue.items[0].item, &delivery)
+	assert.Equal(t, 1, delivery.Attempt)
+	assert.Equal(t, eventExpired, delivery.Event.Type)
+
+	// Dropped after the last attempt
+	retry := queue.items[0].item
+	queue.items = nil
+	s.deliverWebhook(http.DefaultClient, retry)
+	assert.Equal(t, 0, len(queue.items))
+
+	assert.Equal(t, 2*time.Second, webhookBackoff(1))
+	assert.Equal(t, webhookMaxBackoff, webhookBackoff(40))
+}
+
+func TestPoll(t *testing.T) {
+	server := httptest.NewServer(baseServer.router())
+	defer server.Close()
+
+	uuid, _ := util.NewUUID()
+	registrar := broker.NewRedisRegistrar()
+	assert.Nil(t, registrar.Register(uuid))
+	writer, _ := broker.NewWriter(uuid)
+	writer.Write([]byte("hello"))
+
+	poll := func(query string) (*pollResponse, int) {
+		resp, err := http.Get(server.URL + "/streams/" + uuid + "?poll=true&" + query)
+		assert.Nil(t, err)
+		defer resp.Body.Close()
+		var poll pollResponse
+		json.NewDecoder(resp.Body).Decode(&poll)
+		return &poll, resp.StatusCode
+	}
+
+	resp, _ := poll("")
+	assert.Equal(t, &pollResponse{Data: "hello", Offset: 5}, resp)
+
+	resp, _ = poll("offset=2")
+	assert.Equal(t, &pollResponse{Data: "llo", Offset: 5}, resp)
+
+	start := time.Now()
+	resp, _ = poll("offset=5&wait=100ms")
+	assert.Equal(t, &pollResponse{Offset: 5}, resp)
+	assert.True(t, time.Since(start) >= 100*time.Millisecond)
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		writer.Write([]byte(" world"))
+		writer.Close()
+	}()
+	resp, _ = poll("offset=5&wait=5s")
+	assert.Equal(t, " world", resp.Data)
+	assert.Equal(t, int64(11), resp.Offset)
+
+	resp, _ = poll("offset=11")
+	assert.Equal(t, &pollResponse{Offset: 11, Done: true}, resp)
+
+	_, status := poll("wait=forever")
+	assert.Equal(t, http.StatusBadRequest, status)
+}
+
+func TestPollEncoding(t *testing.T) {
+	server := httptest.NewServer(baseServer.router())
+	defer server.Close()
+
+	uuid, _ := util.NewUUID()
+	registrar := broker.NewRedisRegistrar()
+	assert.Nil(t, registrar.Register(uuid))
+	writer, _ := broker.NewWriter(uuid)
+	writer.Write(append(bytes.Repeat([]byte("a"), maxPollBytes-1), "é\xff\x00"...))
+	writer.Close()
+
+	poll := func(query string) *pollResponse {
+		resp, err := http.Get(server.URL + "/streams/" + uuid + "?poll=true&" + query)
+		assert.Nil(t, err)
+		defer resp.Body.Close()
+		var poll pollResponse
+		json.NewDecoder(resp.Body).Decode(&poll)
+		return &poll
+	}
+
+	// Characters aren't cut in the middle
+	resp := poll("")
+	assert.Equal(t, maxPollBytes-1, len(resp.Data))
+	assert.Equal(t, int64(maxPollBytes-1), resp.Offset)
+
+	resp = poll("offset=" + strconv.FormatInt(resp.Offset, 10))
+	assert.Equal(t, &pollResponse{Data: base64.StdEncoding.EncodeToString([]byte("é\xff\x00")), Encoding: "base64", Offset: maxPollBytes + 3, Done: true}, resp)
+
+	resp = poll("offset=" + strconv.Itoa(maxPollBytes-1) + "&wait=0s")
+	data, _ := base64.StdEncoding.DecodeString(resp.Data)
+	assert.Equal(t, "é\xff\x00", string(data))
+}
+
+func TestPollStored(t *testing.T) {
+	uuid, _ := util.NewUUID()
+
+	// Presigned GET URLs don't allow HEAD requests
+	storage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if r.Header.Get("Range") != "" {
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		w.Write([]byte("hello"))
+	}))
+	defer storage.Close()
+
+	baseServer.StorageBaseURL = func(*http.Request) string { return storage.URL }
+	defer func() {
+		baseServer.StorageBaseURL = func(*http.Request) string { return "" }
+	}()
+
+	server := httptest.NewServer(baseServer.router())
+	defer server.Close()
+
+	poll := func(query string) *pollResponse {
+		resp, err := http.Get(server.URL + "/streams/" + uuid + "?poll=true&" + query)
+		assert.Nil(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		var poll pollResponse
+		json.NewDecoder(resp.Body).Decode(&poll)
+		return &poll
+	}
+
+	resp := poll("")
+	assert.Equal(t, "hello", resp.Data)
+	assert.Equal(t, int64(5), resp.Offset)
+
+	assert.Equal(t, &pollResponse{Offset: 5, Done: true}, poll("offset=5"))
+}
+
+func TestSubscribeGrep(t *testing.T) {
+	server := httptest.NewServer(baseServer.router())
+	defer server.Close()
+
+	uuid, _ := util.NewUUID()
+	registrar := broker.NewRedisRegistrar()
+	assert.Nil(t, registrar.Register(uuid))
+	writer, _ := broker.NewWriter(uuid)
+	writer.Write([]byte("ok\nerror 1\nok\nerror 2\nok\n"))
+	writer.Close()
+
+	get := func(query, accept string) (int, string) {
+		req, _ := http.NewRequest("GET", server.URL+"/streams/"+uuid+"?"+query, nil)
+		req.Header.Set("Accept", accept)
+		resp, err := http.DefaultClient.Do(req)
+		assert.Nil(t, err)
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	_, body := get("grep=error", "")
+	assert.Equal(t, "error 1\nerror 2\n", body)
+
+	_, body = get("grep=error&invert=true", "")
+	assert.Equal(t, "ok\nok\nok\n", body)
+
+	_, body = get("grep=2&context=1", "")
+	assert.Equal(t, "ok\nerror 2\nok\n", body)
+
+	// Ids are offsets in the whole stream, to resume from
+	_, body = get("grep=error+2", "text/event-stream")
+	assert.Equal(t, "id: 25\ndata: error 2\ndata: \n\n", body)
+
+	status, _ := get("grep=(", "")
+	assert.Equal(t, http.StatusBadRequest, status)
+}
+
+func TestSubscribeNDJSON(t *testing.T) {
+	server := httptest.NewServer(baseServer.router())
+	defer server.Close()
+
+	uuid, _ := util.NewUUID()
+	registrar := broker.NewRedisRegistrar()
+	assert.Nil(t, registrar.Register(uuid))
+	writer, _ := broker.NewWriter(uuid)
+	writer.Write([]byte("hello\nworld\n"))
+	writer.Close()
+
+	req, _ := http.NewRequest("GET", server.URL+"/streams/"+uuid, nil)
+	req.Header.Set("Accept", "application/x-ndjson")
+	req.Header.Set("Range", "bytes=6-")
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "application/x-ndjson", resp.Header.Get("Content-Type"))
+
+	var line map[string]interface{}
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&line))
+	assert.Equal(t, float64(6), line["offset"])
+	assert.Equal(t, float64(2), line["line"])
+	assert.Equal(t, "world", line["text"])
+	assert.Equal(t, uuid, line["channel"])
+	assert.NotNil(t, line["time"])
+}
+
+func TestReplay(t *testing.T) {
+	server := httptest.NewServer(baseServer.router())
+	defer server.Close()
+
+	uuid, _ := util.NewUUID()
+	registrar := broker.NewRedisRegistrar()
+	assert.Nil(t, registrar.Register(uuid))
+	writer, _ := broker.NewWriter(uuid)
+	writer.Write([]byte("hello"))
+	time.Sleep(400 * time.Millisecond)
+	writer.Write([]byte(" world"))
+	writer.Close()
+
+	// Paced 4 times faster than published
+	start := time.Now()
+	resp, err := http.Get(server.URL + "/streams/" + uuid + "?replay=realtime&speed=4x")
+	assert.Nil(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "hello world", string(body))
+	elapsed := time.Since(start)
+	assert.True(t, elapsed >= 90*time.Millisecond && elapsed < 400*time.Millisecond, elapsed.String())
+
+	resp, err = http.Get(server.URL + "/streams/" + uuid + "?replay=realtime&speed=0")
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	// Timing indexes are archived where no stream can be
+	assert.Equal(t, "timing//1/2/3", timingURI("1/2/3"))
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	for _, method := range []string{"POST", "PUT"} {
+		req, _ := http.NewRequest(method, server.URL+"/streams/"+timingURI(uuid), nil)
+		resp, err = client.Do(req)
+		assert.Nil(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusMovedPermanently, resp.StatusCode, method)
+	}
+}
+
+func TestAsciicast(t *testing.T) {
+	server := httptest.NewServer(baseServer.router())
+	defer server.Close()
+
+	uuid, _ := util.NewUUID()
+	registrar := broker.NewRedisRegistrar()
+	assert.Nil(t, registrar.Register(uuid))
+	writer, _ := broker.NewWriter(uuid)
+	writer.Write([]byte("hello "))
+	time.Sleep(100 * time.Millisecond)
+	writer.Write([]byte("world"))
+	writer.Close()
+
+	resp, err := http.Get(server.URL + "/streams/" + uuid + "?format=cast&download=1&cols=100")
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "application/x-asciicast", resp.Header.Get("Content-Type"))
+	assert.Equal(t, `attachment; filename="`+uuid+`.cast"`, resp.Header.Get("Content-Disposition"))
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	lines := strings.Split(strings.TrimSpace(string(body)), "\n")
+	assert.Equal(t, 3, len(lines))
+	assert.Contains(t, lines[0], `"version":2,"width":100,"height":24`)
+	assert.Equal(t, `[0.000000, "o", "hello "]`, lines[1])
+
+	var event []interface{}
+	assert.Nil(t, json.Unmarshal([]byte(lines[2]), &event))
+	assert.True(t, event[0].(float64) >= 0.09, lines[2])
+	assert.Equal(t, "world", event[2])
+
+	// Keys ending with .cast are streams like any other
+	assert.Nil(t, registrar.Register(uuid+".cast"))
+	writer, _ = broker.NewWriter(uuid + ".cast")
+	writer.Write([]byte("raw"))
+	writer.Close()
+	raw, err := http.Get(server.URL + "/streams/" + uuid + ".cast")
+	assert.Nil(t, err)
+	body, _ = ioutil.ReadAll(raw.Body)
+	raw.Body.Close()
+	assert.Equal(t, "raw", string(body))
+	assert.Empty(t, raw.Header.Get("Content-Disposition"))
+}
+
+func TestSubscribeHTML(t *testing.T) {
+	server := httptest.NewServer(baseServer.router())
+	defer server.Close()
+
+	uuid, _ := util.NewUUID()
+	registrar := broker.NewRedisRegistrar()
+	assert.Nil(t, registrar.Register(uuid))
+	writer, _ := broker.NewWriter(uuid)
+	writer.Write([]byte("\x1b[3"))
+	writer.Write([]byte("2mok\x1b[0m <done>"))
+	writer.Close()
+
+	// As browsers ask for it
+	for _, query := range []string{"", "?format=html"} {
+		req, _ := http.NewRequest("GET", server.URL+"/streams/"+uuid+query, nil)
+		if query == "" {
+			req.Header.Set("Accept", "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		assert.Nil(t, err)
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		assert.Equal(t, "text/html; charset=utf-8", resp.Header.Get("Content-Type"))
+		assert.Contains(t, string(body), `<pre class="ansi"><span class="ansi-fg-2">ok</span> &lt;done&gt;</pre>`)
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	for accept, expected := range map[string]string{
+		"":                                      "",
+		"*/*":                                   "",
+		"text/plain, */*;q=0.5":                 "",
+		"text/event-stream":                     "text/event-stream",
+		"Text/Event-Stream; charset=utf-8":      "text/event-stream",
+		"application/x-ndjson;q=0.5, text/html": "text/html",
+		"text/html;q=0, application/x-ndjson":   "application/x-ndjson",
+		"text/html, application/x-asciicast":    "text/html",
+		"text/html;q=oops":                      "",
+	} {
+		assert.Equal(t, expected, negotiate(accept, subscribeFormats), accept)
+	}
+}
+
+func TestViewer(t *testing.T) {
+	server := httptest.NewServer(baseServer.router())
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/view/1/2/<3>")
+	assert.Nil(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/html; charset=utf-8", resp.Header.Get("Content-Type"))
+	assert.Contains(t, string(body), "<title>1/2/&lt;3&gt;</title>")
+	assert.Contains(t, string(body), `var key = "1/2/\u003c3\u003e";`)
+	assert.Contains(t, string(body), ".ansi-fg-1{color:#cd3131}")
+
+	// The page is only served to those who may read the stream
+	baseServer.TokenSecret = "secret"
+	baseServer.RequireReadToken = true
+	defer func() {
+		baseServer.TokenSecret = ""
+		baseServer.RequireReadToken = false
+	}()
+	server = httptest.NewServer(baseServer.router())
+	defer server.Close()
+
+	resp, err = http.Get(server.URL + "/view/1/2/3")
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestLastLines(t *testing.T) {
+	for _, c := range []struct {
+		source string
+		n      int
+		offset int64
+	}{
+		{"a\nb\nc\n", 1, 4},
+		{"a\nb\nc\n", 2, 2},
+		{"a\nb\nc", 1, 4},
+		{"a\nb\nc\n", 3, 0},
+		{"a\nb\nc\n", 10, 0},
+		{"a\nb\nc\n", 0, 6},
+		{"", 1, 0},
+	} {
+		o, err := lastLines(strings.NewReader(c.source), int64(len(c.source)), c.n)
+		assert.Nil(t, err)
+		assert.Equal(t, c.offset, o, "%q %d", c.source, c.n)
+	}
+
+	// Lines spanning chunks
+	long := strings.Repeat("x", tailChunkSize) + "\n" + strings.Repeat("y", tailChunkSize*2) + "\nz\n"
+	o, err := lastLines(strings.NewReader(long), int64(len(long)), 2)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(tailChunkSize+1), o)
+
+	// Streams held by the broker are read a chunk at a time too
+	uuid, _ := util.NewUUID()
+	assert.Nil(t, broker.NewRedisRegistrar().Register(uuid))
+	writer, _ := broker.NewWriter(uuid)
+	writer.Write([]byte(long))
+	o, err = lastLines(streamReaderAt(uuid), int64(len(long)), 2)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(tailChunkSize+1), o)
+}
+
+func TestSubscribeTail(t *testing.T) {
+	server := httptest.NewServer(baseServer.router())
+	defer server.Close()
+
+	uuid, _ := util.NewUUID()
+	registrar := broker.NewRedisRegistrar()
+	assert.Nil(t, registrar.Register(uuid))
+	writer, _ := broker.NewWriter(uuid)
+	writer.Write([]byte("one\ntwo\nthree\n"))
+	writer.Close()
+
+	req, _ := http.NewRequest("GET", server.URL+"/streams/"+uuid+"?tail=2", nil)
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "id: 14\ndata: two\ndata: three\ndata: \n\n", string(body))
+
+	// Reconnections resume from the last event instead
+	req.Header.Set("Last-Event-ID", "8")
+	resp, err = http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "id: 14\ndata: three\ndata: \n\n", string(body))
+
+	resp, err = http.Get(server.URL + "/streams/" + uuid + "?tail=-1")
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	// Stored streams are read backwards with range requests
+	stored := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Presigned URLs only allow GET requests
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader("old\nstored\nlines\n"))
+	}))
+	defer stored.Close()
+	baseServer.StorageBaseURL = func(*http.Request) string { return stored.URL }
+	defer func() {
+		baseServer.StorageBaseURL = func(*http.Request) string { return "" }
+	}()
+
+	resp, err = http.Get(server.URL + "/streams/gone?tail=1")
+	assert.Nil(t, err)
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "lines\n", string(body))
+}
+
+func TestSubscribeMulti(t *testing.T) {
+	server := httptest.NewServer(baseServer.router())
+	defer server.Close()
+
+	prefix, _ := util.NewUUID()
+	registrar := broker.NewRedisRegistrar()
+	for _, key := range []string{"a", "b"} {
+		assert.Nil(t, registrar.Register(prefix+"/"+key))
+		writer, _ := broker.NewWriter(prefix + "/" + key)
+		writer.Write([]byte(key + "1\n"))
+		writer.Close()
+	}
+
+	// Events are keyed by stream, ids holding every offset
+	events := func(req *http.Request) (map[string]string, string) {
+		resp, err := http.DefaultClient.Do(req)
+		assert.Nil(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+		data := map[string]string{}
+		var lastID string
+		scanner := bufio.NewScanner(resp.Body)
+		var event string
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case strings.HasPrefix(line, "event: "):
+				event = line[7:]
+			case strings.HasPrefix(line, "id: "):
+				lastID = line[4:]
+			case strings.HasPrefix(line, "data: "):
+				data[event] += line[6:] + "\n"
+			}
+		}
+		return data, lastID
+	}
+
+	req, _ := http.NewRequest("GET", server.URL+"/multi?key="+prefix+"/a&key="+prefix+"/b", nil)
+	data, lastID := events(req)
+	assert.Equal(t, "a1\n\n", data[prefix+"/a"])
+	assert.Equal(t, "b1\n\n", data[prefix+"/b"])
+	assert.Contains(t, data["done"], prefix+"/a\n")
+	assert.Contains(t, data["done"], prefix+"/b\n")
+	offsets, err := parseMultiID(lastID)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]int64{prefix + "/a": 3, prefix + "/b": 3}, offsets)
+
+	// Streams are resumed from the id
+	req, _ = http.NewRequest("GET", server.URL+"/multi?prefix="+prefix+"/", nil)
+	req.Header.Set("Last-Event-ID", url.Values{prefix + "/a": {"3"}, prefix + "/b": {"1"}}.Encode())
+	data, _ = events(req)
+	assert.Equal(t, "", data[prefix+"/a"])
+	assert.Equal(t, "1\n\n", data[prefix+"/b"])
+	assert.Equal(t, prefix+"/b\n", data["done"])
+
+	req.Header.Set("Last-Event-ID", lastID)
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	// done names the events of streams ending
+	for _, query := range []string{"", "?key=done"} {
+		resp, err = http.Get(server.URL + "/multi" + query)
+		assert.Nil(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, query)
+	}
+}
+
+func TestMultiReaderIDs(t *testing.T) {
+	readers := map[string]io.ReadCloser{"a": ioutil.NopCloser(strings.NewReader("hello"))}
+	multi := newMultiReader(readers, map[string]int64{"a": 2})
+	defer multi.Close()
+	assert.Equal(t, "a=2", multi.lastID())
+
+	// Ids only move once whole events are written, however split
+	recorder := &recordingWriter{}
+	w := &eventWriter{Writer: recorder, sent: multi.sent}
+	buf := make([]byte, 3)
+	for {
+		n, err := multi.Read(buf)
+		w.Write(buf[:n])
+		if !strings.Contains(strings.Join(recorder.writes, ""), "data: hello") {
+			assert.Equal(t, "a=2", multi.lastID())
+			assert.Equal(t, int64(2), multi.offset("a", 0))
+		}
+		if err != nil {
+			break
+		}
+	}
+	assert.Equal(t, "a=7", multi.lastID())
+	assert.Equal(t, int64(7), multi.offset("a", 0))
+	assert.Equal(t, "event: a\nid: a=7\ndata: hello\n\nevent: done\nid: a=7\ndata: a\n\n", strings.Join(recorder.writes, ""))
+}
+
+func TestSubscribeSSEFraming(t *testing.T) {
+	server := httptest.NewServer(baseServer.router())
+	defer server.Close()
+
+	uuid, _ := util.NewUUID()
+	registrar := broker.NewRedisRegistrar()
+	assert.Nil(t, registrar.Register(uuid))
+	writer, _ := broker.NewWriter(uuid)
+	writer.Write([]byte("one\ntw"))
+	writer.Write([]byte("o\n"))
+	writer.Close()
+
+	req, _ := http.NewRequest("GET", server.URL+"/streams/"+uuid+"?framing=line&event=log&retry=5s", nil)
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "retry: 5000\n\nevent: log\nid: 4\ndata: one\n\nevent: log\nid: 8\ndata: two\n\n", string(body))
+
+	for _, query := range []string{"framing=words", "hold=1m", "retry=-1s", "event=a%0Ab"} {
+		req, _ := http.NewRequest("GET", server.URL+"/streams/"+uuid+"?"+query, nil)
+		req.Header.Set("Accept", "text/event-stream")
+		resp, err := http.DefaultClient.Do(req)
+		assert.Nil(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, query)
+	}
+}
+
+func TestSubscribeSSEBase64(t *testing.T) {
+	server := httptest.NewServer(baseServer.router())
+	defer server.Close()
+
+	uuid, _ := util.NewUUID()
+	registrar := broker.NewRedisRegistrar()
+	assert.Nil(t, registrar.Register(uuid))
+	writer, _ := broker.NewWriter(uuid)
+	binary := []byte("\x1b[1m\r\x00\xfe\xff\n\r")
+	writer.Write(binary)
+	writer.Close()
+
+	req, _ := http.NewRequest("GET", server.URL+"/streams/"+uuid+"?encoding=base64", nil)
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+
+	var received []byte
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		if line := scanner.Text(); strings.HasPrefix(line, "data: ") {
+			data, err := base64.StdEncoding.DecodeString(line[6:])
+			assert.Nil(t, err)
+			received = append(received, data...)
+		}
+	}
+	assert.Equal(t, binary, received)
+}
+
+func TestKeepAliveReaderWithoutPacket(t *testing.T) {
+	pr, pw := io.Pipe()
+	rd := newKeepAliveReader(pr, nil, 10*time.Millisecond, nil, nil, nil)
+	defer rd.Close()
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		pw.Write([]byte("hello"))
+	}()
+
+	// Reads wait for the stream instead of returning empty heartbeats
+	buf := make([]byte, 32)
+	n, err := rd.Read(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(buf[:n]))
+}
+
+func TestSubscribeKeepAlive(t *testing.T) {
+	baseServer.MaxHeartbeatDuration = time.Minute
+	defer func() {
+		baseServer.MaxHeartbeatDuration = 0
+	}()
+
+	server := httptest.NewServer(baseServer.router())
+	defer server.Close()
+
+	for _, test := range []struct {
+		query string
+		check func(body string)
+	}{
+		{"?heartbeat=50ms&keepalive=newline", func(body string) {
+			assert.True(t, strings.HasPrefix(body, "hello\n"))
+			assert.True(t, strings.HasSuffix(body, "\n world"))
+			assert.Equal(t, "hello world", strings.Replace(body, "\n", "", -1))
+		}},
+		{"?heartbeat=50ms&keepalive=none", func(body string) {
+			assert.Equal(t, "hello world", body)
+		}},
+		{"?heartbeat=50ms", func(body string) {
+			assert.Contains(t, body, "\x00")
+			assert.Equal(t, "hello world", strings.Replace(body, "\x00", "", -1))
+		}},
+	} {
+		uuid, _ := util.NewUUID()
+		assert.Nil(t, broker.NewRedisRegistrar().Register(uuid))
+		writer, _ := broker.NewWriter(uuid)
+		writer.Write([]byte("hello"))
+
+		go func() {
+			time.Sleep(300 * time.Millisecond)
+			writer.Write([]byte(" world"))
+			writer.Close()
+		}()
+
+		resp, err := http.Get(server.URL + "/streams/" + uuid + test.query)
+		assert.Nil(t, err)
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		test.check(string(body))
+	}
+
+	uuid, _ := util.NewUUID()
+	assert.Nil(t, broker.NewRedisRegistrar().Register(uuid))
+	for _, query := range []string{"?heartbeat=nope", "?heartbeat=2m", "?keepalive=comment", "?keepalive=ping", "?keepalive=tab"} {
+		resp, err := http.Get(server.URL + "/streams/" + uuid + query)
+		assert.Nil(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, query)
+	}
+	resp, err := http.Get(server.URL + "/multi?key=" + uuid + "&keepalive=ping")
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	// Nor can HTTP/2 requests get pings
+	req := httptest.NewRequest("GET", "/streams/"+uuid+"?keepalive=ping", nil)
+	req.ProtoMajor = 2
+	_, _, err = baseServer.keepAlive(req, nil, nil)
+	assert.Equal(t, errInvalidKeepAlive, err)
+}
@@ -0,0 +1,219 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultDrainTimeout = 30 * time.Second
+
+	// How long SSE clients are asked to wait before reconnecting
+	// to another instance.
+	drainRetry = time.Second
+)
+
+var errDraining = errors.New("server is shutting down")
+
+// reconnect tells an SSE subscriber to come back from where it stopped
+func reconnect(w http.ResponseWriter, id string) {
+	fmt.Fprintf(w, "retry: %d\nevent: reconnect\nid: %s\ndata: %s\n\n", drainRetry/time.Millisecond, id, id)
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// resumeLater tells a publisher still sending its body to resume from
+// length on another instance.
+func resumeLater(w http.ResponseWriter, length int64) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(drainRetry/time.Second)))
+	w.Header().Set(headerStreamLength, strconv.FormatInt(length, 10))
+	abortPublish(w, http.StatusServiceUnavailable, "Server is shutting down, resume publishing.")
+}
+
+// abortPublish answers a publisher still sending its body. The response
+// is flushed right away, and the connection closed, as the rest of the
+// body is never going to be read.
+func abortPublish(w http.ResponseWriter, status int, msg string) {
+	msg += "\n"
+	w.Header().Set("Connection", "close")
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(len(msg)))
+	w.WriteHeader(status)
+	io.WriteString(w, msg)
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// netConns remembers the network connections of the server by remote
+// address, so reads of a request body can be interrupted.
+type netConns struct {
+	mu     sync.Mutex
+	byAddr map[string]net.Conn
+}
+
+func (c *netConns) track(conn net.Conn, state http.ConnState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch state {
+	case http.StateNew:
+		if c.byAddr == nil {
+			c.byAddr = make(map[string]net.Conn)
+		}
+		c.byAddr[conn.RemoteAddr().String()] = conn
+	case http.StateHijacked, http.StateClosed:
+		delete(c.byAddr, conn.RemoteAddr().String())
+	}
+}
+
+// interruptBody unblocks a read of the body of r still in progress. The
+// body of an HTTP/1 request can't be closed while it is being read, so
+// the read deadline of its connection is moved instead.
+func (s *Server) interruptBody(r *http.Request) {
+	if r.ProtoMajor < 2 {
+		s.netConns.mu.Lock()
+		conn, ok := s.netConns.byAddr[r.RemoteAddr]
+		s.netConns.mu.Unlock()
+		if ok {
+			conn.SetReadDeadline(time.Now())
+			return
+		}
+	}
+	r.Body.Close()
+}
+
+// eventWriter only writes whole SSE events and comments through, holding
+// the start of an event back until it is complete, for subscribers to
+// be told to reconnect in between events. It remembers the id of the
+// last event written.
+type eventWriter struct {
+	io.Writer
+	pending []byte           // start of an event, yet to be written
+	sent    func(events int) // when set, told how many events got written
+
+	mu      sync.Mutex
+	id      string
+	written int64
+}
+
+func (w *eventWriter) Write(p []byte) (int, error) {
+	w.pending = append(w.pending, p...)
+	end, id, events := wholeEvents(w.pending)
+	if end == 0 {
+		return len(p), nil
+	}
+
+	n, err := w.Writer.Write(w.pending[:end])
+	w.mu.Lock()
+	w.written += int64(n)
+	if id != "" && n == end {
+		w.id = id
+	}
+	w.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	if w.sent != nil && events > 0 {
+		w.sent(events)
+	}
+
+	w.pending = append([]byte(nil), w.pending[end:]...)
+	return len(p), nil
+}
+
+func (w *eventWriter) lastID() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.id
+}
+
+// bytesWritten returns how much of whole events was written
+func (w *eventWriter) bytesWritten() int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.written
+}
+
+// wholeEvents returns the length of the whole events and comments buf
+// starts with, along with the last id they hold and how many events
+// there are.
+func wholeEvents(buf []byte) (end int, id string, events int) {
+	var start int      // of the current line
+	var fields bool    // whether the current event has any yet
+	var eventID []byte // of the current event
+	for {
+		i := bytes.IndexByte(buf[start:], '\n')
+		if i < 0 {
+			return end, id, events
+		}
+		line := buf[start : start+i]
+		start += i + 1
+
+		switch {
+		case len(line) == 0:
+			// A blank line ends events
+			if eventID != nil {
+				id = string(eventID)
+			}
+			if fields {
+				events++
+			}
+			end, fields, eventID = start, false, nil
+		case line[0] == ':' && !fields:
+			// Comments between events, such as keepalives
+			end = start
+		default:
+			fields = true
+			if bytes.HasPrefix(line, []byte("id: ")) {
+				eventID = line[4:]
+			}
+		}
+	}
+}
+
+// resumableWriter counts what is written to the broker and refuses
+// further writes once stopped, so publishers can be told where to
+// resume from.
+type resumableWriter struct {
+	io.Writer
+	mu      sync.Mutex
+	written int64
+	stopped bool
+}
+
+func (w *resumableWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.stopped {
+		return 0, errDraining
+	}
+	n, err := w.Writer.Write(p)
+	w.written += int64(n)
+	return n, err
+}
+
+// stop waits for the current write to finish and returns the number of
+// bytes written.
+func (w *resumableWriter) stop() int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.stopped = true
+	return w.written
+}
+
+func (w *resumableWriter) bytesWritten() int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.written
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	"github.com/heroku/busl/broker"
+	"github.com/heroku/busl/storage"
+)
+
+var errInvalidTail = errors.New("Invalid tail line count")
+
+// Streams are read backwards this much at a time to find their tail
+const tailChunkSize = 64 * 1024
+
+// Returns the number of lines given through the `tail` query parameter,
+// or -1 without one.
+func tailLines(r *http.Request) (int, error) {
+	v := r.URL.Query().Get("tail")
+	if v == "" {
+		return -1, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, errInvalidTail
+	}
+	return n, nil
+}
+
+// Returns where subscribers start reading: after the last event they
+// got when reconnecting, else at the requested tail or offset.
+func (s *Server) startOffset(ctx context.Context, r *http.Request) (int64, error) {
+	o, err := offset(r)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := tailLines(r)
+	if err != nil || n < 0 || r.Header.Get("Last-Event-ID") != "" {
+		return o, err
+	}
+	return s.tailOffset(ctx, r, n)
+}
+
+// Returns the offset of the nth line from the end of the stream, as
+// published so far in the broker or once stored.
+func (s *Server) tailOffset(ctx context.Context, r *http.Request, n int) (int64, error) {
+	if info, err := broker.Stat(key(r)); err == nil {
+		return lastLines(streamReaderAt(key(r)), info.Length, n)
+	}
+
+	// Storage URLs may be presigned for GET requests only, which tell
+	// the length of the stream as well.
+	rd, err := storage.GetContext(ctx, requestURI(r), s.StorageBaseURL(r), 0)
+	if err != nil {
+		if rd != nil {
+			rd.Close()
+		}
+		return 0, err
+	}
+	defer rd.Close()
+
+	length := storage.Length(rd)
+	if length < 0 {
+		buf, err := ioutil.ReadAll(rd)
+		if err != nil {
+			return 0, err
+		}
+		return lastLines(bytes.NewReader(buf), int64(len(buf)), n)
+	}
+	return lastLines(&blobReaderAt{ctx, requestURI(r), s.StorageBaseURL(r)}, length, n)
+}
+
+// streamReaderAt reads parts of a stream held by the broker
+type streamReaderAt string
+
+func (key streamReaderAt) ReadAt(p []byte, o int64) (int, error) {
+	buf, err := broker.GetRange(string(key), o, int64(len(p)))
+	n := copy(p, buf)
+	if err == nil && n < len(p) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// blobReaderAt reads parts of a stored stream with range requests
+type blobReaderAt struct {
+	ctx         context.Context
+	requestURI  string
+	storageBase string
+}
+
+func (b *blobReaderAt) ReadAt(p []byte, o int64) (int, error) {
+	rd, err := storage.GetContext(b.ctx, b.requestURI, b.storageBase, o)
+	if err != nil {
+		return 0, err
+	}
+	defer rd.Close()
+	return io.ReadFull(rd, p)
+}
+
+// lastLines returns the offset at which the last n lines of a source of
+// the given length start, reading it backwards from the end. A trailing
+// line without a newline counts as a line.
+func lastLines(rd io.ReaderAt, length int64, n int) (int64, error) {
+	if n == 0 {
+		return length, nil
+	}
+
+	buf := make([]byte, tailChunkSize)
+	end := length
+	for end > 0 {
+		start := end - int64(len(buf))
+		if start < 0 {
+			start = 0
+		}
+		chunk := buf[:end-start]
+		if _, err := rd.ReadAt(chunk, start); err != nil && err != io.EOF {
+			return 0, err
+		}
+
+		for i := len(chunk) - 1; i >= 0; i-- {
+			// The newline ending the stream doesn't start a line
+			if chunk[i] != '\n' || start+int64(i) == length-1 {
+				continue
+			}
+			if n--; n == 0 {
+				return start + int64(i) + 1, nil
+			}
+		}
+		end = start
+	}
+	return 0, nil
+}
@@ -0,0 +1,233 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/heroku/busl/util"
+)
+
+var errClientCert = errors.New("A client certificate is required")
+
+// TLS configures serving HTTPS natively instead of behind a router
+type TLS struct {
+	CertFile string
+	KeyFile  string
+
+	MinVersion   string   // 1.0, 1.1, 1.2 (default) or 1.3 with Go 1.12+
+	CipherSuites []string // Go's defaults when empty
+
+	// Client certificates signed by these CAs are required to publish,
+	// create and administer streams. Subscribers don't need any.
+	ClientCAFile string
+
+	// How often certificate files are checked for changes, every
+	// minute when zero.
+	ReloadInterval time.Duration
+}
+
+// Enabled tells whether busl terminates TLS itself
+func (t TLS) Enabled() bool {
+	return t.CertFile != "" && t.KeyFile != ""
+}
+
+// The versions this build can serve, see tls13.go
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+}
+
+var cipherSuites = map[string]uint16{
+	"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256": tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256":   tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384": tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384":   tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305":  tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+	"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305":    tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA":    tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA":      tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA":    tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA":      tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_RSA_WITH_AES_128_GCM_SHA256":         tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_RSA_WITH_AES_256_GCM_SHA384":         tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+}
+
+// Validate refuses a minimum TLS version this build can't serve, so that
+// busl doesn't start serving without the TLS policy it was given.
+func (t TLS) Validate() error {
+	if _, ok := tlsVersions[t.MinVersion]; ok || t.MinVersion == "" {
+		return nil
+	}
+	if t.MinVersion == "1.3" {
+		return errors.New("TLS 1.3 requires busl to be built with Go 1.12 or later")
+	}
+	return fmt.Errorf("unknown TLS version %q", t.MinVersion)
+}
+
+// tlsConfig builds the TLS configuration served, certificates being
+// loaded through the reloader.
+func (t TLS) tlsConfig(certs *certReloader) (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion:               tls.VersionTLS12,
+		PreferServerCipherSuites: true,
+		GetCertificate:           certs.getCertificate,
+	}
+
+	if err := t.Validate(); err != nil {
+		return nil, err
+	}
+	if t.MinVersion != "" {
+		config.MinVersion = tlsVersions[t.MinVersion]
+	}
+
+	for _, name := range t.CipherSuites {
+		suite, ok := cipherSuites[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite %q", name)
+		}
+		config.CipherSuites = append(config.CipherSuites, suite)
+	}
+
+	if t.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(t.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", t.ClientCAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return config, nil
+}
+
+// certReloader serves the latest certificate loaded from its files.
+// Connections already established keep theirs.
+type certReloader struct {
+	certFile, keyFile string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	return r, r.reload()
+}
+
+func (r *certReloader) reload() error {
+	modTime := r.filesModTime()
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cert = &cert
+	r.modTime = modTime
+	return nil
+}
+
+// filesModTime returns the last time either file changed
+func (r *certReloader) filesModTime() (t time.Time) {
+	for _, name := range []string{r.certFile, r.keyFile} {
+		if info, err := os.Stat(name); err == nil && info.ModTime().After(t) {
+			t = info.ModTime()
+		}
+	}
+	return t
+}
+
+// changed tells whether the files were modified since the last reload
+func (r *certReloader) changed() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.filesModTime().After(r.modTime)
+}
+
+// watch reloads the certificate whenever asked to, or when its files
+// change.
+func (r *certReloader) watch(interval time.Duration, reload <-chan struct{}, done <-chan struct{}) {
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-reload:
+		case <-ticker.C:
+			if !r.changed() {
+				continue
+			}
+		case <-done:
+			return
+		}
+
+		if err := r.reload(); err != nil {
+			util.CountWithData("server.tls.reload.error", 1, "error=%q", err)
+			continue
+		}
+		log.Printf("server.tls.reload cert=%s", r.certFile)
+	}
+}
+
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// ReloadCertificates asks for the TLS certificate to be read again
+func (s *Server) ReloadCertificates() {
+	select {
+	case s.reloadCerts <- struct{}{}:
+	default:
+	}
+}
+
+// requireClientCert only lets requests with a verified client
+// certificate through, when client CAs are configured.
+func (s *Server) requireClientCert(fn http.HandlerFunc) http.HandlerFunc {
+	if s.TLS.ClientCAFile == "" {
+		return fn
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			util.CountWithData("server.tls.clientCert.missing", 1, "request_id=%q", r.Header.Get("Request-Id"))
+			handleError(w, r, errClientCert)
+			return
+		}
+		fn(w, r)
+	}
+}
+
+func (s *Server) listenAndServeTLS() error {
+	certs, err := newCertReloader(s.TLS.CertFile, s.TLS.KeyFile)
+	if err != nil {
+		return err
+	}
+	if s.TLSConfig, err = s.TLS.tlsConfig(certs); err != nil {
+		return err
+	}
+	go certs.watch(s.TLS.ReloadInterval, s.reloadCerts, s.draining)
+
+	return s.ListenAndServeTLS("", "")
+}
@@ -0,0 +1,11 @@
+//go:build go1.12
+// +build go1.12
+
+package server
+
+import "crypto/tls"
+
+// TLS 1.3 is only served by binaries built with Go 1.12 onwards.
+func init() {
+	tlsVersions["1.3"] = tls.VersionTLS13
+}
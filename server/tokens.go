@@ -0,0 +1,118 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// tokenScope restricts what a stream token can be used for.
+type tokenScope string
+
+const (
+	scopePublish tokenScope = "publish"
+	scopeRead    tokenScope = "read"
+)
+
+// Headers used to hand out and present stream tokens
+const (
+	headerPublishToken = "Busl-Publish-Token"
+	headerReadToken    = "Busl-Read-Token"
+	headerToken        = "Busl-Token"
+)
+
+const defaultTokenTTL = 24 * time.Hour
+
+var (
+	errMissingToken = errors.New("Missing stream token")
+	errInvalidToken = errors.New("Invalid stream token")
+	errExpiredToken = errors.New("Expired stream token")
+)
+
+// Tokens are stateless: `<scope>.<expiry>.<signature>` where the
+// signature is an HMAC-SHA256 of the scope, stream key and expiry.
+func (s *Server) newToken(key string, scope tokenScope, expires time.Time) string {
+	exp := strconv.FormatInt(expires.Unix(), 10)
+	return string(scope) + "." + exp + "." + s.tokenSignature(key, scope, exp)
+}
+
+func (s *Server) tokenSignature(key string, scope tokenScope, exp string) string {
+	mac := hmac.New(sha256.New, []byte(s.TokenSecret))
+	mac.Write([]byte(string(scope) + "\n" + key + "\n" + exp))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (s *Server) verifyToken(token, key string, scope tokenScope) error {
+	if token == "" {
+		return errMissingToken
+	}
+
+	parts := strings.SplitN(token, ".", 3)
+	if len(parts) != 3 || parts[0] != string(scope) {
+		return errInvalidToken
+	}
+
+	signature := s.tokenSignature(key, scope, parts[1])
+	if !hmac.Equal([]byte(parts[2]), []byte(signature)) {
+		return errInvalidToken
+	}
+
+	exp, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return errInvalidToken
+	}
+	if time.Now().Unix() > exp {
+		return errExpiredToken
+	}
+	return nil
+}
+
+// verifyTokens checks one of the tokens lets the stream key be acted on
+// with scope.
+func (s *Server) verifyTokens(tokens []string, key string, scope tokenScope) error {
+	err := errMissingToken
+	for _, token := range tokens {
+		if err = s.verifyToken(token, key, scope); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (s *Server) tokenTTL() time.Duration {
+	if s.TokenTTL <= 0 {
+		return defaultTokenTTL
+	}
+	return s.TokenTTL
+}
+
+// Sets the publish and read tokens for a freshly created stream.
+func (s *Server) issueTokens(w http.ResponseWriter, key string) {
+	if s.TokenSecret == "" {
+		return
+	}
+
+	expires := time.Now().Add(s.tokenTTL())
+	w.Header().Set(headerPublishToken, s.newToken(key, scopePublish, expires))
+	w.Header().Set(headerReadToken, s.newToken(key, scopeRead, expires))
+}
+
+// Returns the token from the `Busl-Token` header or the `token`
+// query parameter.
+func token(r *http.Request) string {
+	if t := r.Header.Get(headerToken); t != "" {
+		return t
+	}
+	return r.URL.Query().Get("token")
+}
+
+// Returns every stream token the request carries, in its headers or
+// query.
+func requestTokens(r *http.Request) []string {
+	return append(append([]string{}, r.Header[headerToken]...), r.URL.Query()["token"]...)
+}
@@ -0,0 +1,319 @@
+package server
+
+import (
+	"html/template"
+	"net/http"
+
+	"github.com/heroku/busl/encoders"
+	"github.com/heroku/busl/util"
+)
+
+// viewer follows a stream in the browser. It reads the stream as SSE
+// through fetch, rather than EventSource, to resume from Last-Event-ID
+// itself whenever the connection is lost, and renders ANSI colours with
+// the classes of the HTML encoder.
+var viewer = template.Must(template.New("viewer").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Key}}</title>
+<style>
+{{.Style}}
+body{margin:0;background:#1e1e1e;color:#d4d4d4;font:13px/1.4 monospace}
+header{position:sticky;top:0;display:flex;gap:.5em;align-items:center;padding:.5em 1em;background:#333;color:#eee}
+header .key{flex:1;overflow:hidden;text-overflow:ellipsis;white-space:nowrap}
+header a,header button{color:#eee;background:#555;border:0;border-radius:3px;padding:.2em .6em;font:inherit;text-decoration:none;cursor:pointer}
+header input{font:inherit;padding:.2em}
+pre.ansi{margin:0}
+.line{display:flex}
+.line .ln{flex:none;width:5em;padding-right:1em;text-align:right;color:#666;text-decoration:none;user-select:none}
+.line .text{flex:1;white-space:pre-wrap;word-break:break-all}
+.line.match{background:#4b4b18}
+.line.current,.line:target{background:#264f78}
+</style>
+</head>
+<body>
+<header>
+<span class="key">{{.Key}}</span>
+<span id="status">connecting</span>
+<input id="search" type="search" placeholder="Search" title="Enter finds the next match">
+<span id="matches"></span>
+<button id="follow">Pause</button>
+<a id="download" download>Download</a>
+</header>
+<pre class="ansi" id="output"></pre>
+<script>
+(function() {
+  var key = {{.Key}};
+  var url = "/streams/" + key.split("/").map(encodeURIComponent).join("/") + location.search;
+  var output = document.getElementById("output");
+  var status = document.getElementById("status");
+  var search = document.getElementById("search");
+  var matches = document.getElementById("matches");
+  var followButton = document.getElementById("follow");
+  document.getElementById("download").href = url;
+
+  // Rendering of the output, line by line
+  var lines = [];
+  var line = null;
+  var run = "";
+  var style = {};
+  var escape = null; // escape sequence being parsed
+  var anchor = /^#L(\d+)$/.exec(location.hash);
+  var following = !anchor;
+
+  function newLine() {
+    var n = lines.length + 1;
+    var div = document.createElement("div");
+    div.className = "line";
+    div.id = "L" + n;
+    var ln = document.createElement("a");
+    ln.className = "ln";
+    ln.href = "#L" + n;
+    ln.textContent = n;
+    var text = document.createElement("span");
+    text.className = "text";
+    div.appendChild(ln);
+    div.appendChild(text);
+    output.appendChild(div);
+    lines.push(div);
+    line = text;
+    if (anchor && n === +anchor[1]) {
+      div.scrollIntoView();
+    }
+  }
+
+  function span() {
+    var classes = [], styles = [];
+    ["bold", "faint", "italic", "underline"].forEach(function(attr) {
+      if (style[attr]) classes.push("ansi-" + attr);
+    });
+    [["fg", "color"], ["bg", "background"]].forEach(function(c) {
+      var value = style[c[0]];
+      if (value === undefined) return;
+      if (value[0] === "#") styles.push(c[1] + ":" + value);
+      else classes.push("ansi-" + c[0] + "-" + value);
+    });
+    if (!classes.length && !styles.length) return null;
+    var el = document.createElement("span");
+    el.className = classes.join(" ");
+    el.style.cssText = styles.join(";");
+    return el;
+  }
+
+  function flush() {
+    if (!run) return;
+    if (!line) newLine();
+    var el = span();
+    if (el) {
+      el.textContent = run;
+      line.appendChild(el);
+    } else {
+      line.appendChild(document.createTextNode(run));
+    }
+    if (search.value && line.parentNode.textContent.toLowerCase().indexOf(search.value.toLowerCase()) >= 0) {
+      line.parentNode.classList.add("match");
+    }
+    run = "";
+  }
+
+  function xterm256(n) {
+    if (n < 16) return String(n);
+    var hex = function(v) { return ("0" + v.toString(16)).slice(-2); };
+    if (n < 232) {
+      var levels = [0, 95, 135, 175, 215, 255];
+      n -= 16;
+      return "#" + hex(levels[Math.floor(n / 36)]) + hex(levels[Math.floor(n / 6) % 6]) + hex(levels[n % 6]);
+    }
+    var gray = hex(8 + (n - 232) * 10);
+    return "#" + gray + gray + gray;
+  }
+
+  function sgr(params) {
+    var codes = params.split(";").map(function(c) { return +c || 0; });
+    for (var i = 0; i < codes.length; i++) {
+      var c = codes[i];
+      if (c === 0) style = {};
+      else if (c === 1) style.bold = true;
+      else if (c === 2) style.faint = true;
+      else if (c === 3) style.italic = true;
+      else if (c === 4) style.underline = true;
+      else if (c === 22) style.bold = style.faint = false;
+      else if (c === 23) style.italic = false;
+      else if (c === 24) style.underline = false;
+      else if (c >= 30 && c <= 37) style.fg = String(c - 30);
+      else if (c === 39) delete style.fg;
+      else if (c >= 40 && c <= 47) style.bg = String(c - 40);
+      else if (c === 49) delete style.bg;
+      else if (c >= 90 && c <= 97) style.fg = String(c - 82);
+      else if (c >= 100 && c <= 107) style.bg = String(c - 92);
+      else if (c === 38 || c === 48) {
+        var color;
+        if (codes[i + 1] === 5 && i + 2 < codes.length) {
+          color = codes[i + 2] <= 255 ? xterm256(codes[i + 2]) : undefined;
+          i += 2;
+        } else if (codes[i + 1] === 2 && i + 4 < codes.length) {
+          color = "#" + codes.slice(i + 2, i + 5).map(function(v) { return ("0" + (v & 255).toString(16)).slice(-2); }).join("");
+          i += 4;
+        } else {
+          i = codes.length;
+        }
+        if (c === 38) style.fg = color;
+        else style.bg = color;
+      }
+    }
+  }
+
+  function render(text) {
+    for (var i = 0; i < text.length; i++) {
+      var ch = text[i];
+      if (escape !== null) {
+        escape += ch;
+        if (escape === "\x1b[" || escape === "\x1b]") continue;
+        if (escape[1] === "[") {
+          if (ch >= " " && ch <= "?") continue;
+          if (ch === "m") sgr(escape.slice(2, -1));
+        } else if (escape[1] === "]") {
+          // Operating system commands end with BEL or ST
+          if (ch !== "\x07" && !(ch === "\\" && escape[escape.length - 2] === "\x1b")) continue;
+        }
+        escape = null;
+      } else if (ch === "\x1b") {
+        flush();
+        escape = ch;
+      } else if (ch === "\n") {
+        flush();
+        if (!line) newLine();
+        line = null;
+      } else if (ch !== "\r" && ch !== "\x07" && ch !== "\b") {
+        run += ch;
+      }
+    }
+    flush();
+    if (following) window.scrollTo(0, document.body.scrollHeight);
+  }
+
+  // Following the end of the output, until scrolling up
+  function follow(on) {
+    following = on;
+    followButton.textContent = on ? "Pause" : "Follow";
+    if (on) window.scrollTo(0, document.body.scrollHeight);
+  }
+  followButton.onclick = function() { follow(!following); };
+  window.addEventListener("wheel", function(e) { if (e.deltaY < 0) follow(false); });
+  window.addEventListener("hashchange", function() { follow(false); });
+
+  // Search, highlighting matching lines and going through them on Enter
+  var current = -1;
+  search.oninput = function() {
+    var term = search.value.toLowerCase();
+    var count = 0;
+    lines.forEach(function(div) {
+      var match = term !== "" && div.textContent.toLowerCase().indexOf(term) >= 0;
+      div.classList.toggle("match", match);
+      if (match) count++;
+    });
+    matches.textContent = term ? count + " matches" : "";
+    current = -1;
+  };
+  search.onkeydown = function(e) {
+    if (e.key !== "Enter") return;
+    for (var i = 1; i <= lines.length; i++) {
+      var n = (current + i) % lines.length;
+      if (lines[n].classList.contains("match")) {
+        if (current >= 0) lines[current].classList.remove("current");
+        current = n;
+        lines[n].classList.add("current");
+        lines[n].scrollIntoView({block: "center"});
+        follow(false);
+        return;
+      }
+    }
+  };
+
+  // Reading the stream, resuming after the last event on reconnection
+  var lastEventID = "";
+  var retry = 1000;
+  var decoder;
+  var buffer = "";
+  var event = {data: [], type: ""};
+
+  function dispatch(field, value) {
+    if (field === "data") event.data.push(value);
+    else if (field === "id") lastEventID = value;
+    else if (field === "event") event.type = value;
+    else if (field === "retry" && /^\d+$/.test(value)) retry = +value;
+  }
+
+  function parse(chunk) {
+    buffer += decoder.decode(chunk, {stream: true});
+    var lines = buffer.split("\n");
+    buffer = lines.pop();
+    lines.forEach(function(l) {
+      if (l === "") {
+        if (event.data.length && event.type === "") render(event.data.join("\n"));
+        event = {data: [], type: ""};
+        return;
+      }
+      if (l[0] === ":") return;
+      var i = l.indexOf(":");
+      var field = i < 0 ? l : l.slice(0, i);
+      var value = i < 0 ? "" : l.slice(i + 1).replace(/^ /, "");
+      dispatch(field, value);
+    });
+  }
+
+  function connect() {
+    var headers = {"Accept": "text/event-stream"};
+    if (lastEventID) headers["Last-Event-ID"] = lastEventID;
+    decoder = new TextDecoder();
+    buffer = "";
+    event = {data: [], type: ""};
+
+    fetch(url, {headers: headers, credentials: "same-origin", cache: "no-store"}).then(function(resp) {
+      // Nothing left past the last event
+      if (resp.status === 204 || resp.status === 416) return "done";
+      if (resp.status >= 400 && resp.status < 500) return resp.status + " " + resp.statusText;
+      if (!resp.ok) throw new Error(resp.status + " " + resp.statusText);
+      status.textContent = "streaming";
+      var reader = resp.body.getReader();
+      return reader.read().then(function next(result) {
+        if (result.done) return "";
+        parse(result.value);
+        return reader.read().then(next);
+      });
+    }).then(function(end) {
+      if (end) {
+        status.textContent = end;
+        return;
+      }
+      // Either done, or the instance is shutting down: the next
+      // request tells.
+      setTimeout(connect, 0);
+    }, function(err) {
+      status.textContent = "reconnecting (" + err.message + ")";
+      setTimeout(connect, retry);
+    });
+  }
+  connect();
+})();
+</script>
+</body>
+</html>
+`))
+
+type viewerPage struct {
+	Key   string
+	Style template.CSS
+}
+
+// view serves a page following a stream in the browser
+func (s *Server) view(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	util.CountWithData("server.view", 1, "request_id=%q", r.Header.Get("Request-Id"))
+
+	if err := viewer.Execute(w, viewerPage{Key: key(r), Style: template.CSS(encoders.HTMLStyle)}); err != nil {
+		logError(r, err)
+	}
+}
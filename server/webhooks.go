@@ -0,0 +1,328 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/heroku/busl/broker"
+	"github.com/heroku/busl/util"
+)
+
+// Stream lifecycle events webhooks are sent for
+const (
+	eventCreated   = "stream.created"
+	eventFirstByte = "stream.first_byte"
+	eventClosed    = "stream.closed"
+	eventArchived  = "stream.archived"
+	eventExpired   = "stream.expired"
+)
+
+const (
+	headerWebhookEvent     = "Busl-Event"
+	headerWebhookDelivery  = "Busl-Delivery"
+	headerWebhookSignature = "Busl-Signature"
+
+	defaultWebhookAttempts    = 10
+	defaultWebhookConcurrency = 4
+	webhookTimeout            = 10 * time.Second
+	webhookPollInterval       = time.Second
+	webhookMaxBackoff         = time.Hour
+)
+
+// Webhooks configures the notifications POSTed on stream lifecycle
+// events: created, first byte published, closed, archived to storage
+// and expired without being closed.
+type Webhooks struct {
+	URLs []string
+
+	// Signs each payload with HMAC-SHA256, sent hex encoded in the
+	// Busl-Signature header as `sha256=<signature>`.
+	Secret string
+
+	// Deliveries are retried with an exponential backoff until this
+	// many attempts failed, 10 when zero.
+	MaxAttempts int
+
+	// Deliveries sent at once, 4 when zero
+	Concurrency int
+
+	// Keeps deliveries in memory when nil, which loses them on restart
+	Queue Queue
+}
+
+// Enabled tells whether any webhook is configured
+func (w Webhooks) Enabled() bool {
+	return len(w.URLs) > 0
+}
+
+// Queue holds webhook deliveries until they succeed or are given up on
+type Queue interface {
+	// Push adds an item, to be popped at or after at
+	Push(item []byte, at time.Time) error
+
+	// Pop returns the next item due, or nil when there is none. Items
+	// popped but never acknowledged may be popped again.
+	Pop() ([]byte, error)
+
+	// Ack removes a popped item for good
+	Ack(item []byte) error
+}
+
+// MemoryQueue keeps items in memory, which only works for a single
+// instance and loses them on restart.
+type MemoryQueue struct {
+	mu    sync.Mutex
+	items []memoryQueueItem
+}
+
+type memoryQueueItem struct {
+	item []byte
+	at   time.Time
+}
+
+// NewMemoryQueue creates an in-memory queue
+func NewMemoryQueue() *MemoryQueue {
+	return &MemoryQueue{}
+}
+
+// Push implements Queue
+func (q *MemoryQueue) Push(item []byte, at time.Time) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.items = append(q.items, memoryQueueItem{item, at})
+	return nil
+}
+
+// Pop implements Queue
+func (q *MemoryQueue) Pop() ([]byte, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+	for i, item := range q.items {
+		if !item.at.After(now) {
+			q.items = append(q.items[:i], q.items[i+1:]...)
+			return item.item, nil
+		}
+	}
+	return nil, nil
+}
+
+// Ack implements Queue. Items are already gone once popped.
+func (q *MemoryQueue) Ack(item []byte) error {
+	return nil
+}
+
+type webhookEvent struct {
+	ID     string    `json:"id"`
+	Type   string    `json:"type"`
+	Key    string    `json:"key"`
+	Length *int64    `json:"length,omitempty"`
+	Time   time.Time `json:"time"`
+}
+
+// webhookDelivery is an event to be sent to one of the webhook URLs
+type webhookDelivery struct {
+	URL     string       `json:"url"`
+	Attempt int          `json:"attempt"`
+	Event   webhookEvent `json:"event"`
+}
+
+// notify queues an event for every webhook. Closed and archived
+// streams come with their length, other events pass a negative one.
+func (s *Server) notify(eventType, key string, length int64) {
+	if !s.Webhooks.Enabled() {
+		return
+	}
+
+	id, err := util.NewUUID()
+	if err != nil {
+		util.CountWithData("server.webhook.queue.error", 1, "event=%s error=%q", eventType, err)
+		return
+	}
+	event := webhookEvent{ID: id, Type: eventType, Key: key, Time: time.Now().UTC()}
+	if length >= 0 {
+		event.Length = &length
+	}
+
+	for _, url := range s.Webhooks.URLs {
+		item, _ := json.Marshal(webhookDelivery{URL: url, Event: event})
+		if err := s.webhookQueue.Push(item, time.Now()); err != nil {
+			util.CountWithData("server.webhook.queue.error", 1, "event=%s error=%q", eventType, err)
+		}
+	}
+}
+
+// deliverWebhooks sends queued deliveries, several at once, until done
+// is closed.
+func (s *Server) deliverWebhooks(done <-chan struct{}) {
+	client := &http.Client{Timeout: webhookTimeout}
+
+	concurrency := s.Webhooks.Concurrency
+	if concurrency <= 0 {
+		concurrency = defaultWebhookConcurrency
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.deliverQueued(client, done)
+		}()
+	}
+	wg.Wait()
+}
+
+// deliverQueued sends deliveries one after the other until done is
+// closed.
+func (s *Server) deliverQueued(client *http.Client, done <-chan struct{}) {
+	for {
+		item, err := s.webhookQueue.Pop()
+		if err != nil {
+			util.CountWithData("server.webhook.queue.error", 1, "error=%q", err)
+		}
+
+		if item == nil {
+			select {
+			case <-done:
+				return
+			case <-time.After(webhookPollInterval):
+			}
+			continue
+		}
+
+		s.deliverWebhook(client, item)
+
+		select {
+		case <-done:
+			return
+		default:
+		}
+	}
+}
+
+// deliverWebhook attempts a delivery, scheduling another attempt when
+// it fails. The next attempt is queued before the failed one is
+// acknowledged, so that deliveries are never lost.
+func (s *Server) deliverWebhook(client *http.Client, item []byte) {
+	defer s.webhookQueue.Ack(item)
+
+	var delivery webhookDelivery
+	if err := json.Unmarshal(item, &delivery); err != nil {
+		util.CountWithData("server.webhook.invalid", 1, "error=%q", err)
+		return
+	}
+	delivery.Attempt++
+
+	err := s.postWebhook(client, &delivery)
+	if err == nil {
+		util.CountWithData("server.webhook.delivered", 1, "event=%s attempt=%d", delivery.Event.Type, delivery.Attempt)
+		return
+	}
+
+	maxAttempts := s.Webhooks.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = defaultWebhookAttempts
+	}
+	if delivery.Attempt >= maxAttempts {
+		util.CountWithData("server.webhook.dropped", 1, "event=%s url=%q error=%q", delivery.Event.Type, delivery.URL, err)
+		return
+	}
+
+	util.CountWithData("server.webhook.retry", 1, "event=%s attempt=%d error=%q", delivery.Event.Type, delivery.Attempt, err)
+	retry, _ := json.Marshal(delivery)
+	if err := s.webhookQueue.Push(retry, time.Now().Add(webhookBackoff(delivery.Attempt))); err != nil {
+		util.CountWithData("server.webhook.queue.error", 1, "event=%s error=%q", delivery.Event.Type, err)
+	}
+}
+
+// webhookBackoff is how long to wait after the given failed attempt:
+// 2s, 4s, 8s and so on, up to an hour.
+func webhookBackoff(attempt int) time.Duration {
+	backoff := time.Second << uint(attempt)
+	if backoff <= 0 || backoff > webhookMaxBackoff {
+		return webhookMaxBackoff
+	}
+	return backoff
+}
+
+func (s *Server) postWebhook(client *http.Client, delivery *webhookDelivery) error {
+	payload, err := json.Marshal(delivery.Event)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", delivery.URL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(headerWebhookEvent, delivery.Event.Type)
+	req.Header.Set(headerWebhookDelivery, delivery.Event.ID)
+	if s.Webhooks.Secret != "" {
+		req.Header.Set(headerWebhookSignature, "sha256="+signWebhook(s.Webhooks.Secret, payload))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func signWebhook(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// firstByteWriter calls fn once something was first written through it
+type firstByteWriter struct {
+	io.Writer
+	once sync.Once
+	fn   func()
+}
+
+func (w *firstByteWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	if n > 0 {
+		w.once.Do(w.fn)
+	}
+	return n, err
+}
+
+// watchExpired notifies streams expiring without being closed until
+// done is closed, watching again whenever redis gets disconnected.
+func (s *Server) watchExpired(done <-chan struct{}) {
+	notify := func(key string) { s.notify(eventExpired, key, -1) }
+
+	for {
+		err := broker.WatchExpired(notify, done)
+		if err == nil {
+			return
+		}
+		util.CountWithData("server.webhook.expired.error", 1, "error=%q", err)
+
+		select {
+		case <-done:
+			return
+		case <-time.After(webhookPollInterval):
+		}
+	}
+}
@@ -1,12 +1,17 @@
 package storage
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/heroku/busl/trace"
 	"github.com/heroku/busl/util"
 )
 
@@ -34,8 +39,25 @@ var (
 //   err := storage.Put(requestURI, reader)
 //
 func Put(requestURI, baseURI string, reader io.Reader) (err error) {
+	return PutContext(context.Background(), requestURI, baseURI, reader)
+}
+
+// PutContext is Put, traced as a child of the span in ctx.
+func PutContext(ctx context.Context, requestURI, baseURI string, reader io.Reader) error {
+	return PutTypedContext(ctx, requestURI, baseURI, "", reader)
+}
+
+// PutTypedContext is PutContext, storing the data with contentType
+// unless it's empty.
+func PutTypedContext(ctx context.Context, requestURI, baseURI, contentType string, reader io.Reader) (err error) {
+	ctx, span := trace.Start(ctx, "storage.put", trace.KindClient)
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
+
 	for i := retries; i > 0; i-- {
-		err = put(requestURI, baseURI, reader)
+		err = put(ctx, requestURI, baseURI, contentType, reader)
 
 		// Break if we get nil / any error other than Err5xx
 		if err == nil {
@@ -57,11 +79,14 @@ func Put(requestURI, baseURI string, reader io.Reader) (err error) {
 	return err
 }
 
-func put(requestURI, baseURI string, reader io.Reader) error {
-	req, err := newRequest("PUT", requestURI, baseURI, reader)
+func put(ctx context.Context, requestURI, baseURI, contentType string, reader io.Reader) error {
+	req, err := newRequest(ctx, "PUT", requestURI, baseURI, reader)
 	if err != nil {
 		return err
 	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
 	res, err := process(req)
 	if res != nil {
 		defer res.Body.Close()
@@ -80,8 +105,20 @@ func put(requestURI, baseURI string, reader io.Reader) error {
 //   reader, err := storage.Get(requestURI, 0)
 //
 func Get(requestURI, baseURI string, offset int64) (rd io.ReadCloser, err error) {
+	return GetContext(context.Background(), requestURI, baseURI, offset)
+}
+
+// GetContext is Get, traced as a child of the span in ctx. The body
+// is bound to ctx as well.
+func GetContext(ctx context.Context, requestURI, baseURI string, offset int64) (rd io.ReadCloser, err error) {
+	ctx, span := trace.Start(ctx, "storage.get", trace.KindClient)
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
+
 	for i := retries; i > 0; i-- {
-		rd, err = get(requestURI, baseURI, offset)
+		rd, err = get(ctx, requestURI, baseURI, offset)
 
 		if err == nil {
 			util.Count("storage.get.success")
@@ -107,8 +144,8 @@ func Get(requestURI, baseURI string, offset int64) (rd io.ReadCloser, err error)
 	return rd, err
 }
 
-func get(requestURI, baseURI string, offset int64) (io.ReadCloser, error) {
-	req, err := newRequest("GET", requestURI, baseURI, nil)
+func get(ctx context.Context, requestURI, baseURI string, offset int64) (io.ReadCloser, error) {
+	req, err := newRequest(ctx, "GET", requestURI, baseURI, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -123,18 +160,144 @@ func get(requestURI, baseURI string, offset int64) (io.ReadCloser, error) {
 	if res == nil {
 		return nil, err
 	}
-	return res.Body, err
+	return &body{ReadCloser: res.Body, contentType: res.Header.Get("Content-Type"), length: objectLength(res)}, err
+}
+
+// objectLength returns the length of the whole object a response holds
+// some of, or -1 when unknown.
+func objectLength(res *http.Response) int64 {
+	if res.StatusCode != http.StatusPartialContent {
+		return res.ContentLength
+	}
+	i := strings.LastIndex(res.Header.Get("Content-Range"), "/")
+	if i < 0 {
+		return -1
+	}
+	length, err := strconv.ParseInt(res.Header.Get("Content-Range")[i+1:], 10, 64)
+	if err != nil {
+		return -1
+	}
+	return length
+}
+
+// body is the data of a stored object, along with its type and length
+type body struct {
+	io.ReadCloser
+	contentType string
+	length      int64
+}
+
+// ContentType returns the type the data read from rd was stored with,
+// or an empty string when rd wasn't returned by Get.
+func ContentType(rd io.Reader) string {
+	if b, ok := rd.(*body); ok {
+		return b.contentType
+	}
+	return ""
+}
+
+// Length returns the length of the whole object the data read from rd
+// belongs to, or -1 when unknown or rd wasn't returned by Get.
+func Length(rd io.Reader) int64 {
+	if b, ok := rd.(*body); ok {
+		return b.length
+	}
+	return -1
+}
+
+// Info describes an object held by the storage backend.
+type Info struct {
+	Length      int64     // -1 when the backend didn't send a Content-Length
+	ModTime     time.Time // zero when the backend didn't send a Last-Modified
+	ETag        string
+	ContentType string
+}
+
+// Stat fetches the metadata of the data stored in requestURI
+// without downloading it. It asks for the first byte only, as presigned
+// URLs are only valid for GET requests.
+// The requestURI is resolved using the `STORAGE_BASE_URL` as the base.
+//
+// Retries transient errors `retries` number of times.
+//
+// Usage:
+//
+//   requestURI := "1/2/3?X-Amz-Algorithm=...&..."
+//   info, err := storage.Stat(requestURI, baseURI)
+//
+func Stat(requestURI, baseURI string) (info *Info, err error) {
+	return StatContext(context.Background(), requestURI, baseURI)
+}
+
+// StatContext is Stat, traced as a child of the span in ctx.
+func StatContext(ctx context.Context, requestURI, baseURI string) (info *Info, err error) {
+	ctx, span := trace.Start(ctx, "storage.stat", trace.KindClient)
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
+
+	for i := retries; i > 0; i-- {
+		info, err = stat(ctx, requestURI, baseURI)
+
+		if err == nil {
+			util.Count("storage.stat.success")
+			return info, nil
+		}
+
+		if err != Err5xx {
+			util.Count("storage.stat.error")
+			return nil, err
+		}
+
+		util.Count("storage.stat.retry")
+	}
+
+	// We've ran out of retries
+	util.Count("storage.stat.maxretries")
+	return nil, err
+}
+
+func stat(ctx context.Context, requestURI, baseURI string) (*Info, error) {
+	req, err := newRequest(ctx, "GET", requestURI, baseURI, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Range", "bytes=0-0")
+
+	res, err := process(req)
+	if res != nil {
+		defer res.Body.Close()
+	}
+	switch {
+	case err == ErrRange:
+		// Empty objects have no first byte to send
+		return &Info{Length: 0, ETag: res.Header.Get("ETag"), ContentType: res.Header.Get("Content-Type")}, nil
+	case err != nil:
+		return nil, err
+	}
+
+	info := &Info{Length: objectLength(res), ETag: res.Header.Get("ETag"), ContentType: res.Header.Get("Content-Type")}
+	if t, err := http.ParseTime(res.Header.Get("Last-Modified")); err == nil {
+		info.ModTime = t
+	}
+	return info, nil
 }
 
 // constructs an http.Request object, resolving requestURI
-// under `STORAGE_BASE_URL`.
-func newRequest(method, requestURI, baseURI string, reader io.Reader) (*http.Request, error) {
+// under `STORAGE_BASE_URL`, and propagating the trace in ctx.
+func newRequest(ctx context.Context, method, requestURI, baseURI string, reader io.Reader) (*http.Request, error) {
 	u, err := absoluteURL(baseURI, requestURI)
 	if err != nil {
 		return nil, err
 	}
 
-	return http.NewRequest(method, u.String(), reader)
+	req, err := http.NewRequest(method, u.String(), reader)
+	if err != nil {
+		return nil, err
+	}
+	trace.Inject(ctx, req.Header)
+	return req.WithContext(ctx), nil
 }
 
 // Executes the HTTP request:
@@ -145,6 +308,10 @@ func newRequest(method, requestURI, baseURI string, reader io.Reader) (*http.Req
 //   - ErrRange
 //
 func process(req *http.Request) (*http.Response, error) {
+	defer func(start time.Time) {
+		util.Measure("storage."+strings.ToLower(req.Method), time.Since(start))
+	}(time.Now())
+
 	transport := &http.Transport{}
 	client := &http.Client{Transport: transport}
 
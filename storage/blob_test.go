@@ -1,14 +1,19 @@
 package storage
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/heroku/busl/trace"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -108,3 +113,109 @@ func TestGetIllegalOffset(t *testing.T) {
 		t.Fatalf("%v != Expected 200, got 416", err)
 	}
 }
+
+func TestStat(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "GET", r.Method)
+		assert.Equal(t, "bytes=0-0", r.Header.Get("Range"))
+		w.Header().Set("ETag", `"abc"`)
+		w.Header().Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+		w.Header().Set("Content-Range", "bytes 0-0/11")
+		w.Header().Set("Content-Type", "text/csv")
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write([]byte("h"))
+	}))
+	defer server.Close()
+
+	info, err := Stat("1/2/3", server.URL)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(11), info.Length)
+	assert.Equal(t, `"abc"`, info.ETag)
+	assert.Equal(t, 2006, info.ModTime.Year())
+	assert.Equal(t, "text/csv", info.ContentType)
+}
+
+func TestStatEmpty(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Range", "bytes */0")
+		w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+	}))
+	defer server.Close()
+
+	info, err := Stat("1/2/3", server.URL)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), info.Length)
+}
+
+func TestStatNotFound(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+
+	_, err := Stat("1/2/3", server.URL)
+	assert.Equal(t, ErrNotFound, err)
+}
+
+func TestPutTyped(t *testing.T) {
+	contentType := make(chan string, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentType <- r.Header.Get("Content-Type")
+	}))
+	defer server.Close()
+
+	assert.Nil(t, PutTypedContext(context.Background(), "1/2/3", server.URL, "text/csv", strings.NewReader("a,b")))
+	assert.Equal(t, "text/csv", <-contentType)
+
+	assert.Nil(t, PutContext(context.Background(), "1/2/3", server.URL, strings.NewReader("a,b")))
+	assert.Equal(t, "", <-contentType)
+}
+
+func TestGetContentType(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Write([]byte("a,b"))
+	}))
+	defer server.Close()
+
+	rd, err := Get("1/2/3", server.URL, 0)
+	assert.Nil(t, err)
+	defer rd.Close()
+	assert.Equal(t, "text/csv", ContentType(rd))
+	assert.Equal(t, "", ContentType(strings.NewReader("a,b")))
+}
+
+func TestGetLength(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader("hello world"))
+	}))
+	defer server.Close()
+
+	for _, offset := range []int64{0, 6} {
+		rd, err := Get("1/2/3", server.URL, offset)
+		assert.Nil(t, err)
+		assert.Equal(t, int64(11), Length(rd))
+		rd.Close()
+	}
+	assert.Equal(t, int64(-1), Length(strings.NewReader("hello")))
+}
+
+func TestTraceparentPropagation(t *testing.T) {
+	traceparent := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent <- r.Header.Get("traceparent")
+	}))
+	defer server.Close()
+
+	trace.SetExporter(trace.NewWriterExporter(ioutil.Discard))
+	defer trace.SetExporter(nil)
+
+	ctx, span := trace.Start(context.Background(), "server.publish", trace.KindServer)
+	defer span.End()
+
+	err := PutContext(ctx, "1/2/3", server.URL, strings.NewReader("hello"))
+	assert.Nil(t, err)
+
+	sc, ok := trace.ParseTraceparent(<-traceparent)
+	assert.True(t, ok)
+	assert.Equal(t, span.Context.TraceID, sc.TraceID)
+	assert.NotEqual(t, span.Context.SpanID, sc.SpanID)
+}
@@ -0,0 +1,215 @@
+package trace
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/heroku/busl/util"
+)
+
+// OTLPExporter sends spans in batches to an OpenTelemetry collector,
+// using OTLP over HTTP with JSON encoding.
+type OTLPExporter struct {
+	endpoint string
+	service  string
+	client   *http.Client
+
+	mutex   sync.Mutex
+	pending []*Span
+	flush   chan bool
+	done    chan bool
+}
+
+const (
+	otlpBatchSize     = 512
+	otlpFlushInterval = 5 * time.Second
+	otlpMaxPending    = 8192 // spans are dropped past that
+)
+
+// NewOTLPExporter creates an exporter for the collector at endpoint,
+// e.g. `http://localhost:4318`. Spans are sent in the background.
+func NewOTLPExporter(endpoint, service string) *OTLPExporter {
+	e := &OTLPExporter{
+		endpoint: strings.TrimRight(endpoint, "/") + "/v1/traces",
+		service:  service,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		flush:    make(chan bool, 1),
+		done:     make(chan bool),
+	}
+	go e.loop()
+	return e
+}
+
+// Export implements Exporter
+func (e *OTLPExporter) Export(span *Span) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if len(e.pending) >= otlpMaxPending {
+		util.Count("trace.otlp.dropped")
+		return
+	}
+	e.pending = append(e.pending, span)
+
+	if len(e.pending) >= otlpBatchSize {
+		select {
+		case e.flush <- true:
+		default:
+		}
+	}
+}
+
+// Flush sends all pending spans right away
+func (e *OTLPExporter) Flush() error {
+	e.mutex.Lock()
+	spans := e.pending
+	e.pending = nil
+	e.mutex.Unlock()
+
+	if len(spans) == 0 {
+		return nil
+	}
+	return e.send(spans)
+}
+
+// Shutdown sends the pending spans and stops the exporter
+func (e *OTLPExporter) Shutdown() error {
+	close(e.done)
+	return e.Flush()
+}
+
+func (e *OTLPExporter) loop() {
+	ticker := time.NewTicker(otlpFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-e.done:
+			return
+		case <-ticker.C:
+		case <-e.flush:
+		}
+
+		if err := e.Flush(); err != nil {
+			util.CountWithData("trace.otlp.error", 1, "error=%q", err)
+		}
+	}
+}
+
+func (e *OTLPExporter) send(spans []*Span) error {
+	body, err := json.Marshal(e.request(spans))
+	if err != nil {
+		return err
+	}
+
+	res, err := e.client.Post(e.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("Expected 2xx, got %d", res.StatusCode)
+	}
+	util.CountMany("trace.otlp.exported", int64(len(spans)))
+	return nil
+}
+
+// Types below follow the JSON encoding of the OTLP protobuf messages.
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              Kind            `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"` // 2 for errors
+	Message string `json:"message,omitempty"`
+}
+
+func (e *OTLPExporter) request(spans []*Span) otlpRequest {
+	scope := otlpScopeSpans{Scope: otlpScope{Name: "github.com/heroku/busl"}}
+	for _, span := range spans {
+		s := otlpSpan{
+			TraceID:           hex.EncodeToString(span.Context.TraceID[:]),
+			SpanID:            hex.EncodeToString(span.Context.SpanID[:]),
+			Name:              span.Name,
+			Kind:              span.Kind,
+			StartTimeUnixNano: strconv.FormatInt(span.StartTime.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.EndTime.UnixNano(), 10),
+			Attributes:        attributes(span.Attributes),
+		}
+		if span.Parent.IsValid() {
+			s.ParentSpanID = hex.EncodeToString(span.Parent.SpanID[:])
+		}
+		if span.Err != nil {
+			s.Status = otlpStatus{Code: 2, Message: span.Err.Error()}
+		}
+		scope.Spans = append(scope.Spans, s)
+	}
+
+	return otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: attributes(map[string]string{"service.name": e.service})},
+		ScopeSpans: []otlpScopeSpans{scope},
+	}}}
+}
+
+func attributes(m map[string]string) []otlpAttribute {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	attrs := make([]otlpAttribute, 0, len(keys))
+	for _, k := range keys {
+		attrs = append(attrs, otlpAttribute{Key: k, Value: otlpValue{StringValue: m[k]}})
+	}
+	return attrs
+}
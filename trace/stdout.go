@@ -0,0 +1,55 @@
+package trace
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// WriterExporter writes one JSON document per span, e.g. to stdout
+type WriterExporter struct {
+	mutex sync.Mutex
+	w     io.Writer
+}
+
+// NewWriterExporter creates an exporter writing spans to w
+func NewWriterExporter(w io.Writer) *WriterExporter {
+	return &WriterExporter{w: w}
+}
+
+type jsonSpan struct {
+	TraceID    string            `json:"trace_id"`
+	SpanID     string            `json:"span_id"`
+	ParentID   string            `json:"parent_id,omitempty"`
+	Name       string            `json:"name"`
+	Kind       Kind              `json:"kind"`
+	Start      time.Time         `json:"start"`
+	Duration   float64           `json:"duration_ms"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	Error      string            `json:"error,omitempty"`
+}
+
+// Export implements Exporter
+func (e *WriterExporter) Export(span *Span) {
+	s := jsonSpan{
+		TraceID:    hex.EncodeToString(span.Context.TraceID[:]),
+		SpanID:     hex.EncodeToString(span.Context.SpanID[:]),
+		Name:       span.Name,
+		Kind:       span.Kind,
+		Start:      span.StartTime,
+		Duration:   float64(span.EndTime.Sub(span.StartTime)) / float64(time.Millisecond),
+		Attributes: span.Attributes,
+	}
+	if span.Parent.IsValid() {
+		s.ParentID = hex.EncodeToString(span.Parent.SpanID[:])
+	}
+	if span.Err != nil {
+		s.Error = span.Err.Error()
+	}
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	json.NewEncoder(e.w).Encode(s)
+}
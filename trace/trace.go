@@ -0,0 +1,203 @@
+// Package trace records OpenTelemetry style spans and propagates them
+// across services with the W3C `traceparent` header.
+package trace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// SpanContext identifies a span within a trace
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Sampled bool
+}
+
+// IsValid reports whether the span context has non zero ids
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != [16]byte{} && sc.SpanID != [8]byte{}
+}
+
+// Traceparent formats the span context as a W3C traceparent header
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", hex.EncodeToString(sc.TraceID[:]), hex.EncodeToString(sc.SpanID[:]), flags)
+}
+
+// ParseTraceparent parses a W3C traceparent header
+func ParseTraceparent(h string) (sc SpanContext, ok bool) {
+	parts := strings.Split(strings.TrimSpace(h), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return sc, false
+	}
+	if len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, false
+	}
+
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return sc, false
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return sc, false
+	}
+	sc.Sampled = flags[0]&1 == 1
+	return sc, sc.IsValid()
+}
+
+// Kind tells whether a span serves, issues or is internal to a request
+type Kind int
+
+// Span kinds, numbered as in OTLP
+const (
+	KindInternal Kind = 1
+	KindServer   Kind = 2
+	KindClient   Kind = 3
+)
+
+// Span is a timed operation within a trace
+type Span struct {
+	Name       string
+	Kind       Kind
+	Context    SpanContext
+	Parent     SpanContext
+	StartTime  time.Time
+	EndTime    time.Time
+	Attributes map[string]string
+	Err        error
+
+	exporter Exporter
+	ended    int32
+}
+
+// SetAttribute annotates the span. Safe to call on a nil span.
+func (s *Span) SetAttribute(key, value string) {
+	if s == nil {
+		return
+	}
+	s.Attributes[key] = value
+}
+
+// SetError marks the span as failed. Safe to call on a nil span.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.Err = err
+}
+
+// End ends the span and hands it to the exporter. Safe to call on a
+// nil span, only the first call has an effect.
+func (s *Span) End() {
+	if s == nil || !atomic.CompareAndSwapInt32(&s.ended, 0, 1) {
+		return
+	}
+	s.EndTime = time.Now()
+	if s.Context.Sampled {
+		s.exporter.Export(s)
+	}
+}
+
+// Exporter ships finished spans somewhere
+type Exporter interface {
+	Export(span *Span)
+}
+
+var exporter atomic.Value
+
+type exporterHolder struct{ Exporter }
+
+// SetExporter enables tracing, sending finished spans to e. Tracing is
+// disabled with a nil exporter, which is the default.
+func SetExporter(e Exporter) {
+	exporter.Store(exporterHolder{e})
+}
+
+func currentExporter() Exporter {
+	h, _ := exporter.Load().(exporterHolder)
+	return h.Exporter
+}
+
+type spanKey struct{}
+type remoteKey struct{}
+
+// Start starts a span, child of the span or remote parent found in
+// ctx. Returns a nil span when tracing is disabled.
+func Start(ctx context.Context, name string, kind Kind) (context.Context, *Span) {
+	e := currentExporter()
+	if e == nil {
+		return ctx, nil
+	}
+
+	span := &Span{
+		Name:       name,
+		Kind:       kind,
+		StartTime:  time.Now(),
+		Attributes: make(map[string]string),
+		exporter:   e,
+	}
+
+	if parent := SpanContextFromContext(ctx); parent.IsValid() {
+		span.Parent = parent
+		span.Context.TraceID = parent.TraceID
+		span.Context.Sampled = parent.Sampled
+	} else {
+		rand.Read(span.Context.TraceID[:])
+		span.Context.Sampled = true
+	}
+	rand.Read(span.Context.SpanID[:])
+
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// SpanContextFromContext returns the context of the current span in
+// ctx, or of the remote parent extracted from an incoming request.
+func SpanContextFromContext(ctx context.Context) SpanContext {
+	if span, ok := ctx.Value(spanKey{}).(*Span); ok {
+		return span.Context
+	}
+	sc, _ := ctx.Value(remoteKey{}).(SpanContext)
+	return sc
+}
+
+// Extract returns a context holding the remote parent span found in
+// the `traceparent` header, if any.
+func Extract(ctx context.Context, h http.Header) context.Context {
+	if sc, ok := ParseTraceparent(h.Get("traceparent")); ok {
+		return context.WithValue(ctx, remoteKey{}, sc)
+	}
+	return ctx
+}
+
+// Inject sets the `traceparent` header for the current span in ctx.
+func Inject(ctx context.Context, h http.Header) {
+	if sc := SpanContextFromContext(ctx); sc.IsValid() {
+		h.Set("traceparent", sc.Traceparent())
+	}
+}
+
+// Detach returns a context carrying the span of ctx, but none of its
+// deadline or cancelation. Use it for work outliving a request.
+func Detach(ctx context.Context) context.Context {
+	detached := context.Background()
+	if span, ok := ctx.Value(spanKey{}).(*Span); ok {
+		detached = context.WithValue(detached, spanKey{}, span)
+	}
+	if sc, ok := ctx.Value(remoteKey{}).(SpanContext); ok {
+		detached = context.WithValue(detached, remoteKey{}, sc)
+	}
+	return detached
+}
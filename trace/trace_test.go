@@ -0,0 +1,134 @@
+package trace
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type recorder struct {
+	spans []*Span
+}
+
+func (r *recorder) Export(span *Span) {
+	r.spans = append(r.spans, span)
+}
+
+func TestTraceparent(t *testing.T) {
+	h := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	sc, ok := ParseTraceparent(h)
+	assert.True(t, ok)
+	assert.True(t, sc.Sampled)
+	assert.Equal(t, h, sc.Traceparent())
+
+	for _, invalid := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-zzf067aa0ba902b7-01",
+	} {
+		_, ok := ParseTraceparent(invalid)
+		assert.False(t, ok, invalid)
+	}
+}
+
+func TestDisabled(t *testing.T) {
+	SetExporter(nil)
+
+	ctx, span := Start(context.Background(), "noop", KindInternal)
+	assert.Nil(t, span)
+	span.SetAttribute("key", "value")
+	span.End()
+
+	h := http.Header{}
+	Inject(ctx, h)
+	assert.Empty(t, h.Get("traceparent"))
+}
+
+func TestPropagation(t *testing.T) {
+	rec := &recorder{}
+	SetExporter(rec)
+	defer SetExporter(nil)
+
+	incoming := http.Header{}
+	incoming.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+
+	ctx, parent := Start(Extract(context.Background(), incoming), "server", KindServer)
+	_, child := Start(Detach(ctx), "storage", KindClient)
+	child.SetError(errors.New("HTTP 5xx"))
+
+	outgoing := http.Header{}
+	Inject(ctx, outgoing)
+	sc, ok := ParseTraceparent(outgoing.Get("traceparent"))
+	assert.True(t, ok)
+	assert.Equal(t, parent.Context, sc)
+
+	child.End()
+	parent.End()
+	parent.End()
+
+	assert.Equal(t, 2, len(rec.spans))
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", hexID(parent.Context.TraceID[:]))
+	assert.Equal(t, "00f067aa0ba902b7", hexID(parent.Parent.SpanID[:]))
+	assert.Equal(t, parent.Context.TraceID, child.Context.TraceID)
+	assert.Equal(t, parent.Context.SpanID, child.Parent.SpanID)
+}
+
+func TestOTLPExporter(t *testing.T) {
+	received := make(chan otlpRequest, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/traces", r.URL.Path)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+
+		var req otlpRequest
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&req))
+		received <- req
+	}))
+	defer collector.Close()
+
+	exporter := NewOTLPExporter(collector.URL, "busl")
+	SetExporter(exporter)
+	defer SetExporter(nil)
+
+	_, span := Start(context.Background(), "server.publish", KindServer)
+	span.SetAttribute("busl.key", "1/2/3")
+	span.SetError(errors.New("boom"))
+	span.End()
+	assert.Nil(t, exporter.Shutdown())
+
+	req := <-received
+	spans := req.ResourceSpans[0].ScopeSpans[0].Spans
+	assert.Equal(t, "service.name", req.ResourceSpans[0].Resource.Attributes[0].Key)
+	assert.Equal(t, 1, len(spans))
+	assert.Equal(t, "server.publish", spans[0].Name)
+	assert.Equal(t, KindServer, spans[0].Kind)
+	assert.Equal(t, hexID(span.Context.SpanID[:]), spans[0].SpanID)
+	assert.Equal(t, "1/2/3", spans[0].Attributes[0].Value.StringValue)
+	assert.Equal(t, 2, spans[0].Status.Code)
+}
+
+func TestWriterExporter(t *testing.T) {
+	var buf bytes.Buffer
+	SetExporter(NewWriterExporter(&buf))
+	defer SetExporter(nil)
+
+	_, span := Start(context.Background(), "broker.write", KindClient)
+	span.End()
+
+	var s jsonSpan
+	assert.Nil(t, json.Unmarshal(buf.Bytes(), &s))
+	assert.Equal(t, "broker.write", s.Name)
+	assert.Equal(t, hexID(span.Context.TraceID[:]), s.TraceID)
+}
+
+func hexID(b []byte) string {
+	return hex.EncodeToString(b)
+}
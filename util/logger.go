@@ -1,10 +1,17 @@
 package util
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 const prefix = "busl"
@@ -41,3 +48,292 @@ func source() string {
 	domain := env("HEROKU_HOST", defaultDomain)
 	return reverseDNS(fmt.Sprintf("%s.%s", prefix, domain)) + "." + os.Getenv("DYNO")
 }
+
+// Level is the severity of a log line
+type Level int
+
+// Log levels
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	return levelNames[l]
+}
+
+// Log formats
+const (
+	FormatL2met = "l2met" // key=value lines through the log package
+	FormatJSON  = "json"  // one JSON object per line
+)
+
+var logConfig = struct {
+	sync.RWMutex
+	format string
+	level  Level
+	output io.Writer
+}{format: FormatL2met, level: LevelInfo, output: os.Stderr}
+
+// Serializes JSON lines so they never interleave
+var writeMu sync.Mutex
+
+// SetLogFormat switches between the l2met (default) and json formats.
+// In the json format, lines written through the log package are turned
+// into JSON objects as well.
+func SetLogFormat(format string) error {
+	logConfig.Lock()
+	defer logConfig.Unlock()
+
+	switch format {
+	case FormatL2met:
+		log.SetOutput(logConfig.output)
+		log.SetPrefix(fmt.Sprintf("app=%s source=%s pid=%v ", prefix, source(), os.Getpid()))
+	case FormatJSON:
+		log.SetOutput(jsonLogWriter{})
+		log.SetPrefix("")
+	default:
+		return fmt.Errorf("unknown log format %q", format)
+	}
+	logConfig.format = format
+	return nil
+}
+
+// SetLogLevel sets the minimum level logged, `info` by default
+func SetLogLevel(level string) error {
+	for i, name := range levelNames {
+		if name == level {
+			logConfig.Lock()
+			defer logConfig.Unlock()
+			logConfig.level = Level(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown log level %q", level)
+}
+
+// SetLogOutput sets where logs are written, stderr by default
+func SetLogOutput(w io.Writer) {
+	logConfig.Lock()
+	defer logConfig.Unlock()
+	logConfig.output = w
+	if logConfig.format == FormatL2met {
+		log.SetOutput(w)
+	}
+}
+
+// JSONLogs tells whether logs are in the JSON format
+func JSONLogs() bool {
+	logConfig.RLock()
+	defer logConfig.RUnlock()
+	return logConfig.format == FormatJSON
+}
+
+// Fields are the structured context of a log line. Commonly used:
+// request_id, key, remote_addr, bytes and duration.
+type Fields map[string]interface{}
+
+// Logger writes leveled log lines carrying a set of fields
+type Logger struct {
+	fields Fields
+}
+
+// NewLogger creates a logger always adding fields to its lines
+func NewLogger(fields Fields) *Logger {
+	return (&Logger{}).With(fields)
+}
+
+// With returns a logger adding fields to the ones of l
+func (l *Logger) With(fields Fields) *Logger {
+	merged := make(Fields, len(l.fields)+len(fields))
+	for k, v := range l.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	return &Logger{fields: merged}
+}
+
+// Debug logs at the debug level
+func (l *Logger) Debug(msg string, fields ...Fields) { l.log(LevelDebug, msg, fields) }
+
+// Info logs at the info level
+func (l *Logger) Info(msg string, fields ...Fields) { l.log(LevelInfo, msg, fields) }
+
+// Warn logs at the warn level
+func (l *Logger) Warn(msg string, fields ...Fields) { l.log(LevelWarn, msg, fields) }
+
+// Error logs at the error level
+func (l *Logger) Error(msg string, fields ...Fields) { l.log(LevelError, msg, fields) }
+
+func (l *Logger) log(level Level, msg string, extra []Fields) {
+	logConfig.RLock()
+	format, minLevel, output := logConfig.format, logConfig.level, logConfig.output
+	logConfig.RUnlock()
+
+	if level < minLevel {
+		return
+	}
+
+	for _, f := range extra {
+		l = l.With(f)
+	}
+
+	if format == FormatJSON {
+		writeJSON(output, level, msg, l.fields)
+	} else {
+		writeL2met(level, msg, l.fields)
+	}
+}
+
+func writeJSON(w io.Writer, level Level, msg string, fields Fields) {
+	line := make(map[string]interface{}, len(fields)+6)
+	for k, v := range fields {
+		switch val := v.(type) {
+		case time.Duration:
+			v = val.Seconds()
+		case error:
+			v = val.Error()
+		}
+		line[k] = v
+	}
+	line["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	line["level"] = level.String()
+	line["msg"] = msg
+	line["app"] = prefix
+	line["source"] = source()
+	line["pid"] = os.Getpid()
+
+	buf, err := json.Marshal(line)
+	if err != nil {
+		buf, _ = json.Marshal(map[string]string{"level": "error", "msg": "log.marshal", "error": err.Error()})
+	}
+
+	writeMu.Lock()
+	defer writeMu.Unlock()
+	w.Write(append(buf, '\n'))
+}
+
+func writeL2met(level Level, msg string, fields Fields) {
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := []string{msg}
+	if level != LevelInfo {
+		parts = append(parts, "level="+level.String())
+	}
+	for _, k := range keys {
+		parts = append(parts, k+"="+l2metValue(fields[k]))
+	}
+	log.Print(strings.Join(parts, " "))
+}
+
+func l2metValue(v interface{}) string {
+	switch v := v.(type) {
+	case time.Duration:
+		return fmt.Sprintf("%f", v.Seconds())
+	case error:
+		return strconv.Quote(v.Error())
+	case string:
+		if v == "" || strings.ContainsAny(v, " \"=") {
+			return strconv.Quote(v)
+		}
+		return v
+	}
+	return fmt.Sprint(v)
+}
+
+// jsonLogWriter turns the l2met lines written through the log package
+// into JSON lines: key=value pairs become fields, the rest the message.
+type jsonLogWriter struct{}
+
+func (jsonLogWriter) Write(p []byte) (int, error) {
+	logConfig.RLock()
+	output := logConfig.output
+	logConfig.RUnlock()
+
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		msg, fields := parseL2met(line)
+		writeJSON(output, LevelInfo, msg, fields)
+	}
+	return len(p), nil
+}
+
+// parseL2met splits a line of space separated words and key=value
+// pairs, where values may be double quoted.
+func parseL2met(line string) (string, Fields) {
+	var words []string
+	fields := Fields{}
+
+	for line = strings.TrimSpace(line); line != ""; line = strings.TrimSpace(line) {
+		end := strings.IndexByte(line, ' ')
+		if end < 0 {
+			end = len(line)
+		}
+
+		eq := strings.IndexByte(line[:end], '=')
+		if eq <= 0 {
+			words = append(words, line[:end])
+			line = line[end:]
+			continue
+		}
+
+		key, rest := line[:eq], line[eq+1:]
+		if strings.HasPrefix(rest, `"`) {
+			if n := closingQuote(rest); n > 0 {
+				if val, err := strconv.Unquote(rest[:n+1]); err == nil {
+					fields[key] = val
+					line = rest[n+1:]
+					continue
+				}
+			}
+		}
+
+		end = strings.IndexByte(rest, ' ')
+		if end < 0 {
+			end = len(rest)
+		}
+		fields[key] = rest[:end]
+		line = rest[end:]
+	}
+
+	return strings.Join(words, " "), fields
+}
+
+// closingQuote returns the index of the quote ending the string
+// starting at s[0], or -1.
+func closingQuote(s string) int {
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			return i
+		}
+	}
+	return -1
+}
+
+type loggerKey struct{}
+
+// WithLogger returns a context carrying the given request logger
+func WithLogger(ctx context.Context, l *Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, l)
+}
+
+// LoggerFromContext returns the request logger in ctx, or a logger
+// without any fields.
+func LoggerFromContext(ctx context.Context) *Logger {
+	if l, ok := ctx.Value(loggerKey{}).(*Logger); ok {
+		return l
+	}
+	return &Logger{}
+}
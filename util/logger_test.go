@@ -0,0 +1,99 @@
+package util
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func withLogs(t *testing.T, format, level string) *bytes.Buffer {
+	var buf bytes.Buffer
+	SetLogOutput(&buf)
+	assert.NoError(t, SetLogFormat(format))
+	assert.NoError(t, SetLogLevel(level))
+	return &buf
+}
+
+func resetLogs() {
+	SetLogOutput(os.Stderr)
+	SetLogFormat(FormatL2met)
+	SetLogLevel("info")
+}
+
+func decodeLines(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	var lines []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var v map[string]interface{}
+		assert.NoError(t, json.Unmarshal([]byte(line), &v), line)
+		lines = append(lines, v)
+	}
+	return lines
+}
+
+func TestJSONLogger(t *testing.T) {
+	buf := withLogs(t, FormatJSON, "info")
+	defer resetLogs()
+
+	logger := NewLogger(Fields{"request_id": "abc"}).With(Fields{"key": "1/2/3"})
+	logger.Debug("skipped")
+	logger.Info("server.pub.end", Fields{"bytes": 10, "duration": 1500 * time.Millisecond})
+	log.Printf("count#busl.x=1 request_id=%q", "a b")
+
+	lines := decodeLines(t, buf)
+	assert.Len(t, lines, 2)
+
+	assert.Equal(t, "info", lines[0]["level"])
+	assert.Equal(t, "server.pub.end", lines[0]["msg"])
+	assert.Equal(t, "abc", lines[0]["request_id"])
+	assert.Equal(t, "1/2/3", lines[0]["key"])
+	assert.Equal(t, float64(10), lines[0]["bytes"])
+	assert.Equal(t, 1.5, lines[0]["duration"])
+
+	assert.Equal(t, "1", lines[1]["count#busl.x"])
+	assert.Equal(t, "a b", lines[1]["request_id"])
+}
+
+func TestL2metLogger(t *testing.T) {
+	buf := withLogs(t, FormatL2met, "warn")
+	defer resetLogs()
+
+	logger := NewLogger(Fields{"request_id": "abc", "path": "/a b"})
+	logger.Info("skipped")
+	logger.Error("server.error", Fields{"bytes": 3})
+
+	out := buf.String()
+	assert.NotContains(t, out, "skipped")
+	assert.Contains(t, out, `server.error level=error bytes=3 path="/a b" request_id=abc`)
+}
+
+func TestJSONMetrics(t *testing.T) {
+	buf := withLogs(t, FormatJSON, "info")
+	defer resetLogs()
+
+	CountWithData("server.pub", 2, "request_id=%q", "abc")
+
+	lines := decodeLines(t, buf)
+	assert.Len(t, lines, 1)
+	assert.Equal(t, "metric", lines[0]["msg"])
+	assert.Equal(t, "busl.server.pub", lines[0]["metric"])
+	assert.Equal(t, "count", lines[0]["type"])
+	assert.Equal(t, float64(2), lines[0]["value"])
+	assert.Equal(t, "abc", lines[0]["request_id"])
+}
+
+func TestParseL2met(t *testing.T) {
+	msg, fields := parseL2met(`http.start count#busl.x=1 msg="a \"quoted\" value" bare=`)
+	assert.Equal(t, "http.start", msg)
+	assert.Equal(t, Fields{"count#busl.x": "1", "msg": `a "quoted" value`, "bare": ""}, fields)
+}
+
+func TestSetLogFormatUnknown(t *testing.T) {
+	assert.Error(t, SetLogFormat("xml"))
+	assert.Error(t, SetLogLevel("loud"))
+}
@@ -4,9 +4,37 @@ import (
 	"fmt"
 	"log"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
+// Sink receives the metrics busl emits. extraData is the formatted
+// context of the metric (request ids, errors...), which only makes
+// sense for log based sinks.
+type Sink interface {
+	Count(metric string, count int64, extraData string)
+	Sample(metric string, value int64, extraData string)
+	Measure(metric string, elapsed time.Duration, extraData string)
+}
+
+var sinks atomic.Value
+
+func init() {
+	SetSinks(LogSink{})
+}
+
+// SetSinks replaces the sinks metrics are sent to. Metrics are
+// logged in the l2met format by default.
+func SetSinks(s ...Sink) {
+	sinks.Store(s)
+}
+
+func each(fn func(Sink)) {
+	for _, sink := range sinks.Load().([]Sink) {
+		fn(sink)
+	}
+}
+
 // Count parses a string into a count for logging to librato
 func Count(metric string) { CountMany(metric, 1) }
 
@@ -15,21 +43,24 @@ func CountMany(metric string, count int64) { CountWithData(metric, count, "") }
 
 // CountWithData parses metrics for logging to librato
 func CountWithData(metric string, count int64, extraData string, v ...interface{}) {
-	if extraData == "" {
-		log.Printf("count#busl.%s=%d", metric, count)
-	} else {
-		log.Printf("count#busl.%s=%d %s", metric, count, fmt.Sprintf(extraData, v...))
-	}
+	extra := sprintf(extraData, v...)
+	each(func(s Sink) { s.Count(metric, count, extra) })
 }
 
 func Sample(metric string, value int64) { SampleWithData(metric, value, "") }
 
 func SampleWithData(metric string, value int64, extraData string, v ...interface{}) {
-	if extraData == "" {
-		log.Printf("sample#busl.%s=%d", metric, value)
-	} else {
-		log.Printf("sample#busl.%s=%d %s", metric, value, fmt.Sprintf(extraData, v...))
-	}
+	extra := sprintf(extraData, v...)
+	each(func(s Sink) { s.Sample(metric, value, extra) })
+}
+
+// Measure records how long an operation took
+func Measure(metric string, elapsed time.Duration) { MeasureWithData(metric, elapsed, "") }
+
+// MeasureWithData records how long an operation took, with context
+func MeasureWithData(metric string, elapsed time.Duration, extraData string, v ...interface{}) {
+	extra := sprintf(extraData, v...)
+	each(func(s Sink) { s.Measure(metric, elapsed, extra) })
 }
 
 func SMeasure(subject string, object string) string {
@@ -42,6 +73,57 @@ func TimerStart(subject string, extras ...string) (time.Time, string, []string)
 }
 
 func TimerEnd(startTime time.Time, subject string, extras []string) {
-	elapsed := fmt.Sprintf("%f", time.Now().Sub(startTime).Seconds())
-	log.Printf("%s.timer.end %s %s", subject, SMeasure(subject+".elapsed.seconds", elapsed), strings.Join(extras, " "))
+	MeasureWithData(subject, time.Now().Sub(startTime), "%s", strings.Join(extras, " "))
+}
+
+func sprintf(format string, v ...interface{}) string {
+	if format == "" {
+		return ""
+	}
+	return fmt.Sprintf(format, v...)
+}
+
+// LogSink logs metrics in the l2met format
+type LogSink struct{}
+
+// Count implements Sink
+func (LogSink) Count(metric string, count int64, extraData string) {
+	if JSONLogs() {
+		logMetric("count", metric, count, extraData)
+	} else if extraData == "" {
+		log.Printf("count#busl.%s=%d", metric, count)
+	} else {
+		log.Printf("count#busl.%s=%d %s", metric, count, extraData)
+	}
+}
+
+// Sample implements Sink
+func (LogSink) Sample(metric string, value int64, extraData string) {
+	if JSONLogs() {
+		logMetric("sample", metric, value, extraData)
+	} else if extraData == "" {
+		log.Printf("sample#busl.%s=%d", metric, value)
+	} else {
+		log.Printf("sample#busl.%s=%d %s", metric, value, extraData)
+	}
+}
+
+// Measure implements Sink
+func (LogSink) Measure(metric string, elapsed time.Duration, extraData string) {
+	if JSONLogs() {
+		logMetric("measure", metric, elapsed.Seconds(), extraData)
+		return
+	}
+	seconds := fmt.Sprintf("%f", elapsed.Seconds())
+	log.Printf("%s.timer.end %s %s", metric, SMeasure(metric+".elapsed.seconds", seconds), extraData)
+}
+
+// logMetric logs a metric as a structured line, the l2met pairs of
+// extraData becoming fields.
+func logMetric(kind, metric string, value interface{}, extraData string) {
+	_, fields := parseL2met(extraData)
+	fields["metric"] = prefix + "." + metric
+	fields["type"] = kind
+	fields["value"] = value
+	(&Logger{}).Info("metric", fields)
 }
@@ -0,0 +1,61 @@
+package util
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrometheusSink(t *testing.T) {
+	sink := NewPrometheusSink()
+	SetSinks(sink)
+	defer SetSinks(LogSink{})
+
+	Count("server.sub.read.finish")
+	CountWithData("server.sub.read.finish", 2, "request_id=%q", "abc")
+	Sample("redis.connections", 3)
+	Measure("storage.get", 30*time.Millisecond)
+	Measure("storage.get", 2*time.Hour)
+
+	var buf bytes.Buffer
+	sink.WriteTo(&buf)
+	out := buf.String()
+
+	assert.Contains(t, out, "# TYPE busl_server_sub_read_finish_total counter\nbusl_server_sub_read_finish_total 3\n")
+	assert.Contains(t, out, "# TYPE busl_redis_connections gauge\nbusl_redis_connections 3\n")
+	assert.Contains(t, out, "# TYPE busl_storage_get_seconds histogram\n")
+	assert.Contains(t, out, "busl_storage_get_seconds_bucket{le=\"0.025\"} 0\n")
+	assert.Contains(t, out, "busl_storage_get_seconds_bucket{le=\"0.05\"} 1\n")
+	assert.Contains(t, out, "busl_storage_get_seconds_bucket{le=\"3600\"} 1\n")
+	assert.Contains(t, out, "busl_storage_get_seconds_bucket{le=\"+Inf\"} 2\n")
+	assert.Contains(t, out, "busl_storage_get_seconds_count 2\n")
+}
+
+func TestStatsDSink(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	sink, err := NewStatsDSink(conn.LocalAddr().String())
+	assert.Nil(t, err)
+	defer sink.Close()
+
+	sink.Count("server.close", 1, "")
+	sink.Sample("redis.connections", 4, "")
+	sink.Measure("storage.put", 1500*time.Millisecond, "")
+
+	var packets []string
+	buf := make([]byte, 512)
+	for i := 0; i < 3; i++ {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		assert.Nil(t, err)
+		packets = append(packets, string(buf[:n]))
+	}
+
+	assert.Equal(t, "busl.server.close:1|c busl.redis.connections:4|g busl.storage.put:1500|ms", strings.Join(packets, " "))
+}
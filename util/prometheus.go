@@ -0,0 +1,150 @@
+package util
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Upper bounds, in seconds, of the duration histograms buckets.
+// Subscriptions can last up to an hour.
+var defaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 300, 1800, 3600}
+
+var invalidMetricChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+// PrometheusSink aggregates metrics in memory and serves them in the
+// Prometheus text format: counts become counters, samples gauges and
+// measures histograms.
+type PrometheusSink struct {
+	mutex      sync.Mutex
+	counters   map[string]float64
+	gauges     map[string]float64
+	histograms map[string]*histogram
+}
+
+// NewPrometheusSink creates an empty Prometheus sink
+func NewPrometheusSink() *PrometheusSink {
+	return &PrometheusSink{
+		counters:   make(map[string]float64),
+		gauges:     make(map[string]float64),
+		histograms: make(map[string]*histogram),
+	}
+}
+
+func prometheusName(metric string) string {
+	return prefix + "_" + invalidMetricChars.ReplaceAllString(metric, "_")
+}
+
+// Count implements Sink
+func (p *PrometheusSink) Count(metric string, count int64, extraData string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.counters[prometheusName(metric)+"_total"] += float64(count)
+}
+
+// Sample implements Sink
+func (p *PrometheusSink) Sample(metric string, value int64, extraData string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.gauges[prometheusName(metric)] = float64(value)
+}
+
+// Measure implements Sink
+func (p *PrometheusSink) Measure(metric string, elapsed time.Duration, extraData string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	name := prometheusName(metric) + "_seconds"
+	h, ok := p.histograms[name]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(defaultBuckets))}
+		p.histograms[name] = h
+	}
+
+	seconds := elapsed.Seconds()
+	if i := sort.SearchFloat64s(defaultBuckets, seconds); i < len(defaultBuckets) {
+		h.counts[i]++
+	}
+	h.count++
+	h.sum += seconds
+}
+
+// ServeHTTP serves the metrics for Prometheus to scrape
+func (p *PrometheusSink) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	p.WriteTo(w)
+}
+
+// WriteTo writes the metrics in the Prometheus text format
+func (p *PrometheusSink) WriteTo(w io.Writer) (int64, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	cw := &countingWriter{w: w}
+	for _, name := range sortedKeys(p.counters) {
+		fmt.Fprintf(cw, "# TYPE %s counter\n%s %s\n", name, name, formatFloat(p.counters[name]))
+	}
+	for _, name := range sortedKeys(p.gauges) {
+		fmt.Fprintf(cw, "# TYPE %s gauge\n%s %s\n", name, name, formatFloat(p.gauges[name]))
+	}
+
+	names := make([]string, 0, len(p.histograms))
+	for name := range p.histograms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		h := p.histograms[name]
+		fmt.Fprintf(cw, "# TYPE %s histogram\n", name)
+
+		var cumulative uint64
+		for i, bound := range defaultBuckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(cw, "%s_bucket{le=\"%s\"} %d\n", name, formatFloat(bound), cumulative)
+		}
+		fmt.Fprintf(cw, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+		fmt.Fprintf(cw, "%s_sum %s\n%s_count %d\n", name, formatFloat(h.sum), name, h.count)
+	}
+	return cw.n, cw.err
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+type countingWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	c.err = err
+	return n, err
+}
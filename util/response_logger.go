@@ -5,18 +5,32 @@ import (
 	"log"
 	"net/http"
 	"strconv"
+	"time"
 )
 
 // NewResponseLogger creates a new logger for HTTP responses
 func NewResponseLogger(r *http.Request, w http.ResponseWriter) *ResponseLogger {
-	return &ResponseLogger{ResponseWriter: w, request: r, status: http.StatusOK}
+	l := &ResponseLogger{ResponseWriter: w, request: r, status: http.StatusOK, start: time.Now()}
+	l.id = l.requestID()
+	l.Logger = NewLogger(Fields{
+		"request_id":  l.id,
+		"remote_addr": r.RemoteAddr,
+		"method":      r.Method,
+		"path":        r.URL.Path,
+	})
+	return l
 }
 
 // ResponseLogger is a logger for HTTP responses
 type ResponseLogger struct {
 	http.ResponseWriter
+	*Logger // carries the fields of the request
+
 	request *http.Request
 	status  int
+	bytes   int64
+	start   time.Time
+	id      string
 }
 
 // WriteHeader writes a new header to the response
@@ -25,6 +39,13 @@ func (l *ResponseLogger) WriteHeader(s int) {
 	l.status = s
 }
 
+// Write writes to the response, counting the bytes sent
+func (l *ResponseLogger) Write(p []byte) (int, error) {
+	n, err := l.ResponseWriter.Write(p)
+	l.bytes += int64(n)
+	return n, err
+}
+
 // CloseNotify returns a chan notifying when the connection is being closed
 func (l *ResponseLogger) CloseNotify() <-chan bool {
 	return l.ResponseWriter.(http.CloseNotifier).CloseNotify()
@@ -56,7 +77,21 @@ func (l *ResponseLogger) requestID() (id string) {
 // WriteLog logs the response
 func (l *ResponseLogger) WriteLog() {
 	maskedStatus := strconv.Itoa(l.status/100) + "xx"
-	CountWithData(fmt.Sprintf("http.status.%s", maskedStatus), 1, "request_id=%s", l.requestID())
-	log.Printf("method=%s path=\"%s\" host=\"%s\" fwd=\"%s\" status=%d user_agent=\"%s\" request_id=%s",
-		l.request.Method, l.request.URL.Path, l.request.Host, l.request.Header.Get("X-Forwarded-For"), l.status, l.request.UserAgent(), l.requestID())
+	CountWithData(fmt.Sprintf("http.status.%s", maskedStatus), 1, "request_id=%s", l.id)
+
+	duration := time.Since(l.start)
+	if JSONLogs() {
+		l.Info("http.request", Fields{
+			"host":       l.request.Host,
+			"fwd":        l.request.Header.Get("X-Forwarded-For"),
+			"status":     l.status,
+			"user_agent": l.request.UserAgent(),
+			"bytes":      l.bytes,
+			"duration":   duration,
+		})
+		return
+	}
+
+	log.Printf("method=%s path=\"%s\" host=\"%s\" fwd=\"%s\" status=%d user_agent=\"%s\" request_id=%s bytes=%d duration=%f",
+		l.request.Method, l.request.URL.Path, l.request.Host, l.request.Header.Get("X-Forwarded-For"), l.status, l.request.UserAgent(), l.id, l.bytes, duration.Seconds())
 }
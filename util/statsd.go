@@ -0,0 +1,46 @@
+package util
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// StatsDSink sends metrics to a StatsD server over UDP. Packets are
+// fire and forget: a missing or slow server never blocks busl.
+type StatsDSink struct {
+	conn net.Conn
+}
+
+// NewStatsDSink creates a sink sending to addr, e.g. `localhost:8125`
+func NewStatsDSink(addr string) (*StatsDSink, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &StatsDSink{conn: conn}, nil
+}
+
+func (s *StatsDSink) send(metric string, value int64, kind string) {
+	fmt.Fprintf(s.conn, "%s.%s:%d|%s", prefix, metric, value, kind)
+}
+
+// Count implements Sink
+func (s *StatsDSink) Count(metric string, count int64, extraData string) {
+	s.send(metric, count, "c")
+}
+
+// Sample implements Sink
+func (s *StatsDSink) Sample(metric string, value int64, extraData string) {
+	s.send(metric, value, "g")
+}
+
+// Measure implements Sink
+func (s *StatsDSink) Measure(metric string, elapsed time.Duration, extraData string) {
+	s.send(metric, int64(elapsed/time.Millisecond), "ms")
+}
+
+// Close closes the underlying connection
+func (s *StatsDSink) Close() error {
+	return s.conn.Close()
+}